@@ -0,0 +1,232 @@
+/*
+ * Batch processing of an upload directory: files are grouped by
+ * document id, documents with enough shares on hand (shares encrypted
+ * for keys in the secret keyring) are decrypted into an output
+ * directory and a summary report is produced.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+// status of documents in a batch
+const (
+	STATUS_READY     = "ready"             // enough shares on hand
+	STATUS_SHARES    = "not enough shares" // too few shares on hand
+	STATUS_MISSING   = "no document"       // document file missing
+	STATUS_DECRYPTED = "decrypted"         // document decrypted
+	STATUS_FAILED    = "failed"            // decryption failed
+)
+
+// names of upload files: <16-digit id>.<suffix>
+var uploadFile = regexp.MustCompile(`^([0-9]{16})\.(.+)$`)
+
+// suffix of share files: <KEYID>.gpg
+var shareSuffix = regexp.MustCompile(`^([0-9A-Fa-f]{1,8})\.gpg$`)
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Files of a document in an upload directory.
+ */
+type DocumentSet struct {
+	Id       string            // document id
+	Document string            // name of encrypted document file ("": missing)
+	Shares   map[uint32]string // share files (by key id)
+	OnHand   []string          // share files for keys in the secret keyring
+	Status   string            // status of document
+	Info     string            // additional information (output file, error)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Scan an upload directory: files are grouped by document id.
+ * @param dir string - upload directory
+ * @return []*DocumentSet - documents in directory (sorted by id)
+ * @return error - error object (or nil)
+ */
+func ScanDirectory(dir string) ([]*DocumentSet, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sets := make(map[string]*DocumentSet)
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		m := uploadFile.FindStringSubmatch(fi.Name())
+		if m == nil {
+			continue
+		}
+		set, ok := sets[m[1]]
+		if !ok {
+			set = &DocumentSet{Id: m[1], Shares: make(map[uint32]string)}
+			sets[m[1]] = set
+		}
+		fname := filepath.Join(dir, fi.Name())
+		if m[2] == "document.aes256" {
+			set.Document = fname
+		} else if s := shareSuffix.FindStringSubmatch(m[2]); s != nil {
+			id, _ := strconv.ParseUint(s[1], 16, 32)
+			set.Shares[uint32(id)] = fname
+		}
+	}
+	// only documents with a document file or shares are listed
+	list := make([]*DocumentSet, 0, len(sets))
+	for _, set := range sets {
+		if len(set.Document) > 0 || len(set.Shares) > 0 {
+			list = append(list, set)
+		}
+	}
+	sort.Sort(byId(list))
+	return list, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check which documents can be decrypted with the shares on hand.
+ * @param list []*DocumentSet - documents in upload directory
+ * @param keys map[uint32]bool - key ids of secret keys
+ * @param treshold int - number of shares required
+ */
+func CheckDocuments(list []*DocumentSet, keys map[uint32]bool, treshold int) {
+	for _, set := range list {
+		set.OnHand = nil
+		for id, fname := range set.Shares {
+			if keys[id] {
+				set.OnHand = append(set.OnHand, fname)
+			}
+		}
+		sort.Strings(set.OnHand)
+		switch {
+		case len(set.Document) == 0:
+			set.Status = STATUS_MISSING
+		case len(set.OnHand) < treshold || len(set.OnHand) == 0:
+			set.Status = STATUS_SHARES
+		default:
+			set.Status = STATUS_READY
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Process an upload directory: all documents with enough shares on
+ * hand are decrypted to the output directory (if not only listed).
+ * @param dir string - upload directory
+ * @param outDir string - output directory
+ * @param treshold int - number of shares required
+ * @param listOnly bool - only list documents (no decryption)
+ * @return []*DocumentSet - processed documents
+ * @return error - error object (or nil)
+ */
+func ProcessBatch(dir, outDir string, treshold int, listOnly bool) ([]*DocumentSet, error) {
+	list, err := ScanDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	if keyring, err = LoadKeyring(keyringFile); err != nil {
+		return nil, fmt.Errorf("can't read secret keyring '%s': %s", keyringFile, err.Error())
+	}
+	keys := make(map[uint32]bool)
+	for _, key := range keyring.DecryptionKeys() {
+		keys[uint32(key.Entity.PrimaryKey.KeyId&0xFFFFFFFF)] = true
+	}
+	CheckDocuments(list, keys, treshold)
+	if listOnly {
+		return list, nil
+	}
+	if err = os.MkdirAll(outDir, 0700); err != nil {
+		return nil, err
+	}
+	for _, set := range list {
+		if set.Status != STATUS_READY {
+			continue
+		}
+		fmt.Printf("\n=== Document %s\n", set.Id)
+		res, err := DecryptDocument(set.Document, set.OnHand, outDir)
+		if err != nil {
+			fmt.Println("Error: " + err.Error())
+			set.Status = STATUS_FAILED
+			set.Info = err.Error()
+			continue
+		}
+		set.Status = STATUS_DECRYPTED
+		set.Info = res.Output
+		if n := len(res.Warnings); n > 0 {
+			set.Info += fmt.Sprintf(" (%d warning(s): %s)", n, strings.Join(res.Warnings, "; "))
+		}
+		fmt.Printf("Document decrypted to '%s'\n", res.Output)
+	}
+	return list, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create summary report for processed documents.
+ * @param list []*DocumentSet - processed documents
+ * @return []byte - report
+ */
+func Report(list []*DocumentSet) []byte {
+	buf := new(bytes.Buffer)
+	count := make(map[string]int)
+	fmt.Fprintf(buf, "%-16s  %-7s  %s\n", "Document", "Shares", "Status")
+	for _, set := range list {
+		count[set.Status]++
+		shares := fmt.Sprintf("%d/%d", len(set.OnHand), len(set.Shares))
+		status := set.Status
+		if len(set.Info) > 0 {
+			status += ": " + set.Info
+		}
+		fmt.Fprintf(buf, "%-16s  %-7s  %s\n", set.Id, shares, status)
+	}
+	fmt.Fprintf(buf, "\n%d document(s)", len(list))
+	for _, status := range []string{STATUS_DECRYPTED, STATUS_READY, STATUS_FAILED, STATUS_SHARES, STATUS_MISSING} {
+		if n := count[status]; n > 0 {
+			fmt.Fprintf(buf, ", %d %s", n, status)
+		}
+	}
+	fmt.Fprintln(buf)
+	return buf.Bytes()
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper types
+
+// sort documents by id
+type byId []*DocumentSet
+
+func (l byId) Len() int           { return len(l) }
+func (l byId) Less(i, j int) bool { return l[i].Id < l[j].Id }
+func (l byId) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,177 @@
+/*
+ * Stand-alone decryption application: batch mode tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Create an upload directory with given files.
+ * @param t *testing.T - test instance
+ * @param names []string - names of files (directories end with '/')
+ * @return string - upload directory
+ */
+func testUploadDir(t *testing.T, names []string) string {
+	dir, err := ioutil.TempDir("", "dcd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		fname := filepath.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			err = os.Mkdir(fname, 0700)
+		} else {
+			err = ioutil.WriteFile(fname, []byte("data"), 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Files in an upload directory are grouped by document id; unrelated
+ * files are ignored.
+ */
+func TestScanDirectory(t *testing.T) {
+	dir := testUploadDir(t, []string{
+		"1234567890123456.document.aes256",
+		"1234567890123456.meta.aes256",
+		"1234567890123456.commit",
+		"1234567890123456.DA714896.gpg",
+		"1234567890123456.487608d5.gpg",
+		"1234567890123456.ABC.gpg",
+		"1234567890123456.DA714896.response",
+		"2222222222222222.DA714896.gpg",
+		"3333333333333333.document.aes256",
+		"4444444444444444.meta.aes256",
+		"5555555555555555.123456789.gpg",
+		"5555555555555555.document.aes256.part",
+		"6666666666666666.document.aes256/",
+		"123.document.aes256",
+		"12345678901234567.document.aes256",
+		"123456789012345a.document.aes256",
+		"x1234567890123456.document.aes256",
+		"notes.txt",
+		"pubring.gpg",
+	})
+	defer os.RemoveAll(dir)
+	list, err := ScanDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		for _, set := range list {
+			t.Logf("%s: '%s' %v", set.Id, set.Document, set.Shares)
+		}
+		t.Fatalf("%d documents instead of 3", len(list))
+	}
+	doc := list[0]
+	if doc.Id != "1234567890123456" || doc.Document != filepath.Join(dir, "1234567890123456.document.aes256") {
+		t.Fatalf("wrong document %s: '%s'", doc.Id, doc.Document)
+	}
+	if len(doc.Shares) != 3 || doc.Shares[0xDA714896] != filepath.Join(dir, "1234567890123456.DA714896.gpg") ||
+		doc.Shares[0x487608D5] != filepath.Join(dir, "1234567890123456.487608d5.gpg") || len(doc.Shares[0xABC]) == 0 {
+		t.Fatalf("wrong shares %v", doc.Shares)
+	}
+	if list[1].Id != "2222222222222222" || len(list[1].Document) != 0 || len(list[1].Shares) != 1 {
+		t.Fatal("share without document not listed")
+	}
+	if list[2].Id != "3333333333333333" || len(list[2].Document) == 0 || len(list[2].Shares) != 0 {
+		t.Fatal("document without shares not listed")
+	}
+
+	// unreadable directory
+	if _, err = ScanDirectory(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("missing directory scanned")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Documents are ready for decryption if enough shares are on hand.
+ */
+func TestCheckDocuments(t *testing.T) {
+	dir := testUploadDir(t, []string{
+		"1234567890123456.document.aes256",
+		"1234567890123456.DA714896.gpg",
+		"1234567890123456.487608D5.gpg",
+		"1234567890123456.0000ABCD.gpg",
+		"2222222222222222.DA714896.gpg",
+		"2222222222222222.487608D5.gpg",
+		"3333333333333333.document.aes256",
+	})
+	defer os.RemoveAll(dir)
+	list, err := ScanDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[uint32]bool{0xDA714896: true, 0x487608D5: true, 0x11111111: true}
+	for _, tc := range []struct {
+		treshold int
+		status   []string
+	}{
+		{2, []string{STATUS_READY, STATUS_MISSING, STATUS_SHARES}},
+		{3, []string{STATUS_SHARES, STATUS_MISSING, STATUS_SHARES}},
+		{0, []string{STATUS_READY, STATUS_MISSING, STATUS_SHARES}},
+	} {
+		CheckDocuments(list, keys, tc.treshold)
+		for i, set := range list {
+			if set.Status != tc.status[i] {
+				t.Fatalf("treshold %d: %s is '%s' (expected '%s')", tc.treshold, set.Id, set.Status, tc.status[i])
+			}
+		}
+		onHand := []string{
+			filepath.Join(dir, "1234567890123456.487608D5.gpg"),
+			filepath.Join(dir, "1234567890123456.DA714896.gpg"),
+		}
+		if len(list[0].OnHand) != 2 || list[0].OnHand[0] != onHand[0] || list[0].OnHand[1] != onHand[1] {
+			t.Fatalf("wrong shares on hand %v", list[0].OnHand)
+		}
+	}
+
+	// summary report
+	report := string(Report(list))
+	for _, s := range []string{
+		"1234567890123456  2/3      ready\n",
+		"2222222222222222  2/2      no document\n",
+		"3333333333333333  0/0      not enough shares\n",
+		"3 document(s), 1 ready, 1 not enough shares, 1 no document\n",
+	} {
+		if !strings.Contains(report, s) {
+			t.Fatalf("'%s' not in report:\n%s", strings.TrimSpace(s), report)
+		}
+	}
+}
@@ -24,17 +24,43 @@ package main
 
 import (
 	"bufio"
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/armor"
+	pgperr "code.google.com/p/go.crypto/openpgp/errors"
+	"code.google.com/p/go.crypto/ssh/terminal"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/bfix/gospel/crypto"
 	"io"
-	"math/big"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sid/container"
 	"strings"
 )
 
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	MAX_SHARE_SIZE   = 64 * 1024 // max. size of a share file
+	PASSPHRASE_TRIES = 3         // number of passphrase attempts per share
+	MAX_OUTPUT_NAMES = 1000      // max. number of numbered output names
+)
+
+///////////////////////////////////////////////////////////////////////
+// Global variables
+
+var (
+	keyringFile string                   // name of secret keyring
+	keyring     openpgp.EntityList = nil // secret keys of reviewers (loaded on demand)
+	session     *container.Session = nil // session of combining party (or nil)
+)
+
 ///////////////////////////////////////////////////////////////////////
 // Main application entry point
 /*
@@ -43,100 +69,801 @@ import (
 func main() {
 
 	// handle command line arguments
+	flag.StringVar(&keyringFile, "keyring", DefaultKeyring(), "secret keyring of reviewer(s) (binary or ASCII-armored)")
+	request := flag.Bool("request", false, "create a request for shares (combining party)")
+	respond := flag.String("respond", "", "answer a request for shares with sealed shares (reviewer)")
+	sessionFile := flag.String("session", "", "session file of a request for shares (combining party)")
+	batch := flag.String("batch", "", "process all documents in an upload directory")
+	outDir := flag.String("out", "", "output directory for batch processing (default: <dir>/decrypted) or for session files of requests (default: "+DefaultSessionDir()+")")
+	listOnly := flag.Bool("list", false, "only list documents in batch processing")
+	treshold := flag.Int("treshold", 2, "number of shares required for a document (batch processing)")
+	reportFile := flag.String("report", "", "file for summary report of batch processing")
 	flag.Parse()
 	args := flag.Args()
 	count := len(args)
-	if count < 2 {
-		fmt.Println("At least two arguments are expected -- abort!")
-		fmt.Println("dcd <document.aes256> <share1> [ ... <shareN> ]")
+
+	// batch processing of an upload directory
+	if len(*batch) > 0 {
+		if len(*outDir) == 0 {
+			*outDir = filepath.Join(*batch, "decrypted")
+		}
+		list, err := ProcessBatch(*batch, *outDir, *treshold, *listOnly)
+		if err != nil {
+			fmt.Printf("Failed to process directory '%s' -- abort!\n", *batch)
+			fmt.Println("Error: " + err.Error())
+			os.Exit(1)
+		}
+		report := Report(list)
+		fmt.Println()
+		os.Stdout.Write(report)
+		if len(*reportFile) > 0 {
+			if err = ioutil.WriteFile(*reportFile, report, 0600); err != nil {
+				fmt.Printf("Failed to write report '%s': %s\n", *reportFile, err.Error())
+				os.Exit(1)
+			}
+		}
+		for _, set := range list {
+			if set.Status == STATUS_FAILED {
+				os.Exit(1)
+			}
+		}
 		return
 	}
 
-	// read shares
-	shares := make([]crypto.Share, count-1)
-	for n := 1; n < count; n++ {
-		f, err := os.Open(args[n])
-		if err != nil {
-			fmt.Printf("Failed to open file '%s' -- abort!\n", args[n])
+	// distributed combination of shares: create a request or answer it
+	if *request {
+		if count != 1 {
+			Usage()
+			return
+		}
+		if len(*outDir) == 0 {
+			*outDir = DefaultSessionDir()
+		}
+		if err := CreateRequest(args[0], *outDir); err != nil {
+			fmt.Println("Failed to create request -- abort!")
 			fmt.Println("Error: " + err.Error())
 			os.Exit(1)
 		}
-		rdr := bufio.NewReader(f)
-		p, _ := new(big.Int).SetString(GetLine(rdr, args[n]), 10)
-		x, _ := new(big.Int).SetString(GetLine(rdr, args[n]), 10)
-		y, _ := new(big.Int).SetString(GetLine(rdr, args[n]), 10)
-		shares[n-1] = crypto.Share{x, y, p}
-		f.Close()
+		return
+	}
+	if len(*respond) > 0 {
+		if count < 1 {
+			Usage()
+			return
+		}
+		if err := Respond(*respond, args); err != nil {
+			fmt.Println("Failed to answer request -- abort!")
+			fmt.Println("Error: " + err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if count < 2 {
+		fmt.Println("At least two arguments are expected -- abort!")
+		Usage()
+		return
 	}
 
-	// recover key and create cipher engine
-	secret := crypto.Reconstruct(shares)
-	key := secret.Bytes()
-	engine, err := aes.NewCipher(key)
+	// check name of document file
+	base, err := DocumentBase(args[0])
 	if err != nil {
-		fmt.Println("Failed to create AES cipher engine -- abort!")
-		fmt.Println("Error: " + err.Error())
+		fmt.Printf("Invalid document file name '%s' -- abort!\n", args[0])
 		os.Exit(1)
 	}
+	id := filepath.Base(base)
+
+	// load session for responses of reviewers
+	if len(*sessionFile) > 0 {
+		if session, err = LoadSession(*sessionFile); err != nil {
+			fmt.Printf("Failed to read session file '%s' -- abort!\n", *sessionFile)
+			fmt.Println("Error: " + err.Error())
+			os.Exit(1)
+		}
+		if session.Document != id {
+			fmt.Printf("Session '%s' belongs to document '%s' -- abort!\n", *sessionFile, session.Document)
+			os.Exit(1)
+		}
+	}
 
 	// decrypt document
-	rdr, err := os.Open(args[0])
+	res, err := DecryptDocument(args[0], args[1:], filepath.Dir(base))
 	if err != nil {
-		fmt.Printf("Failed to open file '%s' -- abort!\n", args[0])
+		fmt.Println("Failed to decrypt document -- abort!")
 		fmt.Println("Error: " + err.Error())
 		os.Exit(1)
 	}
-	defer rdr.Close()
-	parts := strings.Split(args[0], ".")
-	if parts[1] != "document" || parts[2] != "aes256" {
-		fmt.Printf("Invalid document file name '%s' -- abort!\n", args[0])
-		os.Exit(1)
+	fmt.Printf("Document decrypted to '%s'\n", res.Output)
+
+	// a session is only used once
+	if session != nil {
+		session.Close()
+		if err = os.Remove(*sessionFile); err != nil {
+			fmt.Printf("WARNING: Can't remove session file '%s': %s\n", *sessionFile, err.Error())
+		} else {
+			fmt.Printf("Session '%s' closed.\n", *sessionFile)
+		}
 	}
-	fname := parts[0] + ".document"
-	wrt, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Print usage information.
+ */
+func Usage() {
+	fmt.Println("Decrypt a document with shares:")
+	fmt.Println("    dcd [-keyring <secring>] [-session <dir>/<id>.session] <document.aes256> <share1> [ ... <shareN> ]")
+	fmt.Println("    (shares are encrypted share files '<id>.<KEYID>.gpg', responses or decrypted shares)")
+	fmt.Println("Create a request for shares (combining party):")
+	fmt.Println("    dcd -request [-out <dir>] <document.aes256>")
+	fmt.Println("Answer a request for shares (reviewer):")
+	fmt.Println("    dcd [-keyring <secring>] -respond <id>.request <share1> [ ... <shareN> ]")
+	fmt.Println("Decrypt all documents in an upload directory:")
+	fmt.Println("    dcd [-keyring <secring>] -batch <dir> [-out <dir>] [-treshold <n>] [-list] [-report <file>]")
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Result of a document decryption.
+ */
+type Result struct {
+	Output   string   // name of decrypted document
+	Warnings []string // warnings issued during decryption
+}
+
+//---------------------------------------------------------------------
+/*
+ * Issue a warning.
+ * @param format string - format of warning
+ * @param args ...interface{} - arguments of warning
+ */
+func (r *Result) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Println("WARNING: " + msg)
+	r.Warnings = append(r.Warnings, msg)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Decrypt a document with a set of shares: the document key is
+ * recovered from the shares and verified against the key commitment
+ * (if available); the document is decrypted to the output directory.
+ * @param docFile string - name of encrypted document file
+ * @param shareFiles []string - names of share files
+ * @param outDir string - output directory
+ * @return *Result - result of decryption
+ * @return error - error object (or nil)
+ */
+func DecryptDocument(docFile string, shareFiles []string, outDir string) (*Result, error) {
+	base, err := DocumentBase(docFile)
 	if err != nil {
-		fmt.Printf("Failed to open output file '%s' -- abort!\n", fname)
-		fmt.Println("Error: " + err.Error())
-		os.Exit(1)
+		return nil, err
+	}
+	id := filepath.Base(base)
+	res := new(Result)
+
+	// read shares (encrypted shares are decrypted in memory)
+	shares := make([]*container.Share, len(shareFiles))
+	for n, fname := range shareFiles {
+		if shares[n], err = ReadShare(fname); err != nil {
+			return nil, fmt.Errorf("share file '%s': %s", fname, err.Error())
+		}
+		if shares[n].Version == 0 {
+			res.warn("Share '%s' in legacy format (no document id and checksum)", fname)
+		}
+	}
+	if err = CheckShares(shareFiles, shares, id); err != nil {
+		return nil, errors.New("invalid set of shares: " + err.Error())
+	}
+
+	// recover key (restore leading zero bytes)
+	key, err := RecoverKey(shares)
+	if err != nil {
+		return nil, errors.New("invalid key recovered from shares: " + err.Error())
+	}
+	defer wipe(key)
+
+	// verify key against commitment (if available)
+	commit, err := ioutil.ReadFile(base + ".commit")
+	if err == nil {
+		if !container.VerifyKey(id, key, string(commit)) {
+			return nil, errors.New("recovered key does not match the key commitment (not enough shares or shares of a different document?)")
+		}
+		fmt.Println("Document key verified.")
+	} else if os.IsNotExist(err) {
+		res.warn("No key commitment for document -- the recovered key can't be verified!")
+	} else {
+		return nil, fmt.Errorf("can't read key commitment '%s.commit': %s", base, err.Error())
+	}
+
+	// read metadata of document (if available)
+	meta, err := ReadMeta(base+".meta.aes256", key)
+	if err != nil {
+		res.warn("Can't read metadata file '%s.meta.aes256': %s", base, err.Error())
+	} else if meta != nil {
+		fmt.Println("Document metadata:")
+		for _, line := range meta.Listing() {
+			fmt.Println("    " + line)
+		}
+	}
+
+	// open document container
+	f, err := os.Open(docFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rdr, err := container.NewReader(f, key)
+	if err != nil {
+		return nil, fmt.Errorf("can't read document file '%s': %s", docFile, err.Error())
+	}
+	if !rdr.Authenticated() {
+		res.warn("Document in legacy format -- modifications can't be detected!")
+	}
+
+	// decrypt document: the output file is newly created (existing files
+	// are never overwritten) and removed if decryption fails.
+	wrt, fname, err := CreateOutput(outDir, id, meta)
+	if err != nil {
+		return nil, fmt.Errorf("can't create output file: %s", err.Error())
+	}
+	hsh := sha256.New()
+	size, err := io.Copy(io.MultiWriter(wrt, hsh), rdr)
+	if cerr := wrt.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fname)
+		return nil, fmt.Errorf("can't decrypt document file '%s': %s", docFile, err.Error())
+	}
+	if meta != nil && (meta.Size != size || meta.SHA256 != hex.EncodeToString(hsh.Sum(nil))) {
+		res.warn("Document does not match its metadata!")
+	}
+	res.Output = fname
+	return res, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get base name of document files.
+ * @param fname string - name of encrypted document file
+ * @return string - base name (path and document id)
+ * @return error - error object (or nil)
+ */
+func DocumentBase(fname string) (string, error) {
+	if !strings.HasSuffix(fname, ".document.aes256") {
+		return "", errors.New("invalid document file name")
+	}
+	return strings.TrimSuffix(fname, ".document.aes256"), nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read encrypted metadata of document.
+ * @param fname string - name of metadata file
+ * @param key []byte - document key
+ * @return *container.Metadata - metadata (nil: no metadata file)
+ * @return error - error object (or nil)
+ */
+func ReadMeta(fname string, key []byte) (*container.Metadata, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	rdr, err := container.NewReader(f, key)
+	if err != nil {
+		return nil, err
+	}
+	// read complete record (authenticates it)
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	return container.ReadMetadata(bytes.NewReader(data))
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create output file: the original file name of the document is used
+ * if it is available (and no file of that name exists). Existing files
+ * are never overwritten: the file is created exclusively and the next
+ * name is tried if the file already exists.
+ * @param dir string - output directory
+ * @param id string - document id
+ * @param meta *container.Metadata - metadata of document (or nil)
+ * @return *os.File - output file (opened for writing)
+ * @return string - name of output file
+ * @return error - error object (or nil)
+ */
+func CreateOutput(dir, id string, meta *container.Metadata) (*os.File, string, error) {
+	names := make([]string, 0, 3)
+	if meta != nil {
+		// strip path of original file name (both separators)
+		name := meta.FileName
+		if pos := strings.LastIndexAny(name, "/\\"); pos != -1 {
+			name = name[pos+1:]
+		}
+		if len(name) > 0 && name != "." && name != ".." {
+			names = append(names, name, id+"."+name)
+		}
+	}
+	names = append(names, id+".document")
+	for n := 1; ; n++ {
+		for _, name := range names {
+			fname := filepath.Join(dir, name)
+			f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err == nil {
+				return f, fname, nil
+			}
+			if !os.IsExist(err) {
+				return nil, "", err
+			}
+		}
+		if n == MAX_OUTPUT_NAMES {
+			return nil, "", fmt.Errorf("too many output files for document '%s' in '%s'", id, dir)
+		}
+		// retry with a counter
+		names = []string{fmt.Sprintf("%s.%d.document", id, n)}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Read a share from file: an encrypted share (OpenPGP message) is
+ * decrypted with the secret keyring; the decrypted share is only kept
+ * in memory.
+ * @param fname string - name of share file
+ * @return *container.Share - share of document key
+ * @return error - error object (or nil)
+ */
+func ReadShare(fname string) (*container.Share, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, MAX_SHARE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_SHARE_SIZE {
+		return nil, errors.New("share file too large")
+	}
+	if IsEncrypted(data) {
+		if keyring == nil {
+			if keyring, err = LoadKeyring(keyringFile); err != nil {
+				return nil, errors.New("can't read secret keyring '" + keyringFile + "': " + err.Error())
+			}
+		}
+		fmt.Printf("Decrypting share '%s'\n", fname)
+		if data, err = DecryptShare(data, keyring); err != nil {
+			return nil, err
+		}
+		defer wipe(data)
+	}
+	if container.IsResponse(data) {
+		if session == nil {
+			return nil, errors.New("response of a reviewer requires a session file (-session)")
+		}
+		resp, err := container.ParseResponse(data)
+		if err != nil {
+			return nil, err
+		}
+		return session.Open(resp)
+	}
+	return container.ParseShare(data)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check a set of shares: all shares must belong to the document, use
+ * the same prime and have different x coordinates.
+ * @param names []string - names of share files
+ * @param shares []*container.Share - shares of document key
+ * @param id string - document id
+ * @return error - error object (or nil)
+ */
+func CheckShares(names []string, shares []*container.Share, id string) error {
+	xs := make(map[string]int)
+	for n, share := range shares {
+		if err := share.Check(); err != nil {
+			return fmt.Errorf("share '%s': %s", names[n], err.Error())
+		}
+		if share.Version > 0 && share.Document != id {
+			return fmt.Errorf("share '%s' belongs to document '%s'", names[n], share.Document)
+		}
+		if share.P.Cmp(shares[0].P) != 0 {
+			return fmt.Errorf("shares '%s' and '%s' use different primes", names[0], names[n])
+		}
+		if k, ok := xs[share.X.String()]; ok {
+			return fmt.Errorf("shares '%s' and '%s' are the same share", names[k], names[n])
+		}
+		xs[share.X.String()] = n
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Recover document key from shares (restores leading zero bytes).
+ * @param shares []*container.Share - shares of document key
+ * @return []byte - document key
+ * @return error - error object (or nil)
+ */
+func RecoverKey(shares []*container.Share) ([]byte, error) {
+	list := make([]crypto.Share, len(shares))
+	for n, share := range shares {
+		list[n] = crypto.Share{X: share.X, Y: share.Y, P: share.P}
+	}
+	secret := crypto.Reconstruct(list)
+	key := make([]byte, container.KEY_SIZE)
+	kb := secret.Bytes()
+	if len(kb) > len(key) {
+		return nil, errors.New("recovered key too large (not enough shares?)")
 	}
-	defer wrt.Close()
+	copy(key[len(key)-len(kb):], kb)
+	return key, nil
+}
 
-	bs := engine.BlockSize()
-	iv := make([]byte, bs)
-	rdr.Read(iv)
-	dec := cipher.NewCFBDecrypter(engine, iv)
+//---------------------------------------------------------------------
+/*
+ * Check if share data is an OpenPGP message (ASCII-armored or binary).
+ * @param data []byte - share data
+ * @return bool - encrypted share?
+ */
+func IsEncrypted(data []byte) bool {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP MESSAGE-----")) {
+		return true
+	}
+	// binary OpenPGP packets have the high bit set in the first byte
+	// (a decrypted share starts with a decimal digit).
+	return len(data) > 0 && data[0]&0x80 != 0
+}
 
-	data := make([]byte, 32768)
-	for {
-		num, err := rdr.Read(data)
+//---------------------------------------------------------------------
+/*
+ * Decrypt an encrypted share with the secret keyring: the passphrase
+ * of a protected secret key is read from the terminal.
+ * @param data []byte - encrypted share
+ * @param keys openpgp.EntityList - secret keys
+ * @return []byte - decrypted share
+ * @return error - error object (or nil)
+ */
+func DecryptShare(data []byte, keys openpgp.EntityList) ([]byte, error) {
+	var rdr io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		blk, err := armor.Decode(bytes.NewReader(bytes.TrimSpace(data)))
 		if err != nil {
+			return nil, err
+		}
+		rdr = blk.Body
+	}
+	md, err := openpgp.ReadMessage(rdr, keys, PassphrasePrompt(), nil)
+	if err == pgperr.ErrKeyIncorrect {
+		return nil, errors.New("no matching secret key in keyring")
+	} else if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a prompt function that asks for passphrases on the terminal
+ * (without echo): all offered secret keys are tried until one of them
+ * is unlocked; for symmetrically encrypted messages the passphrase of
+ * the message is requested. An error is returned if no key can be
+ * unlocked (and no passphrase for the message is accepted).
+ * @return openpgp.PromptFunction - prompt function
+ */
+func PassphrasePrompt() openpgp.PromptFunction {
+	tries := make(map[uint64]int) // passphrase attempts per key
+	symTries := 0                 // passphrase attempts for message
+	var last []byte               // last passphrase for message
+	return func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		// called again: last passphrase for message was wrong
+		if last != nil {
+			fmt.Fprintln(os.Stderr, "Wrong passphrase.")
+			wipe(last)
+			last = nil
+		}
+		// try to unlock offered keys
+		for _, key := range keys {
+			id := key.PrivateKey.KeyId
+			for key.PrivateKey.Encrypted && tries[id] < PASSPHRASE_TRIES {
+				pass, err := ReadPassphrase(fmt.Sprintf("Passphrase for key %08X '%s': ", key.Entity.PrimaryKey.KeyId&0xFFFFFFFF, primaryName(key.Entity)))
+				if err != nil {
+					return nil, err
+				}
+				tries[id]++
+				err = key.PrivateKey.Decrypt(pass)
+				wipe(pass)
+				if err == nil {
+					// the message is decrypted with the (now unlocked) key
+					return nil, nil
+				}
+				fmt.Fprintln(os.Stderr, "Wrong passphrase.")
+			}
+		}
+		// symmetrically encrypted message
+		if symmetric && symTries < PASSPHRASE_TRIES {
+			symTries++
+			pass, err := ReadPassphrase("Passphrase for message: ")
+			if err != nil {
+				return nil, err
+			}
+			last = pass
+			return pass, nil
+		}
+		return nil, errors.New("wrong passphrase")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read a passphrase from the terminal (without echo).
+ * @param prompt string - prompt for passphrase
+ * @return []byte - passphrase
+ * @return error - error object (or nil)
+ */
+func ReadPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("passphrase required, but no terminal available")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return pass, err
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read secret keyring: a binary keyring or a file with one or more
+ * ASCII-armored key blocks (e.g. concatenated key exports).
+ * @param fname string - name of keyring file
+ * @return openpgp.EntityList - secret keys
+ * @return error - error object (or nil)
+ */
+func LoadKeyring(fname string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var keys openpgp.EntityList
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		if keys, err = openpgp.ReadKeyRing(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	} else {
+		rdr := bufio.NewReader(bytes.NewReader(data))
+		for {
+			blk, err := armor.Decode(rdr)
 			if err == io.EOF {
 				break
+			} else if err != nil {
+				return nil, err
 			}
-			fmt.Printf("Failed to read encrypted file '%s' -- abort!\n", args[0])
-			fmt.Println("Error: " + err.Error())
-			os.Exit(1)
+			list, err := openpgp.ReadKeyRing(blk.Body)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, list...)
 		}
-		dec.XORKeyStream(data[0:num], data[0:num])
-		num, err = wrt.Write(data[0:num])
+	}
+	if len(keys.DecryptionKeys()) == 0 {
+		return nil, errors.New("no secret keys found")
+	}
+	return keys, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get name of default secret keyring (GnuPG home directory).
+ * @return string - name of keyring file
+ */
+func DefaultKeyring() string {
+	home := os.Getenv("GNUPGHOME")
+	if len(home) == 0 {
+		home = filepath.Join(os.Getenv("HOME"), ".gnupg")
+	}
+	return filepath.Join(home, "secring.gpg")
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get name of default directory for session files.
+ * @return string - name of directory
+ */
+func DefaultSessionDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".sid", "sessions")
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Create a request for shares of a document key: the request is sent
+ * to the reviewers; the session file (with the private key of the
+ * session) stays with the combining party. The session file is never
+ * written to the directory of the document: upload directories are
+ * usually synchronized with other computers.
+ * @param docFile string - name of encrypted document file
+ * @param sessionDir string - directory for session file
+ * @return error - error object (or nil)
+ */
+func CreateRequest(docFile, sessionDir string) error {
+	base, err := DocumentBase(docFile)
+	if err != nil {
+		return err
+	}
+	if sameDir(filepath.Dir(base), sessionDir) {
+		return errors.New("session directory '" + sessionDir + "' is the directory of the document")
+	}
+	if err = os.MkdirAll(sessionDir, 0700); err != nil {
+		return err
+	}
+	s, err := container.NewSession(filepath.Base(base))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// the session file must not exist (one session per document)
+	sessionFile := filepath.Join(sessionDir, s.Document+".session")
+	f, err := os.OpenFile(sessionFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.New("session file '" + sessionFile + "' exists (remove it to start a new session)")
+		}
+		return err
+	}
+	err = s.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = writeFile(base+".request", s.Request.Write)
+	}
+	if err != nil {
+		os.Remove(sessionFile)
+		return err
+	}
+	fmt.Printf("Request written to '%s.request' (send it to the reviewers).\n", base)
+	fmt.Printf("Session written to '%s' (keep it; never send it to anyone!).\n", sessionFile)
+	fmt.Println("Request fingerprint: " + s.Fingerprint())
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Answer a request for shares: the shares are decrypted in memory and
+ * sealed for the session of the combining party; for every share file
+ * a response file is written.
+ * @param reqFile string - name of request file
+ * @param shareFiles []string - names of share files
+ * @return error - error object (or nil)
+ */
+func Respond(reqFile string, shareFiles []string) error {
+	data, err := ioutil.ReadFile(reqFile)
+	if err != nil {
+		return err
+	}
+	req, err := container.ParseRequest(data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Request for document '%s'\n", req.Document)
+	fmt.Println("Request fingerprint: " + req.Fingerprint())
+	fmt.Println("(Compare the fingerprint with the combining party on a separate channel!)")
+	for _, fname := range shareFiles {
+		share, err := ReadShare(fname)
 		if err != nil {
-			fmt.Printf("Failed to write decrypted file '%s' -- abort!\n", fname)
-			fmt.Println("Error: " + err.Error())
-			os.Exit(1)
+			return errors.New("share '" + fname + "': " + err.Error())
+		}
+		if err = share.Check(); err != nil {
+			return errors.New("share '" + fname + "': " + err.Error())
+		}
+		if share.Version == 0 {
+			fmt.Printf("WARNING: Share '%s' in legacy format (no document id and checksum)\n", fname)
+		}
+		resp, err := req.Seal(share)
+		if err != nil {
+			return errors.New("share '" + fname + "': " + err.Error())
 		}
+		out := strings.TrimSuffix(fname, ".gpg") + ".response"
+		if err = writeFile(out, resp.Write); err != nil {
+			return err
+		}
+		fmt.Printf("Response written to '%s' (send it to the combining party).\n", out)
 	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read session file of combining party.
+ * @param fname string - name of session file
+ * @return *container.Session - session
+ * @return error - error object (or nil)
+ */
+func LoadSession(fname string) (*container.Session, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(data)
+	return container.ParseSession(data)
 }
 
 ///////////////////////////////////////////////////////////////////////
+// Helper functions
+
 /*
- * Read line from reader.
+ * Write a record to file.
+ * @param fname string - name of file
+ * @param write func(io.Writer) error - write function of record
+ * @return error - error object (or nil)
  */
-func GetLine(rdr *bufio.Reader, fname string) string {
-	line, _, err := rdr.ReadLine()
+func writeFile(fname string, write func(io.Writer) error) error {
+	f, err := os.Create(fname)
 	if err != nil {
-		fmt.Printf("Failed to read from file '%s' -- abort!\n", fname)
-		fmt.Println("Error: " + err.Error())
-		os.Exit(1)
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fname)
+	}
+	return err
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if two names refer to the same directory.
+ * @param dir1 string - name of first directory
+ * @param dir2 string - name of second directory
+ * @return bool - same directory?
+ */
+func sameDir(dir1, dir2 string) bool {
+	fi1, err := os.Stat(dir1)
+	if err != nil {
+		return false
+	}
+	fi2, err := os.Stat(dir2)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi1, fi2)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get primary identity of a key.
+ * @param ent *openpgp.Entity - key
+ * @return string - name of primary identity
+ */
+func primaryName(ent *openpgp.Entity) string {
+	for name, id := range ent.Identities {
+		if id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil && *id.SelfSignature.IsPrimaryId {
+			return name
+		}
+	}
+	for name := range ent.Identities {
+		return name
+	}
+	return "?"
+}
+
+//---------------------------------------------------------------------
+/*
+ * Overwrite sensitive data in memory.
+ * @param data []byte - data to be cleared
+ */
+func wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
 	}
-	return string(line)
 }
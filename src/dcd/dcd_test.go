@@ -0,0 +1,143 @@
+/*
+ * Stand-alone decryption application: tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sid/container"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Output files are created exclusively: existing files are never
+ * overwritten.
+ */
+func TestCreateOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id := "4534645319481941"
+	meta := &container.Metadata{FileName: "C:\\Documents\\report.pdf"}
+	if err = ioutil.WriteFile(filepath.Join(dir, "report.pdf"), []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		id + ".report.pdf",
+		id + ".document",
+		id + ".1.document",
+		id + ".2.document",
+	}
+	for _, name := range expect {
+		f, fname, err := CreateOutput(dir, id, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if fname != filepath.Join(dir, name) {
+			t.Fatalf("output file '%s' instead of '%s'", fname, name)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "report.pdf"))
+	if err != nil || string(data) != "existing" {
+		t.Fatal("existing file modified")
+	}
+
+	// no usable file name in metadata
+	for _, name := range []string{"", "..", "dir/"} {
+		f, fname, err := CreateOutput(dir, "1111", &container.Metadata{FileName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		os.Remove(fname)
+		if filepath.Base(fname) != "1111.document" {
+			t.Fatalf("output file '%s' for file name '%s'", fname, name)
+		}
+	}
+
+	// output directory missing
+	if _, _, err = CreateOutput(filepath.Join(dir, "missing"), id, nil); err == nil {
+		t.Fatal("output file created in missing directory")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Session files of requests are written outside the directory of the
+ * document.
+ */
+func TestCreateRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	docs := filepath.Join(dir, "uploads")
+	if err = os.Mkdir(docs, 0700); err != nil {
+		t.Fatal(err)
+	}
+	doc := filepath.Join(docs, "4534645319481941.document.aes256")
+	sessions := filepath.Join(dir, "sessions")
+
+	// session directory is the directory of the document
+	for _, sd := range []string{docs, docs + "/.", filepath.Join(docs, "..", "uploads")} {
+		if CreateRequest(doc, sd) == nil {
+			t.Fatalf("session written to '%s'", sd)
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(docs, "*")); len(names) != 0 {
+		t.Fatalf("files %v written to document directory", names)
+	}
+
+	// session directory is created
+	if err = CreateRequest(doc, sessions); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(sessions)
+	if err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatal("session directory not private")
+	}
+	sessionFile := filepath.Join(sessions, "4534645319481941.session")
+	s, err := LoadSession(sessionFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	names, _ := filepath.Glob(filepath.Join(docs, "*"))
+	if len(names) != 1 || names[0] != filepath.Join(docs, "4534645319481941.request") {
+		t.Fatalf("files %v in document directory", names)
+	}
+
+	// one session per document
+	if CreateRequest(doc, sessions) == nil {
+		t.Fatal("existing session file overwritten")
+	}
+}
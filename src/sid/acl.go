@@ -0,0 +1,254 @@
+/*
+ * Access control lists: Check remote addresses of incoming connections
+ * against a list of IP addresses, CIDR ranges (IPv4 and IPv6) and host
+ * names. Rules can explicitly deny access to addresses.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"errors"
+	"github.com/bfix/gospel/logger"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// min. interval between log entries for rejected peers
+	ACL_LOG_INTERVAL = time.Minute
+	// max. number of peers tracked for log rate limiting
+	ACL_LOG_PEERS = 1024
+)
+
+///////////////////////////////////////////////////////////////////////
+// Public types
+
+/*
+ * Access control list: A list specification consists of rules separated
+ * by semicolons (or white spaces). A rule is an IP address, a CIDR range
+ * or a host name (resolved when the list is created); rules starting
+ * with '!' deny access. An address is allowed if it matches an allow
+ * rule and no deny rule.
+ */
+type ACL struct {
+	Name  string     // name of list (for logging)
+	rules []*aclRule // list of rules
+
+	lock     sync.Mutex            // lock for log rate limiting
+	rejected map[string]*aclReject // rejected peers (for logging)
+}
+
+///////////////////////////////////////////////////////////////////////
+// Local types
+
+/*
+ * Single rule of an access control list.
+ */
+type aclRule struct {
+	deny bool       // deny access?
+	net  *net.IPNet // matching addresses
+}
+
+//---------------------------------------------------------------------
+/*
+ * Rejected peer (for log rate limiting).
+ */
+type aclReject struct {
+	logged     time.Time // time of last log entry
+	suppressed int       // number of suppressed log entries
+}
+
+///////////////////////////////////////////////////////////////////////
+// Public functions
+
+/*
+ * Create a new access control list from specification.
+ * @param name string - name of list (for logging)
+ * @param spec string - list specification
+ * @return *ACL - new access control list
+ * @return error - error object (or nil)
+ */
+func NewACL(name, spec string) (*ACL, error) {
+	acl := &ACL{
+		Name:     name,
+		rules:    make([]*aclRule, 0),
+		rejected: make(map[string]*aclReject),
+	}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ';' || r == ' ' || r == '\t'
+	}) {
+		deny := strings.HasPrefix(entry, "!")
+		if deny {
+			entry = entry[1:]
+		}
+		nets, err := parseACLEntry(entry)
+		if err != nil {
+			return nil, errors.New(name + ": " + err.Error())
+		}
+		for _, n := range nets {
+			acl.rules = append(acl.rules, &aclRule{deny, n})
+		}
+	}
+	return acl, nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Public methods
+
+/*
+ * Check if a remote address is allowed by the list; rejected peers
+ * are logged (at most once per ACL_LOG_INTERVAL for every peer).
+ * @param addr string - remote address ("<ip>:<port>" or "<ip>")
+ * @return bool - access allowed?
+ */
+func (a *ACL) IsAllowed(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	// strip zone of IPv6 addresses
+	if pos := strings.Index(host, "%"); pos != -1 {
+		host = host[:pos]
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && a.Match(ip) {
+		return true
+	}
+	a.logReject(host)
+	return false
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if an IP address is allowed by the list.
+ * @param ip net.IP - IP address
+ * @return bool - access allowed?
+ */
+func (a *ACL) Match(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	allowed := false
+	for _, r := range a.rules {
+		if r.net.Contains(ip) {
+			if r.deny {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper methods
+
+/*
+ * Log rejected peer (rate limited).
+ * @param peer string - address of rejected peer
+ */
+func (a *ACL) logReject(peer string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	r, ok := a.rejected[peer]
+	if ok && now.Sub(r.logged) < ACL_LOG_INTERVAL {
+		r.suppressed++
+		return
+	}
+	if !ok {
+		// limit number of tracked peers: drop expired entries (or the
+		// oldest entry if none has expired)
+		if len(a.rejected) >= ACL_LOG_PEERS {
+			oldest := ""
+			for p, e := range a.rejected {
+				if now.Sub(e.logged) >= ACL_LOG_INTERVAL {
+					delete(a.rejected, p)
+				} else if oldest == "" || e.logged.Before(a.rejected[oldest].logged) {
+					oldest = p
+				}
+			}
+			if len(a.rejected) >= ACL_LOG_PEERS {
+				delete(a.rejected, oldest)
+			}
+		}
+		r = &aclReject{}
+		a.rejected[peer] = r
+	}
+	if r.suppressed > 0 {
+		logger.Printf(logger.WARN, "[sid.acl] %s: access denied for '%s' (%d more since last report)\n", a.Name, peer, r.suppressed)
+	} else {
+		logger.Printf(logger.WARN, "[sid.acl] %s: access denied for '%s'\n", a.Name, peer)
+	}
+	r.logged = now
+	r.suppressed = 0
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse a rule of an access control list: IP addresses and resolved
+ * host names match single addresses.
+ * @param entry string - rule (without deny prefix)
+ * @return []*net.IPNet - list of matching networks
+ * @return error - error object (or nil)
+ */
+func parseACLEntry(entry string) ([]*net.IPNet, error) {
+	// CIDR range
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New("invalid CIDR range '" + entry + "'")
+		}
+		return []*net.IPNet{n}, nil
+	}
+	// IP address
+	if ip := net.ParseIP(entry); ip != nil {
+		return []*net.IPNet{hostNet(ip)}, nil
+	}
+	// host name
+	ips, err := net.LookupIP(entry)
+	if err != nil || len(ips) == 0 {
+		return nil, errors.New("can't resolve host name '" + entry + "'")
+	}
+	nets := make([]*net.IPNet, len(ips))
+	for i, ip := range ips {
+		nets[i] = hostNet(ip)
+	}
+	return nets, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get network for a single IP address.
+ * @param ip net.IP - IP address
+ * @return *net.IPNet - network matching only the address
+ */
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
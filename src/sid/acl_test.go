@@ -0,0 +1,189 @@
+/*
+ * Access control lists: rule matching tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Check addresses against an access control list.
+ * @param t *testing.T - test instance
+ * @param spec string - list specification
+ * @param allowed []string - addresses that are allowed
+ * @param denied []string - addresses that are denied
+ */
+func checkACL(t *testing.T, spec string, allowed, denied []string) {
+	acl, err := NewACL("test", spec)
+	if err != nil {
+		t.Fatalf("'%s': %s", spec, err.Error())
+	}
+	for _, addr := range allowed {
+		if !acl.IsAllowed(addr) {
+			t.Fatalf("'%s': '%s' denied", spec, addr)
+		}
+	}
+	for _, addr := range denied {
+		if acl.IsAllowed(addr) {
+			t.Fatalf("'%s': '%s' allowed", spec, addr)
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Single IPv4 addresses and CIDR ranges.
+ */
+func TestACLIPv4(t *testing.T) {
+	checkACL(t, "127.0.0.1",
+		[]string{"127.0.0.1", "127.0.0.1:4711", "::ffff:127.0.0.1", "[::ffff:127.0.0.1]:80"},
+		[]string{"127.0.0.2", "10.0.0.1:80", "::1", "", "localhost", "garbage:80"})
+	checkACL(t, "10.0.0.0/8; 192.168.1.0/24",
+		[]string{"10.0.0.1", "10.255.255.255:80", "192.168.1.17:1234"},
+		[]string{"11.0.0.1", "192.168.2.1:80", "9.255.255.255"})
+	checkACL(t, "192.168.1.77/24",
+		[]string{"192.168.1.1", "192.168.1.254"},
+		[]string{"192.168.0.77"})
+	checkACL(t, "0.0.0.0/0",
+		[]string{"1.2.3.4", "255.255.255.255"},
+		[]string{"2001:db8::1"})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Single IPv6 addresses and CIDR ranges (with zones and in brackets).
+ */
+func TestACLIPv6(t *testing.T) {
+	checkACL(t, "::1",
+		[]string{"::1", "[::1]:8080", "0:0:0:0:0:0:0:1", "[::1%lo]:80"},
+		[]string{"127.0.0.1", "::2"})
+	checkACL(t, "2001:db8::/32 fe80::/10",
+		[]string{"2001:db8::1", "[2001:db8:ffff::42]:443", "[fe80::1%eth0]:22", "fe80::1%eth0"},
+		[]string{"2001:db9::1", "10.0.0.1", "fec0::1"})
+	checkACL(t, "::/0",
+		[]string{"2001:db8::1", "::1"},
+		[]string{"10.0.0.1"})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Host names are resolved when the list is created.
+ */
+func TestACLHostName(t *testing.T) {
+	ips, err := net.LookupIP("localhost")
+	if err != nil || len(ips) == 0 {
+		t.Skip("can't resolve 'localhost'")
+	}
+	var allowed []string
+	for _, ip := range ips {
+		allowed = append(allowed, net.JoinHostPort(ip.String(), "80"))
+	}
+	checkACL(t, "localhost", allowed, []string{"10.0.0.1", "2001:db8::1"})
+
+	// denied host name
+	checkACL(t, "0.0.0.0/0 ::/0 !localhost", []string{"10.0.0.1", "2001:db8::1"}, allowed)
+
+	// unresolvable host names are rejected
+	if _, err := NewACL("test", "10.0.0.1; unknown-host.invalid"); err == nil {
+		t.Fatal("unresolvable host name accepted")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Deny rules take precedence over allow rules (regardless of their
+ * position in the list); a list with deny rules only allows nothing.
+ */
+func TestACLDeny(t *testing.T) {
+	checkACL(t, "10.0.0.0/8; !10.1.0.0/16; !10.2.3.4",
+		[]string{"10.0.0.1", "10.2.3.5", "10.255.0.1"},
+		[]string{"10.1.0.1", "10.1.255.255", "10.2.3.4:80", "11.0.0.1"})
+	checkACL(t, "!10.1.0.0/16 10.0.0.0/8",
+		[]string{"10.0.0.1"},
+		[]string{"10.1.2.3"})
+	checkACL(t, "2001:db8::/32;!2001:db8:1::/48",
+		[]string{"2001:db8::1", "2001:db8:2::1"},
+		[]string{"2001:db8:1::1", "[2001:db8:1:ffff::1]:80"})
+	checkACL(t, "!10.0.0.1",
+		nil,
+		[]string{"10.0.0.1", "10.0.0.2"})
+	checkACL(t, "",
+		nil,
+		[]string{"10.0.0.1", "::1"})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Invalid list specifications are rejected.
+ */
+func TestACLInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"10.0.0.0/33",
+		"2001:db8::/129",
+		"10.0.0/8",
+		"!",
+		"10.0.0.1; !300.0.0.0/8",
+	} {
+		if _, err := NewACL("test", spec); err == nil {
+			t.Fatalf("invalid specification '%s' accepted", spec)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Logging of rejected peers is rate limited and the number of tracked
+ * peers is limited.
+ */
+func TestACLLogReject(t *testing.T) {
+	acl, err := NewACL("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		acl.IsAllowed("10.0.0.1:80")
+	}
+	if r := acl.rejected["10.0.0.1"]; r == nil || r.suppressed != 2 {
+		t.Fatal("rejected peer not rate limited")
+	}
+	for i := 0; i < 2*ACL_LOG_PEERS; i++ {
+		acl.IsAllowed("10.1." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256))
+	}
+	if len(acl.rejected) != ACL_LOG_PEERS {
+		t.Fatalf("%d rejected peers tracked", len(acl.rejected))
+	}
+	// oldest peers are dropped first
+	if _, ok := acl.rejected["10.1.7.255"]; !ok {
+		t.Fatal("recent peer dropped")
+	}
+	if _, ok := acl.rejected["10.0.0.1"]; ok {
+		t.Fatal("oldest peer not dropped")
+	}
+}
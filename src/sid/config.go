@@ -25,12 +25,17 @@ package sid
 
 import (
 	"bufio"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/bfix/gospel/logger"
 	"github.com/bfix/gospel/network"
 	"github.com/bfix/gospel/parser"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -41,16 +46,37 @@ import (
  * Configuation data type.
  */
 type Config struct {
-	CfgFile   string     // configuration file name
-	LogFile   string     // logging file name
-	LogState  bool       // use file-based logging?
-	CtrlPort  int        // port for control sessions
-	CtrlAllow string     // addresses allowed for control sessions
-	HttpPort  int        // port for HTTP sessions
-	HttpAllow string     // addresses allowed for HTTP access
-	UseSocks  bool       // Use SOCKS for outgoing connections?
-	SocksAddr string     // SOCKS address
-	Upload    UploadDefs // upload-related settings
+	CfgFile         string     // configuration file name
+	LogFile         string     // logging file name
+	LogState        bool       // use file-based logging?
+	LogLevel        string     // logging level (empty: unchanged)
+	CtrlPort        int        // port for control sessions
+	CtrlAllow       string     // addresses allowed for control sessions
+	HttpPort        int        // port for HTTP sessions
+	HttpAllow       string     // addresses allowed for HTTP access
+	HttpsPort       int        // port for HTTPS sessions (0: disabled)
+	HttpsCert       string     // certificate file for HTTPS (PEM)
+	HttpsKey        string     // private key file for HTTPS (PEM)
+	UseSocks        bool       // Use SOCKS for outgoing connections?
+	SocksAddr       string     // SOCKS address
+	ShutdownTimeout int        // max. time (in seconds) to wait for active sessions on shutdown
+	Covers          CoverDefs  // cover server-related settings
+	Upload          UploadDefs // upload-related settings
+
+	src     map[string]string // sources of option values (name -> SRC_*)
+	ctrlACL *ACL              // access control list for control sessions
+	httpACL *ACL              // access control list for HTTP(S) sessions
+}
+
+//---------------------------------------------------------------------
+/*
+ * Cover server-related settings: Additional cover servers are created
+ * from the cover instance returned by the custom initialization.
+ */
+type CoverDefs struct {
+	Select  string   // name of cover selection strategy
+	Servers []string // list of additional cover servers
+	Pins    []string // list of certificate pins ("<host>;<pin>")
 }
 
 //---------------------------------------------------------------------
@@ -58,42 +84,91 @@ type Config struct {
  * Upload-related settings.
  */
 type UploadDefs struct {
-	Path          string // directory to store client uploads
-	Keyring       string // name of OpenPGP keyring file
-	SharePrimeOfs int    // prime number offset for secret sharing
-	ShareTreshold int    // number of people required to access documents
+	Path             string // directory to store client uploads
+	FileField        string // name(s) of form fields for document uploads
+	Keyring          string // name of OpenPGP keyring file
+	Reviewers        string // directory of reviewer key files
+	SharePrime       string // prime for secret sharing ("": generated)
+	SharePrimeOffset int    // offset for generated prime (secret sharing)
+	ShareTreshold    int    // number of people required to access documents
+	MaxSize          int    // max. size of document uploads in MB (0: unlimited)
+	Store            string // type of document store ("local", "s3", "webdav")
+	StoreURL         string // URL of remote document store
+	StoreRegion      string // region of S3 document store
+	StoreUser        string // user name (access key id) for remote store
+	StorePassword    string // password (secret key) for remote store
 }
 
 //---------------------------------------------------------------------
 /*
  * Configuration data instance (with default values) accessible
- * from all modules/packages of the application.
+ * from all modules/packages of the application. This instance holds
+ * the configuration at start-up; the current configuration (that can
+ * change at run-time) is returned by 'GetConfig()'.
  */
 var CfgData Config = Config{
-	CfgFile:   "sid.cfg",        // default config file
-	LogFile:   "sid.log",        // default logging file
-	LogState:  false,            // no file-based logging
-	CtrlPort:  2342,             // port for local control service
-	CtrlAllow: "127.0.0.1",      // addresses allowed to connect to control service
-	HttpPort:  80,               // expected port for HTTP connections
-	HttpAllow: "127.0.0.1",      // addresses allowed to connect to HTTP server
-	UseSocks:  false,            // Use SOCKS for outgoing connections?
-	SocksAddr: "127.0.0.1:9050", // SOCKS address
+	CfgFile:         "sid.cfg",        // default config file
+	LogFile:         "sid.log",        // default logging file
+	LogState:        false,            // no file-based logging
+	CtrlPort:        2342,             // port for local control service
+	CtrlAllow:       "127.0.0.1",      // addresses allowed to connect to control service
+	HttpPort:        80,               // expected port for HTTP connections
+	HttpAllow:       "127.0.0.1",      // addresses allowed to connect to HTTP server
+	HttpsPort:       0,                // no HTTPS connections
+	HttpsCert:       "./sid.crt",      // certificate file for HTTPS
+	HttpsKey:        "./sid.key",      // private key file for HTTPS
+	UseSocks:        false,            // Use SOCKS for outgoing connections?
+	SocksAddr:       "127.0.0.1:9050", // SOCKS address
+	ShutdownTimeout: 30,               // wait 30 seconds for sessions on shutdown
+
+	Covers: CoverDefs{
+		Select:  "RANDOM",
+		Servers: make([]string, 0),
+		Pins:    make([]string, 0),
+	},
 
 	Upload: UploadDefs{
-		Path:          "./uploads",
-		Keyring:       "./uploads/pubring.gpg",
-		SharePrimeOfs: 568,
-		ShareTreshold: 2,
+		Path:             "./uploads",
+		FileField:        "file",
+		Keyring:          "./uploads/pubring.gpg",
+		SharePrime:       "",
+		SharePrimeOffset: 0,
+		ShareTreshold:    2,
+		Store:            "local",
 	},
 }
 
 //---------------------------------------------------------------------
 /*
- * Custom callback handler for non-standard configuration options.
+ * Custom callback handler for non-standard configuration options
+ * (called again on every configuration reload).
  */
 var CustomConfigHandler parser.Callback = nil
 
+///////////////////////////////////////////////////////////////////////
+// Local configuration data
+
+/*
+ * Short command line flags for standard options.
+ */
+var cfgShortFlags = map[string]string{
+	"L": "LogFile",
+	"l": "LogToFile",
+	"p": "CtrlPort",
+}
+
+//---------------------------------------------------------------------
+/*
+ * Command line flags for standard options (option name -> flag).
+ */
+var cfgFlags = make(map[string]*optionFlag)
+
+var (
+	cfgLock     sync.RWMutex // lock for current configuration
+	cfgCurrent  *Config      // current configuration (snapshot)
+	cfgDefaults Config       // default configuration (before parsing)
+)
+
 ///////////////////////////////////////////////////////////////////////
 // Public methods
 /*
@@ -102,46 +177,46 @@ var CustomConfigHandler parser.Callback = nil
  */
 func InitConfig() {
 
-	// process command line arguments
-	CfgData.CfgFile = *flag.String("c", CfgData.CfgFile, "configuration file")
-	flag.String("L", CfgData.LogFile, "logfile name")
-	flag.Bool("l", CfgData.LogState, "file-based logging")
-	flag.Int("p", CfgData.CtrlPort, "control session port")
-	flag.Int("h", CfgData.HttpPort, "HTTP session port")
+	// process command line arguments: every standard option has a
+	// command line flag (see 'registerFlags()')
+	cfgFile := CfgData.CfgFile
+	if val, ok := os.LookupEnv("SID_CONFIG"); ok {
+		cfgFile = val
+	}
+	flag.StringVar(&cfgFile, "c", cfgFile, "configuration file (env SID_CONFIG)")
+	flag.StringVar(&cfgFile, "config", cfgFile, "configuration file (env SID_CONFIG)")
+	checkOnly := flag.Bool("check-config", false, "check configuration and exit")
+	printOnly := flag.Bool("print-config", false, "print effective configuration and exit")
+	registerFlags()
 	flag.Parse()
+	CfgData.CfgFile = cfgFile
 
 	// read configuration from file
-	logger.Println(logger.INFO, "[sid.config] using configuration file '"+CfgData.CfgFile+"'")
-	cfg, err := os.Open(CfgData.CfgFile)
-	if err != nil {
-		logger.Println(logger.WARN, "[sid.config] configuration file not available -- using defaults")
-		return
+	cfgDefaults = CfgData.clone()
+	cfg, err := readConfig(CfgData.CfgFile)
+	if err == nil && *checkOnly {
+		// check settings of document handler
+		_, err = NewDocumentHandler(cfg.Upload)
 	}
-	// configuration file exists: read parameters
-	rdr := bufio.NewReader(cfg)
-	err = parser.Parser(rdr, callback)
 	if err != nil {
 		logger.Printf(logger.ERROR, "[sid.config] error reading configuration file: %v\n", err)
 		os.Exit(1)
 	}
-	logger.Println(logger.INFO, "[sid.config] configuration file complete.")
-
-	// handle command line flags that may override options specified in the
-	// configuration file (or are default values)
-	flag.Visit(func(f *flag.Flag) {
-		val := f.Value.String()
-		logger.Printf(logger.INFO, "[sid.config] Overriding '%s' with '%s'\n", f.Usage, val)
-		switch f.Name {
-		case "L":
-			CfgData.LogFile = val
-		case "l":
-			CfgData.LogState = (val == "true")
-		case "p":
-			CfgData.CtrlPort, _ = strconv.Atoi(val)
-		case "h":
-			CfgData.HttpPort, _ = strconv.Atoi(val)
-		}
-	})
+	if *printOnly {
+		for _, line := range cfg.Listing() {
+			fmt.Println(line)
+		}
+		os.Exit(0)
+	}
+	if *checkOnly {
+		logger.Println(logger.INFO, "[sid.config] configuration file '"+CfgData.CfgFile+"' is valid.")
+		os.Exit(0)
+	}
+	CfgData = cfg.clone()
+	setConfig(cfg)
+	if len(cfg.LogLevel) > 0 {
+		logger.SetLogLevelFromName(cfg.LogLevel)
+	}
 
 	// turn on logging if specified on command line or config file
 	if CfgData.LogState {
@@ -162,67 +237,404 @@ func InitConfig() {
 
 	// list current configuration data
 	logger.Println(logger.INFO, "[sid.config] !==========< configuration >===============")
-	logger.Println(logger.INFO, "[sid.config] !       Configuration file: "+CfgData.CfgFile)
-	logger.Println(logger.INFO, "[sid.config] !Port for control sessions: "+strconv.Itoa(CfgData.CtrlPort))
-	logger.Println(logger.INFO, "[sid.config] !   Port for HTTP sessions: "+strconv.Itoa(CfgData.HttpPort))
 	logger.Println(logger.INFO, "[sid.config] !              SOCKS proxy: "+proxy)
+	for _, line := range cfg.Listing() {
+		logger.Println(logger.INFO, "[sid.config] !"+line)
+	}
 	logger.Println(logger.INFO, "[sid.config] !==========================================")
 }
 
 //---------------------------------------------------------------------
 /*
- * Handle callback from parser.
- * @param mode int - parameter mode
- * @param param *Parameter - reference to new parameter
- * @return bool - successful operation?
+ * Get access control list for control sessions.
+ * @return *ACL - access control list
+ */
+func (c *Config) CtrlACL() *ACL {
+	if c.ctrlACL == nil {
+		return fallbackACL("CtrlAllow", c.CtrlAllow)
+	}
+	return c.ctrlACL
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get access control list for HTTP(S) sessions.
+ * @return *ACL - access control list
+ */
+func (c *Config) HttpACL() *ACL {
+	if c.httpACL == nil {
+		return fallbackACL("HttpAllow", c.HttpAllow)
+	}
+	return c.httpACL
+}
+
+//---------------------------------------------------------------------
+/*
+ * List effective configuration: every standard option is listed with
+ * its value and the source of the value (default, file, env, flag).
+ * @return []string - list of options
+ */
+func (c *Config) Listing() []string {
+	list := []string{"Configuration file: " + c.CfgFile}
+	for _, opt := range cfgOptions {
+		if opt.Type == OPT_SECTION || opt.Type == OPT_OBSOLETE {
+			continue
+		}
+		name := opt.Name
+		if len(opt.Section) > 0 {
+			name = opt.Section + "." + name
+		}
+		src, ok := c.src[opt.Name]
+		if !ok {
+			src = SRC_DEFAULT
+		}
+		val := opt.Get(c)
+		if opt.Secret && len(val) > 0 {
+			val = "********"
+		}
+		list = append(list, fmt.Sprintf("%s = %s (%s)", name, val, src))
+	}
+	return list
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get current configuration: the returned instance is a snapshot that
+ * is not changed by a reload and must not be modified by the caller.
+ * @return *Config - current configuration
+ */
+func GetConfig() *Config {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	if cfgCurrent == nil {
+		return &CfgData
+	}
+	return cfgCurrent
+}
+
+//---------------------------------------------------------------------
+/*
+ * Reload configuration: the configuration file is parsed again and
+ * the new configuration is checked before it is applied. Only new
+ * sessions use the new configuration; active sessions keep the
+ * configuration they started with. Settings that require a restart
+ * (ports, HTTPS certificate, logging file and cover servers) are
+ * not changed.
+ * @return error - error object (or nil)
+ */
+func ReloadConfig() error {
+	logger.Println(logger.INFO, "[sid.config] Reloading configuration...")
+	old := GetConfig()
+	cfg, err := readConfig(old.CfgFile)
+	if err != nil {
+		logger.Printf(logger.ERROR, "[sid.config] Reload failed: %s\n", err.Error())
+		return err
+	}
+	// keep settings that require a restart
+	keep := func(name string, changed bool) {
+		if changed {
+			logger.Printf(logger.WARN, "[sid.config] Changed setting '%s' requires a restart -- ignored\n", name)
+		}
+	}
+	keep("CtrlPort", cfg.CtrlPort != old.CtrlPort)
+	keep("HttpPort", cfg.HttpPort != old.HttpPort)
+	keep("HttpsPort", cfg.HttpsPort != old.HttpsPort)
+	keep("HttpsCert", cfg.HttpsCert != old.HttpsCert)
+	keep("HttpsKey", cfg.HttpsKey != old.HttpsKey)
+	keep("LogFile", cfg.LogFile != old.LogFile)
+	keep("LogToFile", cfg.LogState != old.LogState)
+	keep("CoverSelect", cfg.Covers.Select != old.Covers.Select)
+	keep("CoverServer", strings.Join(cfg.Covers.Servers, ",") != strings.Join(old.Covers.Servers, ","))
+	keep("CoverPin", strings.Join(cfg.Covers.Pins, ",") != strings.Join(old.Covers.Pins, ","))
+	cfg.CtrlPort = old.CtrlPort
+	cfg.HttpPort = old.HttpPort
+	cfg.HttpsPort = old.HttpsPort
+	cfg.HttpsCert = old.HttpsCert
+	cfg.HttpsKey = old.HttpsKey
+	cfg.LogFile = old.LogFile
+	cfg.LogState = old.LogState
+	cfg.Covers = old.Covers
+	for _, name := range []string{"CtrlPort", "HttpPort", "HttpsPort", "HttpsCert", "HttpsKey", "LogFile", "LogToFile", "CoverSelect", "CoverServer", "CoverPin"} {
+		if src, ok := old.src[name]; ok {
+			cfg.src[name] = src
+		} else {
+			delete(cfg.src, name)
+		}
+	}
+
+	// prepare document handler for new upload settings
+	docs, err := NewDocumentHandler(cfg.Upload)
+	if err != nil {
+		logger.Printf(logger.ERROR, "[sid.config] Reload failed: %s\n", err.Error())
+		return err
+	}
+	// apply new configuration; the replaced document handler is
+	// cleaned up when its running uploads are finished.
+	prev := GetDocumentHandler()
+	setConfig(cfg)
+	setDocumentHandler(docs)
+	if prev != nil {
+		go prev.retire(docs)
+	}
+	if len(cfg.LogLevel) > 0 {
+		logger.SetLogLevelFromName(cfg.LogLevel)
+	}
+	logger.Println(logger.INFO, "[sid.config] Configuration reloaded.")
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Private methods
+
+/*
+ * Read and check configuration: the configuration file is parsed into
+ * a copy of the default configuration; command line options override
+ * values from the file. A missing configuration file is not an error.
+ * @param fname string - name of configuration file
+ * @return *Config - new configuration
+ * @return error - error object (or nil)
+ */
+func readConfig(fname string) (*Config, error) {
+	cfg := cfgDefaults.clone()
+	cfg.CfgFile = fname
+
+	logger.Println(logger.INFO, "[sid.config] using configuration file '"+fname+"'")
+	if rdr, err := os.Open(fname); err != nil {
+		logger.Println(logger.WARN, "[sid.config] configuration file not available -- using defaults")
+	} else {
+		// configuration file exists: read parameters
+		errs := make([]string, 0)
+		err = parser.Parser(bufio.NewReader(rdr), newCallback(&cfg, &errs))
+		rdr.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(errs) > 0 {
+			for _, e := range errs {
+				logger.Printf(logger.ERROR, "[sid.config] %s: %s\n", fname, e)
+			}
+			return nil, errors.New(strconv.Itoa(len(errs)) + " error(s) in configuration file '" + fname + "'")
+		}
+		logger.Println(logger.INFO, "[sid.config] configuration file complete.")
+	}
+
+	// handle environment variables and command line flags that may override
+	// options specified in the configuration file (or are default values)
+	for _, opt := range cfgOptions {
+		if opt.Type == OPT_SECTION || opt.Type == OPT_OBSOLETE {
+			continue
+		}
+		if val, ok := os.LookupEnv(opt.EnvName()); ok {
+			vals := []string{val}
+			if opt.Type == OPT_LIST {
+				vals = strings.Split(val, ",")
+			}
+			if err := overrideOption(&cfg, opt, vals, SRC_ENV); err != nil {
+				return nil, errors.New("environment variable " + opt.EnvName() + ": " + err.Error())
+			}
+		}
+		if f, ok := cfgFlags[opt.Name]; ok && len(f.vals) > 0 {
+			if err := overrideOption(&cfg, opt, f.vals, SRC_FLAG); err != nil {
+				return nil, errors.New("flag --" + opt.FlagName() + ": " + err.Error())
+			}
+		}
+	}
+
+	// check configuration
+	if err := checkConfig(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Override option value.
+ * @param cfg *Config - configuration
+ * @param opt *Option - option definition
+ * @param vals []string - new value(s)
+ * @param src string - source of value(s)
+ * @return error - error object (or nil)
+ */
+func overrideOption(cfg *Config, opt *Option, vals []string, src string) error {
+	logger.Printf(logger.INFO, "[sid.config] Overriding '%s' with '%s' (%s)\n", opt.Name, strings.Join(vals, ","), src)
+	opt.Reset(cfg)
+	for _, val := range vals {
+		if err := opt.Set(cfg, val); err != nil {
+			return err
+		}
+	}
+	cfg.src[opt.Name] = src
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Register command line flags for all standard options.
+ */
+func registerFlags() {
+	for _, opt := range cfgOptions {
+		if opt.Type == OPT_SECTION || opt.Type == OPT_OBSOLETE {
+			continue
+		}
+		f := &optionFlag{opt: opt, vals: nil}
+		cfgFlags[opt.Name] = f
+		usage := "option '" + opt.Name + "' (env " + opt.EnvName() + ")"
+		flag.Var(f, opt.FlagName(), usage)
+	}
+	for short, name := range cfgShortFlags {
+		flag.Var(cfgFlags[name], short, "short for --"+GetOption(name).FlagName())
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check configuration for invalid settings (values of options are
+ * already checked against the schema) and prepare access control lists.
+ * @param cfg *Config - configuration
+ * @return error - error object (or nil)
  */
-func callback(mode int, param *parser.Parameter) bool {
-	// if parameter is specified
-	if param != nil {
+func checkConfig(cfg *Config) error {
+	var err error
+	if cfg.ctrlACL, err = NewACL("CtrlAllow", cfg.CtrlAllow); err != nil {
+		return err
+	}
+	if cfg.httpACL, err = NewACL("HttpAllow", cfg.HttpAllow); err != nil {
+		return err
+	}
+	if cfg.UseSocks {
+		if _, _, err := net.SplitHostPort(cfg.SocksAddr); err != nil {
+			return errors.New("invalid SOCKS address '" + cfg.SocksAddr + "'")
+		}
+	}
+	if GetCoverSelector(cfg.Covers.Select) == nil {
+		return errors.New("unknown cover selection strategy '" + cfg.Covers.Select + "'")
+	}
+	switch strings.ToUpper(cfg.Upload.Store) {
+	case "", "LOCAL":
+		if fi, err := os.Stat(cfg.Upload.Path); err != nil || !fi.IsDir() {
+			return errors.New("upload directory '" + cfg.Upload.Path + "' not available")
+		}
+	case "S3", "WEBDAV":
+		if _, err := parseStoreURL(cfg.Upload.StoreURL); err != nil {
+			return err
+		}
+	default:
+		if CustomDocumentStore == nil {
+			return errors.New("unknown document store '" + cfg.Upload.Store + "'")
+		}
+	}
+	return nil
+}
 
+//---------------------------------------------------------------------
+/*
+ * Create access control list for a configuration that has not been
+ * checked (e.g. default configuration): an invalid list denies access.
+ * @param name string - name of list
+ * @param spec string - list specification
+ * @return *ACL - access control list
+ */
+func fallbackACL(name, spec string) *ACL {
+	acl, err := NewACL(name, spec)
+	if err != nil {
+		logger.Printf(logger.ERROR, "[sid.config] %s -- access denied\n", err.Error())
+		acl, _ = NewACL(name, "")
+	}
+	return acl
+}
+
+//---------------------------------------------------------------------
+/*
+ * Set current configuration.
+ * @param cfg *Config - new configuration
+ */
+func setConfig(cfg *Config) {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfgCurrent = cfg
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a (deep) copy of a configuration.
+ * @return Config - copy of configuration
+ */
+func (c *Config) clone() Config {
+	cc := *c
+	cc.Covers.Servers = append([]string{}, c.Covers.Servers...)
+	cc.Covers.Pins = append([]string{}, c.Covers.Pins...)
+	cc.src = make(map[string]string)
+	for k, v := range c.src {
+		cc.src[k] = v
+	}
+	return cc
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create callback handler for the parser that stores parameters in
+ * the given configuration: standard options are checked against the
+ * schema (see options.go), other options are passed to the custom
+ * handler. Errors are collected in the error list.
+ * @param cfg *Config - configuration to be set
+ * @param errs *[]string - list of errors
+ * @return parser.Callback - callback handler
+ */
+func newCallback(cfg *Config, errs *[]string) parser.Callback {
+	section := ""
+	/*
+	 * Handle callback from parser.
+	 * @param mode int - parameter mode
+	 * @param param *Parameter - reference to new parameter
+	 * @return bool - successful operation?
+	 */
+	return func(mode int, param *parser.Parameter) bool {
+		// end of section
+		if param == nil {
+			section = ""
+			return true
+		}
 		// print incoming parameter
 		logger.Printf(logger.DBG, "[sid.config] %d: `%s=%s`\n", mode, param.Name, param.Value)
 
-		if mode != parser.LIST {
-			switch param.Name {
-			case "LogFile":
-				CfgData.LogFile = param.Value
-			case "LogToFile":
-				CfgData.LogState = (param.Value == "ON")
-			case "LogLevel":
-				logger.SetLogLevelFromName(param.Value)
-			case "CrtlPort":
-				SetIntValue(&CfgData.CtrlPort, param.Value)
-			case "CrtlAllow":
-				CfgData.CtrlAllow = param.Value
-			case "HttpPort":
-				SetIntValue(&CfgData.HttpPort, param.Value)
-			case "HttpAllow":
-				CfgData.HttpAllow = param.Value
-			case "UseSocks":
-				CfgData.UseSocks = (param.Value == "ON")
-			case "SocksAddr":
-				CfgData.SocksAddr = param.Value
-			case "Path":
-				CfgData.Upload.Path = param.Value
-			case "Keyring":
-				CfgData.Upload.Keyring = param.Value
-			case "SharePrimeOfs":
-				SetIntValue(&CfgData.Upload.SharePrimeOfs, param.Value)
-			case "ShareTreshold":
-				SetIntValue(&CfgData.Upload.ShareTreshold, param.Value)
+		// handle standard options
+		if opt := GetOption(param.Name); opt != nil {
+			switch {
+			case opt.Type == OPT_OBSOLETE:
+				*errs = append(*errs, "option '"+opt.Name+"' is obsolete: "+opt.Reason)
+			case opt.Type == OPT_SECTION:
+				if mode == parser.LIST {
+					section = opt.Name
+					return true
+				}
+				*errs = append(*errs, "option '"+opt.Name+"' must be a section")
+			case mode == parser.LIST:
+				*errs = append(*errs, "option '"+opt.Name+"' is not a section")
+			case len(opt.Section) > 0 && opt.Section != section:
+				*errs = append(*errs, "option '"+opt.Name+"' is only allowed in section '"+opt.Section+"'")
+			case opt.Section != section:
+				*errs = append(*errs, "option '"+opt.Name+"' is not allowed in section '"+section+"'")
 			default:
-				if CustomConfigHandler != nil {
-					return CustomConfigHandler(mode, param)
+				if err := opt.Set(cfg, param.Value); err != nil {
+					*errs = append(*errs, err.Error())
+				} else {
+					cfg.src[opt.Name] = SRC_FILE
 				}
 			}
-		} else {
-			if CustomConfigHandler != nil {
-				return CustomConfigHandler(mode, param)
-			}
+			return true
+		}
+		// handle custom options
+		if CustomConfigHandler != nil && CustomConfigHandler(mode, param) {
+			return true
+		}
+		msg := "unknown option '" + param.Name + "'"
+		if s := SuggestOption(param.Name); len(s) > 0 {
+			msg += " (did you mean '" + s + "'?)"
 		}
+		*errs = append(*errs, msg)
+		return true
 	}
-	return true
 }
 
 //---------------------------------------------------------------------
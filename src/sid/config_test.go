@@ -0,0 +1,355 @@
+/*
+ * Configuration: option names, validation and sources of values.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Write a configuration file in a new directory (that is also used as
+ * upload directory in the default configuration).
+ * @param t *testing.T - test instance
+ * @param content string - content of configuration file
+ * @return string - name of configuration file
+ */
+func writeTestConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "sid-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "sid.cfg")
+	if err = ioutil.WriteFile(fname, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfgDefaults = CfgData.clone()
+	cfgDefaults.Upload.Path = dir
+	return fname
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read a configuration file with given content (based on the default
+ * configuration and an existing upload directory).
+ * @param t *testing.T - test instance
+ * @param content string - content of configuration file
+ * @return *Config - configuration
+ * @return error - error object (or nil)
+ */
+func testConfig(t *testing.T, content string) (*Config, error) {
+	fname := writeTestConfig(t, content)
+	defer os.RemoveAll(filepath.Dir(fname))
+	return readConfig(fname)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Set command line flags for options (as if parsed from the command
+ * line).
+ * @param flags map[string][]string - values of flags (option name -> values)
+ * @return func() - function to remove the flags
+ */
+func setTestFlags(flags map[string][]string) func() {
+	for name, vals := range flags {
+		f := &optionFlag{opt: GetOption(name)}
+		for _, val := range vals {
+			f.Set(val)
+		}
+		cfgFlags[name] = f
+	}
+	return func() {
+		for name := range flags {
+			delete(cfgFlags, name)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Set environment variables.
+ * @param env map[string]string - environment variables
+ * @return func() - function to remove the variables
+ */
+func setTestEnv(env map[string]string) func() {
+	for name, val := range env {
+		os.Setenv(name, val)
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Deprecated option names are resolved to the current options.
+ */
+func TestConfigAliases(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		name    string
+		value   string
+	}{
+		{"CtrlPort = 4000,\n", "CtrlPort", "4000"},
+		{"CrtlPort = 4001,\n", "CtrlPort", "4001"},
+		{"CrtlAllow = 10.0.0.1,\n", "CtrlAllow", "10.0.0.1"},
+		{"ClientUploads = {\n\tKeyRing = /etc/sid/a.gpg\n}\n", "KeyRing", "/etc/sid/a.gpg"},
+		{"ClientUploads = {\n\tKeyring = /etc/sid/b.gpg\n}\n", "KeyRing", "/etc/sid/b.gpg"},
+		{"ClientUploads = {\n\tSharePrimeOffset = 5\n}\n", "SharePrimeOffset", "5"},
+	} {
+		cfg, err := testConfig(t, tc.content)
+		if err != nil {
+			t.Fatalf("'%s': %s", tc.content, err.Error())
+		}
+		if val := GetOption(tc.name).Get(cfg); val != tc.value {
+			t.Fatalf("'%s': %s = '%s'", tc.content, tc.name, val)
+		}
+		if cfg.src[tc.name] != SRC_FILE {
+			t.Fatalf("'%s': source '%s'", tc.content, cfg.src[tc.name])
+		}
+	}
+	for alias, name := range map[string]string{
+		"CrtlPort":  "CtrlPort",
+		"CrtlAllow": "CtrlAllow",
+		"Keyring":   "KeyRing",
+	} {
+		if opt := GetOption(alias); opt == nil || opt.Name != name {
+			t.Fatalf("alias '%s' not resolved to '%s'", alias, name)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Unknown options, options in the wrong place and invalid values are
+ * rejected.
+ */
+func TestConfigInvalid(t *testing.T) {
+	for _, content := range []string{
+		"LogFil = sid.log,\n",
+		"ctrlport = 2342,\n",
+		"Unknown = 1,\n",
+		"Path = ./uploads,\n",
+		"ClientUploads = 1,\n",
+		"CtrlPort = {\n}\n",
+		"ClientUploads = {\n\tCtrlPort = 2342\n}\n",
+		"ClientUploads = {\n\tKeyRingg = ./pubring.gpg\n}\n",
+		"CtrlPort = 70000,\n",
+		"CtrlPort = port,\n",
+		"LogToFile = maybe,\n",
+		"LogLevel = VERBOSE,\n",
+		"CoverSelect = ROUNDROBIN,\n",
+		"CtrlAllow = 10.0.0.0/33,\n",
+		"UseSocks = ON,\nSocksAddr = localhost,\n",
+		"ClientUploads = {\n\tStore = ftp\n}\n",
+	} {
+		if _, err := testConfig(t, content); err == nil {
+			t.Fatalf("invalid configuration '%s' accepted", content)
+		}
+	}
+	// obsolete options (changed meaning)
+	for _, content := range []string{
+		"ClientUploads = {\n\tPrimeOfs = 568\n}\n",
+		"ClientUploads = {\n\tSharePrimeOfs = 0\n}\n",
+	} {
+		if _, err := testConfig(t, content); err == nil {
+			t.Fatalf("obsolete option in '%s' accepted", content)
+		}
+	}
+	for _, name := range []string{"PrimeOfs", "SharePrimeOfs"} {
+		if opt := GetOption(name); opt == nil || opt.Type != OPT_OBSOLETE {
+			t.Fatalf("option '%s' not marked obsolete", name)
+		}
+	}
+	if s := SuggestOption("PrimeOf"); s == "PrimeOfs" {
+		t.Fatal("obsolete option suggested")
+	}
+	// valid configuration (for comparison)
+	if _, err := testConfig(t, "LogFile = sid.log,\nCtrlPort = 2342,\nClientUploads = {\n\tKeyRing = ./pubring.gpg\n}\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Suggestions for misspelled options.
+ */
+func TestSuggestOption(t *testing.T) {
+	for name, expect := range map[string]string{
+		"LogFil":     "LogFile",
+		"ctrlport":   "CtrlPort",
+		"CrtlPrt":    "CtrlPort",
+		"keyringg":   "KeyRing",
+		"Httpsport":  "HttpsPort",
+		"Completely": "",
+	} {
+		if s := SuggestOption(name); s != expect {
+			t.Fatalf("'%s' suggested for '%s' (expected '%s')", s, name, expect)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Precedence of option values: command line flags override environment
+ * variables, which override the configuration file.
+ */
+func TestConfigPrecedence(t *testing.T) {
+	file := "CtrlPort = 3000,\nCoverServer = a.example.org,\nCoverServer = b.example.org,\n" +
+		"ClientUploads = {\n\tKeyRing = ./file.gpg,\n\tMaxSize = 10\n}\n"
+	for _, tc := range []struct {
+		env   map[string]string
+		flags map[string][]string
+		name  string
+		value string
+		src   string
+	}{
+		{nil, nil, "CtrlPort", "3000", SRC_FILE},
+		{nil, nil, "HttpPort", "80", ""},
+		{map[string]string{"SID_CTRL_PORT": "3001"}, nil, "CtrlPort", "3001", SRC_ENV},
+		{map[string]string{"SID_CTRL_PORT": "3001"}, map[string][]string{"CtrlPort": {"3002"}}, "CtrlPort", "3002", SRC_FLAG},
+		{nil, map[string][]string{"CtrlPort": {"3002"}}, "CtrlPort", "3002", SRC_FLAG},
+		{map[string]string{"SID_HTTP_PORT": "8080"}, nil, "HttpPort", "8080", SRC_ENV},
+		{map[string]string{"SID_UPLOAD_KEYRING": "./env.gpg"}, nil, "KeyRing", "./env.gpg", SRC_ENV},
+		{map[string]string{"SID_UPLOAD_KEYRING": "./env.gpg"}, map[string][]string{"KeyRing": {"./flag.gpg"}}, "KeyRing", "./flag.gpg", SRC_FLAG},
+		{map[string]string{"SID_UPLOAD_MAX_SIZE": "20"}, nil, "MaxSize", "20", SRC_ENV},
+		{map[string]string{"SID_COVER_SERVER": "c.example.org,d.example.org"}, nil, "CoverServer", "c.example.org,d.example.org", SRC_ENV},
+		{nil, map[string][]string{"CoverServer": {"e.example.org", "f.example.org"}}, "CoverServer", "e.example.org,f.example.org", SRC_FLAG},
+		{nil, nil, "CoverServer", "a.example.org,b.example.org", SRC_FILE},
+		{map[string]string{"SID_LOG_TO_FILE": "ON"}, map[string][]string{"LogToFile": {"false"}}, "LogToFile", "OFF", SRC_FLAG},
+		{nil, map[string][]string{"LogToFile": {"true"}}, "LogToFile", "ON", SRC_FLAG},
+	} {
+		unsetEnv := setTestEnv(tc.env)
+		unsetFlags := setTestFlags(tc.flags)
+		cfg, err := testConfig(t, file)
+		unsetFlags()
+		unsetEnv()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err.Error())
+		}
+		if val := GetOption(tc.name).Get(cfg); val != tc.value {
+			t.Fatalf("%s = '%s' (expected '%s')", tc.name, val, tc.value)
+		}
+		if src := cfg.src[tc.name]; src != tc.src {
+			t.Fatalf("%s: source '%s' (expected '%s')", tc.name, src, tc.src)
+		}
+	}
+
+	// invalid values from environment and flags are rejected
+	unset := setTestEnv(map[string]string{"SID_CTRL_PORT": "none"})
+	_, err := testConfig(t, file)
+	unset()
+	if err == nil {
+		t.Fatal("invalid environment variable accepted")
+	}
+	unset = setTestFlags(map[string][]string{"HttpPort": {"0"}})
+	_, err = testConfig(t, file)
+	unset()
+	if err == nil {
+		t.Fatal("invalid flag accepted")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * A reloaded configuration keeps the settings that require a restart
+ * (and the values from flags and environment variables).
+ */
+func TestReloadConfig(t *testing.T) {
+	fname := writeTestConfig(t, "CtrlPort = 3000,\nHttpPort = 8000,\nHttpAllow = 127.0.0.1,\n"+
+		"ShutdownTimeout = 10,\nCoverServer = a.example.org,\nClientUploads = {\n\tShareTreshold = 0\n}\n")
+	defer os.RemoveAll(filepath.Dir(fname))
+	defer setTestEnv(map[string]string{"SID_HTTPS_PORT": "8443"})()
+	defer setTestFlags(map[string][]string{"ShutdownTimeout": {"20"}})()
+
+	cfg, err := readConfig(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+	defer setConfig(nil)
+	defer setDocumentHandler(nil)
+
+	// changed configuration file
+	content := "CtrlPort = 4000,\nHttpPort = 8001,\nHttpAllow = 10.0.0.0/8,\nLogToFile = ON,\n" +
+		"ShutdownTimeout = 15,\nCoverServer = b.example.org,\nCoverSelect = STICKY,\n" +
+		"ClientUploads = {\n\tShareTreshold = 0,\n\tMaxSize = 5\n}\n"
+	if err = ioutil.WriteFile(fname, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cur := GetConfig()
+	if cur == cfg {
+		t.Fatal("configuration not replaced")
+	}
+	for _, tc := range []struct {
+		name  string
+		value string
+		src   string
+	}{
+		{"CtrlPort", "3000", SRC_FILE},
+		{"HttpPort", "8000", SRC_FILE},
+		{"HttpsPort", "8443", SRC_ENV},
+		{"LogToFile", "OFF", ""},
+		{"CoverServer", "a.example.org", SRC_FILE},
+		{"CoverSelect", "RANDOM", ""},
+		{"ShutdownTimeout", "20", SRC_FLAG},
+		{"HttpAllow", "10.0.0.0/8", SRC_FILE},
+		{"MaxSize", "5", SRC_FILE},
+	} {
+		if val := GetOption(tc.name).Get(cur); val != tc.value {
+			t.Fatalf("%s = '%s' after reload (expected '%s')", tc.name, val, tc.value)
+		}
+		if src := cur.src[tc.name]; src != tc.src {
+			t.Fatalf("%s: source '%s' after reload (expected '%s')", tc.name, src, tc.src)
+		}
+	}
+	if !cur.HttpACL().IsAllowed("10.1.2.3:1234") {
+		t.Fatal("new access control list not applied")
+	}
+	if GetDocumentHandler() == nil || GetDocumentHandler().maxSize != 5<<20 {
+		t.Fatal("new document handler not applied")
+	}
+
+	// invalid configuration: current configuration is kept
+	if err = ioutil.WriteFile(fname, []byte("HttpAllow = 10.0.0.0/33,\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ReloadConfig() == nil {
+		t.Fatal("invalid configuration applied")
+	}
+	if GetConfig() != cur {
+		t.Fatal("configuration replaced by invalid configuration")
+	}
+}
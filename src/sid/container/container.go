@@ -0,0 +1,378 @@
+/*
+ * Document container: Authenticated encryption of client documents in
+ * a versioned file format. The document is encrypted in chunks, so
+ * large documents can be processed as a stream; every chunk is
+ * authenticated and the sequence of chunks is protected against
+ * re-ordering and truncation.
+ *
+ * File format (version 1):
+ *
+ *	+--------+---------+-----------+------------+--------------+
+ *	| magic  | version | algorithm | chunk size | nonce prefix |
+ *	| "SIDC" | 1 byte  | 1 byte    | 4 bytes    | 6 bytes      |
+ *	+--------+---------+-----------+------------+--------------+
+ *	| chunk #0: ciphertext + tag                               |
+ *	| ...                                                      |
+ *	| chunk #n: ciphertext + tag (last chunk)                  |
+ *	+----------------------------------------------------------+
+ *
+ * The nonce of a chunk is the nonce prefix followed by the chunk number
+ * (4 bytes, big-endian) and a flag for the last chunk (2 bytes); the
+ * header is the additional authenticated data of every chunk. All
+ * chunks but the last have the full chunk size; the last chunk can be
+ * empty. Files without header (legacy format) start with the IV for
+ * AES-256 in CFB mode (no authentication).
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package container
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	MAGIC   = "SIDC" // magic bytes of container header
+	VERSION = 1      // current version of container format
+
+	ALG_AES256_GCM = 1 // AES-256 in GCM mode
+
+	HEADER_SIZE    = 16          // size of container header
+	KEY_SIZE       = 32          // size of encryption key
+	CHUNK_SIZE     = 64 * 1024   // default size of chunks
+	MAX_CHUNK_SIZE = 1024 * 1024 // max. size of chunks (reader)
+
+	prefixSize = 6 // size of nonce prefix
+)
+
+///////////////////////////////////////////////////////////////////////
+// Errors
+
+var (
+	ErrKey    = errors.New("container: invalid key size")
+	ErrHeader = errors.New("container: invalid header")
+	ErrAuth   = errors.New("container: message authentication failed (document modified or truncated)")
+	ErrClosed = errors.New("container: writer closed")
+)
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Container writer: encrypts a document into a container.
+ */
+type Writer struct {
+	wrt    io.Writer   // output of container
+	aead   cipher.AEAD // authenticated encryption
+	header []byte      // container header
+	buf    []byte      // data of current chunk
+	count  uint32      // number of current chunk
+	size   int         // size of chunks
+	closed bool        // writer closed?
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new container writer: the container header is written
+ * immediately; the last chunk is written when the writer is closed.
+ * @param wrt io.Writer - output of container
+ * @param key []byte - encryption key (KEY_SIZE bytes)
+ * @return *Writer - new container writer
+ * @return error - error object (or nil)
+ */
+func NewWriter(wrt io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(ALG_AES256_GCM, key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, HEADER_SIZE)
+	copy(header, MAGIC)
+	header[4] = VERSION
+	header[5] = ALG_AES256_GCM
+	binary.BigEndian.PutUint32(header[6:10], CHUNK_SIZE)
+	if _, err = io.ReadFull(rand.Reader, header[10:]); err != nil {
+		return nil, err
+	}
+	if _, err = wrt.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		wrt:    wrt,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, CHUNK_SIZE),
+		count:  0,
+		size:   CHUNK_SIZE,
+		closed: false,
+	}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Encrypt document data (implements io.Writer interface).
+ * @param data []byte - document data
+ * @return int - number of bytes processed
+ * @return error - error object (or nil)
+ */
+func (w *Writer) Write(data []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	n := 0
+	for len(data) > 0 {
+		// a full chunk is only written if more data follows
+		// (the last chunk is written on close).
+		if len(w.buf) == w.size {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(w.buf[len(w.buf):w.size], data)
+		w.buf = w.buf[:len(w.buf)+k]
+		data = data[k:]
+		n += k
+	}
+	return n, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write last chunk (implements io.Closer interface); the underlying
+ * output is not closed.
+ * @return error - error object (or nil)
+ */
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Encrypt and write current chunk.
+ * @param last bool - last chunk?
+ * @return error - error object (or nil)
+ */
+func (w *Writer) flush(last bool) error {
+	nonce := chunkNonce(w.header, w.count, last)
+	out := w.aead.Seal(nil, nonce, w.buf, w.header)
+	w.count++
+	w.buf = w.buf[:0]
+	_, err := w.wrt.Write(out)
+	return err
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Container reader: decrypts a document from a container. Data is only
+ * returned after it has been authenticated; a reader for a legacy file
+ * returns unauthenticated data.
+ */
+type Reader struct {
+	Version int // version of container format (0: legacy)
+
+	rdr    *bufio.Reader // input of container
+	aead   cipher.AEAD   // authenticated decryption (nil: legacy)
+	stream cipher.Stream // legacy decryption
+	header []byte        // container header
+	buf    []byte        // decrypted data of current chunk
+	chunk  []byte        // encrypted data of current chunk
+	count  uint32        // number of current chunk
+	done   bool          // last chunk processed?
+	err    error         // pending error
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new container reader: the format of the container is
+ * detected from the header.
+ * @param rdr io.Reader - input of container
+ * @param key []byte - decryption key (KEY_SIZE bytes)
+ * @return *Reader - new container reader
+ * @return error - error object (or nil)
+ */
+func NewReader(rdr io.Reader, key []byte) (*Reader, error) {
+	if len(key) != KEY_SIZE {
+		return nil, ErrKey
+	}
+	r := &Reader{
+		rdr: bufio.NewReader(rdr),
+	}
+	header, err := r.rdr.Peek(HEADER_SIZE)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(header) == HEADER_SIZE && bytes.Equal(header[:4], []byte(MAGIC)) {
+		if header[4] != VERSION {
+			return nil, ErrHeader
+		}
+		size := binary.BigEndian.Uint32(header[6:10])
+		if size == 0 || size > MAX_CHUNK_SIZE {
+			return nil, ErrHeader
+		}
+		if r.aead, err = newAEAD(int(header[5]), key); err != nil {
+			return nil, err
+		}
+		r.Version = int(header[4])
+		r.header = make([]byte, HEADER_SIZE)
+		copy(r.header, header)
+		r.rdr.Discard(HEADER_SIZE)
+		r.chunk = make([]byte, int(size)+r.aead.Overhead())
+		return r, nil
+	}
+	// legacy format: AES-256 in CFB mode
+	engine, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, engine.BlockSize())
+	if _, err = io.ReadFull(r.rdr, iv); err != nil {
+		return nil, ErrHeader
+	}
+	r.stream = cipher.NewCFBDecrypter(engine, iv)
+	return r, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if the container is authenticated (not in legacy format).
+ * @return bool - authenticated container?
+ */
+func (r *Reader) Authenticated() bool {
+	return r.aead != nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read decrypted document data (implements io.Reader interface).
+ * @param data []byte - buffer for document data
+ * @return int - number of bytes read
+ * @return error - error object (or nil)
+ */
+func (r *Reader) Read(data []byte) (int, error) {
+	// legacy format
+	if r.aead == nil {
+		n, err := r.rdr.Read(data)
+		r.stream.XORKeyStream(data[:n], data[:n])
+		return n, err
+	}
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+	n := copy(data, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read and decrypt next chunk.
+ * @return error - error object (or nil)
+ */
+func (r *Reader) next() error {
+	n, err := io.ReadFull(r.rdr, r.chunk)
+	last := false
+	switch err {
+	case nil:
+		// full chunk: last chunk if no more data follows
+		if _, err = r.rdr.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+	if n < r.aead.Overhead() {
+		return ErrAuth
+	}
+	nonce := chunkNonce(r.header, r.count, last)
+	if r.buf, err = r.aead.Open(r.chunk[:0], nonce, r.chunk[:n], r.header); err != nil {
+		return ErrAuth
+	}
+	r.count++
+	r.done = last
+	// chunk numbers must not wrap around
+	if !last && r.count == 0 {
+		return ErrAuth
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Create authenticated encryption for an algorithm.
+ * @param alg int - algorithm identifier
+ * @param key []byte - key
+ * @return cipher.AEAD - authenticated encryption
+ * @return error - error object (or nil)
+ */
+func newAEAD(alg int, key []byte) (cipher.AEAD, error) {
+	if len(key) != KEY_SIZE {
+		return nil, ErrKey
+	}
+	switch alg {
+	case ALG_AES256_GCM:
+		engine, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(engine)
+	}
+	return nil, ErrHeader
+}
+
+//---------------------------------------------------------------------
+/*
+ * Compute nonce for a chunk.
+ * @param header []byte - container header
+ * @param count uint32 - number of chunk
+ * @param last bool - last chunk?
+ * @return []byte - nonce
+ */
+func chunkNonce(header []byte, count uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[HEADER_SIZE-prefixSize:])
+	binary.BigEndian.PutUint32(nonce[prefixSize:], count)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,334 @@
+/*
+ * Document container: round trip, authentication and legacy format
+ * tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package container
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+// size of an encrypted (full) chunk
+const sealedSize = CHUNK_SIZE + 16
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Generate random data.
+ * @param n int - number of bytes
+ * @return []byte - random data
+ */
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	io.ReadFull(rand.Reader, data)
+	return data
+}
+
+//---------------------------------------------------------------------
+/*
+ * Encrypt a document into a container (written in odd pieces).
+ * @param t *testing.T - test instance
+ * @param data []byte - document data
+ * @param key []byte - encryption key
+ * @return []byte - container
+ */
+func seal(t *testing.T, data, key []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pos := 0; pos < len(data); pos += 7777 {
+		end := pos + 7777
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err = w.Write(data[pos:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Decrypt a container.
+ * @param data []byte - container
+ * @param key []byte - decryption key
+ * @return []byte - document data
+ * @return error - error object (or nil)
+ */
+func open(data, key []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Documents of any size are decrypted from authenticated containers.
+ */
+func TestContainerRoundTrip(t *testing.T) {
+	key := randomData(KEY_SIZE)
+	for _, n := range []int{0, 1, CHUNK_SIZE - 1, CHUNK_SIZE, CHUNK_SIZE + 1, 3*CHUNK_SIZE + 100} {
+		data := randomData(n)
+		c := seal(t, data, key)
+		chunks := (n + CHUNK_SIZE - 1) / CHUNK_SIZE
+		if chunks == 0 {
+			chunks = 1
+		}
+		if len(c) != HEADER_SIZE+n+16*chunks {
+			t.Fatalf("%d: container size %d", n, len(c))
+		}
+		r, err := NewReader(bytes.NewReader(c), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Authenticated() || r.Version != VERSION {
+			t.Fatalf("%d: container not authenticated", n)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%d: %s", n, err.Error())
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("%d: document mismatch", n)
+		}
+	}
+
+	// no writes after close
+	w, err := NewWriter(ioutil.Discard, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err = w.Write([]byte("data")); err != ErrClosed {
+		t.Fatal("write after close accepted")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Truncated (or extended) containers are detected: the last chunk is
+ * flagged in its nonce, so a container can't be cut at a chunk boundary.
+ */
+func TestContainerTruncated(t *testing.T) {
+	key := randomData(KEY_SIZE)
+	c := seal(t, randomData(3*CHUNK_SIZE+100), key)
+	for _, size := range []int{
+		HEADER_SIZE,                   // header only
+		HEADER_SIZE + 10,              // inside tag
+		HEADER_SIZE + sealedSize,      // chunk boundary
+		HEADER_SIZE + sealedSize + 50, // inside chunk
+		HEADER_SIZE + 3*sealedSize,    // last chunk dropped
+		len(c) - 1,                    // inside last chunk
+	} {
+		if _, err := open(c[:size], key); err != ErrAuth {
+			t.Fatalf("container truncated to %d bytes not detected", size)
+		}
+	}
+
+	// data appended to the last chunk
+	ext := append(append([]byte{}, c...), randomData(20)...)
+	if _, err := open(ext, key); err != ErrAuth {
+		t.Fatal("extended container not detected")
+	}
+
+	// a container ending in a full chunk
+	c = seal(t, randomData(2*CHUNK_SIZE), key)
+	if _, err := open(c[:HEADER_SIZE+sealedSize], key); err != ErrAuth {
+		t.Fatal("container truncated at chunk boundary not detected")
+	}
+	if _, err := open(c, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Reordered chunks are detected: the chunk number is part of the nonce.
+ * No data of a modified chunk is returned.
+ */
+func TestContainerReordered(t *testing.T) {
+	key := randomData(KEY_SIZE)
+	data := randomData(3*CHUNK_SIZE + 100)
+	c := seal(t, data, key)
+
+	swapped := append([]byte{}, c[:HEADER_SIZE]...)
+	swapped = append(swapped, c[HEADER_SIZE+sealedSize:HEADER_SIZE+2*sealedSize]...)
+	swapped = append(swapped, c[HEADER_SIZE:HEADER_SIZE+sealedSize]...)
+	swapped = append(swapped, c[HEADER_SIZE+2*sealedSize:]...)
+	out, err := open(swapped, key)
+	if err != ErrAuth {
+		t.Fatal("swapped chunks not detected")
+	}
+	if len(out) != 0 {
+		t.Fatalf("%d bytes returned from swapped chunk", len(out))
+	}
+
+	// chunk from another container (same key)
+	other := seal(t, data, key)
+	mixed := append([]byte{}, c[:HEADER_SIZE+sealedSize]...)
+	mixed = append(mixed, other[HEADER_SIZE+sealedSize:]...)
+	out, err = open(mixed, key)
+	if err != ErrAuth {
+		t.Fatal("chunk of other container not detected")
+	}
+	if !bytes.Equal(out, data[:CHUNK_SIZE]) {
+		t.Fatal("data of authenticated chunk not returned")
+	}
+
+	// modified ciphertext
+	mod := append([]byte{}, c...)
+	mod[HEADER_SIZE+sealedSize+5] ^= 1
+	if _, err = open(mod, key); err != ErrAuth {
+		t.Fatal("modified chunk not detected")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Containers can't be decrypted with a wrong key; keys of wrong size
+ * are rejected.
+ */
+func TestContainerWrongKey(t *testing.T) {
+	key := randomData(KEY_SIZE)
+	c := seal(t, []byte("secret document"), key)
+	out, err := open(c, randomData(KEY_SIZE))
+	if err != ErrAuth {
+		t.Fatal("container decrypted with wrong key")
+	}
+	if len(out) != 0 {
+		t.Fatal("data returned for wrong key")
+	}
+
+	for _, n := range []int{0, 16, KEY_SIZE + 1} {
+		if _, err = NewWriter(ioutil.Discard, randomData(n)); err != ErrKey {
+			t.Fatalf("writer with %d byte key created", n)
+		}
+		if _, err = NewReader(bytes.NewReader(c), randomData(n)); err != ErrKey {
+			t.Fatalf("reader with %d byte key created", n)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * The header is authenticated; unsupported headers are rejected.
+ */
+func TestContainerHeader(t *testing.T) {
+	key := randomData(KEY_SIZE)
+	c := seal(t, []byte("secret document"), key)
+
+	// modified nonce prefix
+	mod := append([]byte{}, c...)
+	mod[HEADER_SIZE-1] ^= 1
+	if _, err := open(mod, key); err != ErrAuth {
+		t.Fatal("modified header not detected")
+	}
+	// modified (valid) chunk size
+	mod = append([]byte{}, c...)
+	mod[9] ^= 0xff
+	if _, err := open(mod, key); err != ErrAuth {
+		t.Fatal("modified chunk size not detected")
+	}
+	// unsupported version, algorithm and chunk sizes
+	for _, pos := range []int{4, 5, 6} {
+		mod = append([]byte{}, c...)
+		mod[pos] ^= 0xff
+		if _, err := open(mod, key); err != ErrHeader {
+			t.Fatalf("invalid header byte %d not detected", pos)
+		}
+	}
+	mod = append([]byte{}, c...)
+	copy(mod[6:10], []byte{0, 0, 0, 0})
+	if _, err := open(mod, key); err != ErrHeader {
+		t.Fatal("chunk size 0 accepted")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Legacy containers (AES-256 in CFB mode) are decrypted without
+ * authentication.
+ */
+func TestContainerLegacy(t *testing.T) {
+	key := randomData(KEY_SIZE)
+	data := randomData(100000)
+	engine, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := randomData(engine.BlockSize())
+	enc := make([]byte, len(data))
+	cipher.NewCFBEncrypter(engine, iv).XORKeyStream(enc, data)
+	c := append(iv, enc...)
+
+	r, err := NewReader(bytes.NewReader(c), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Authenticated() || r.Version != 0 {
+		t.Fatal("legacy container reported as authenticated")
+	}
+	// read in odd pieces
+	out := make([]byte, 0, len(data))
+	buf := make([]byte, 999)
+	for {
+		n, err := r.Read(buf)
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("legacy document mismatch")
+	}
+
+	// empty legacy document
+	if out, err = open(iv, key); err != nil || len(out) != 0 {
+		t.Fatal("empty legacy document not decrypted")
+	}
+	// incomplete IV
+	if _, err = NewReader(bytes.NewReader(iv[:10]), key); err != ErrHeader {
+		t.Fatal("legacy container without IV accepted")
+	}
+}
@@ -0,0 +1,387 @@
+/*
+ * Share exchange: distributed combination of shares without revealing
+ * a share to anyone but the combining party. The combining party
+ * creates a session with an ephemeral key pair and sends a request
+ * (document id, session id and public key of the session) to the
+ * reviewers; each reviewer answers with a response that contains the
+ * share sealed to the public key of the session (NaCl box with an
+ * ephemeral key pair of the reviewer). Only the combining party can
+ * open the responses, and only in the session they were created for.
+ *
+ * Record formats (version 1):
+ *
+ *	SID-REQUEST 1            SID-RESPONSE 1
+ *	document=<document id>   document=<document id>
+ *	session=<hex>            session=<hex>
+ *	key=<hex>                key=<hex (public key of reviewer)>
+ *	checksum=<hex>           nonce=<hex>
+ *	                         share=<base64 (sealed share record)>
+ *	                         checksum=<hex>
+ *
+ * A session record additionally contains the private key of the
+ * session; it must never leave the computer of the combining party.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package container
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/nacl/box"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	REQUEST_MAGIC    = "SID-REQUEST"  // first word of a request record
+	RESPONSE_MAGIC   = "SID-RESPONSE" // first word of a response record
+	SESSION_MAGIC    = "SID-SESSION"  // first word of a session record
+	EXCHANGE_VERSION = 1              // current version of exchange records
+
+	sessionIdSize = 16 // size of session id
+)
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Request for shares of a document key.
+ */
+type Request struct {
+	Document string    // document id
+	Session  string    // session id (hex)
+	Key      *[32]byte // public key of session
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write request record.
+ * @param wrt io.Writer - output of record
+ * @return error - error object (or nil)
+ */
+func (r *Request) Write(wrt io.Writer) error {
+	return writeRecord(wrt, REQUEST_MAGIC, EXCHANGE_VERSION, []string{
+		"document", r.Document,
+		"session", r.Session,
+		"key", hex.EncodeToString(r.Key[:]),
+	})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse request record.
+ * @param data []byte - request record
+ * @return *Request - request for shares
+ * @return error - error object (or nil)
+ */
+func ParseRequest(data []byte) (*Request, error) {
+	_, fields, err := parseRecord(data, REQUEST_MAGIC, EXCHANGE_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	r := &Request{Document: fields["document"], Session: fields["session"]}
+	if len(r.Document) == 0 || len(r.Session) == 0 {
+		return nil, errors.New("container: incomplete request")
+	}
+	if r.Key, err = parseKey("key", fields["key"]); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get fingerprint of request: the fingerprint is compared by the
+ * combining party and the reviewer on a separate channel (e.g. phone)
+ * to make sure the request has not been replaced.
+ * @return string - fingerprint of request
+ */
+func (r *Request) Fingerprint() string {
+	h := sha256.New()
+	h.Write([]byte(r.Document + "\x00" + r.Session + "\x00"))
+	h.Write(r.Key[:])
+	fp := strings.ToUpper(hex.EncodeToString(h.Sum(nil)[:10]))
+	list := make([]string, 0, 5)
+	for i := 0; i < len(fp); i += 4 {
+		list = append(list, fp[i:i+4])
+	}
+	return strings.Join(list, "-")
+}
+
+//---------------------------------------------------------------------
+/*
+ * Seal a share for the combining party (in the format of the share).
+ * @param share *Share - share of document key
+ * @return *Response - response with sealed share
+ * @return error - error object (or nil)
+ */
+func (r *Request) Seal(share *Share) (*Response, error) {
+	if share.Version > 0 && share.Document != r.Document {
+		return nil, fmt.Errorf("container: share belongs to document '%s'", share.Document)
+	}
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(priv[:])
+	resp := &Response{
+		Document: r.Document,
+		Session:  r.Session,
+		Key:      pub,
+		Nonce:    new([24]byte),
+	}
+	if _, err = io.ReadFull(rand.Reader, resp.Nonce[:]); err != nil {
+		return nil, err
+	}
+	// legacy shares (without document id) are sealed in legacy format
+	buf := new(bytes.Buffer)
+	if share.Version > 0 {
+		err = share.Write(buf)
+	} else {
+		_, err = fmt.Fprintf(buf, "%s\n%s\n%s\n", share.P, share.X, share.Y)
+	}
+	defer wipe(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	resp.Sealed = box.Seal(nil, buf.Bytes(), resp.Nonce, r.Key, priv)
+	return resp, nil
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Response with a sealed share.
+ */
+type Response struct {
+	Document string    // document id
+	Session  string    // session id (hex)
+	Key      *[32]byte // ephemeral public key of reviewer
+	Nonce    *[24]byte // nonce of sealed share
+	Sealed   []byte    // sealed share record
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write response record.
+ * @param wrt io.Writer - output of record
+ * @return error - error object (or nil)
+ */
+func (r *Response) Write(wrt io.Writer) error {
+	return writeRecord(wrt, RESPONSE_MAGIC, EXCHANGE_VERSION, []string{
+		"document", r.Document,
+		"session", r.Session,
+		"key", hex.EncodeToString(r.Key[:]),
+		"nonce", hex.EncodeToString(r.Nonce[:]),
+		"share", base64.StdEncoding.EncodeToString(r.Sealed),
+	})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse response record.
+ * @param data []byte - response record
+ * @return *Response - response with sealed share
+ * @return error - error object (or nil)
+ */
+func ParseResponse(data []byte) (*Response, error) {
+	_, fields, err := parseRecord(data, RESPONSE_MAGIC, EXCHANGE_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	r := &Response{Document: fields["document"], Session: fields["session"]}
+	if len(r.Document) == 0 || len(r.Session) == 0 {
+		return nil, errors.New("container: incomplete response")
+	}
+	if r.Key, err = parseKey("key", fields["key"]); err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(fields["nonce"])
+	if err != nil || len(nonce) != 24 {
+		return nil, errors.New("container: invalid nonce in response")
+	}
+	r.Nonce = new([24]byte)
+	copy(r.Nonce[:], nonce)
+	if r.Sealed, err = base64.StdEncoding.DecodeString(fields["share"]); err != nil {
+		return nil, errors.New("container: invalid share in response")
+	}
+	return r, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if data is a response record.
+ * @param data []byte - data
+ * @return bool - response record?
+ */
+func IsResponse(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(RESPONSE_MAGIC+" "))
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Session of the combining party: the private key of the session is
+ * needed to open the responses of the reviewers.
+ */
+type Session struct {
+	Request           // request of session
+	priv    *[32]byte // private key of session
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new session for a document.
+ * @param document string - document id
+ * @return *Session - new session
+ * @return error - error object (or nil)
+ */
+func NewSession(document string) (*Session, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, sessionIdSize)
+	if _, err = io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	return &Session{
+		Request: Request{
+			Document: document,
+			Session:  hex.EncodeToString(id),
+			Key:      pub,
+		},
+		priv: priv,
+	}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write session record (including the private key).
+ * @param wrt io.Writer - output of record
+ * @return error - error object (or nil)
+ */
+func (s *Session) Write(wrt io.Writer) error {
+	return writeRecord(wrt, SESSION_MAGIC, EXCHANGE_VERSION, []string{
+		"document", s.Document,
+		"session", s.Session,
+		"key", hex.EncodeToString(s.Key[:]),
+		"private", hex.EncodeToString(s.priv[:]),
+	})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse session record.
+ * @param data []byte - session record
+ * @return *Session - session of combining party
+ * @return error - error object (or nil)
+ */
+func ParseSession(data []byte) (*Session, error) {
+	_, fields, err := parseRecord(data, SESSION_MAGIC, EXCHANGE_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{Request: Request{Document: fields["document"], Session: fields["session"]}}
+	if len(s.Document) == 0 || len(s.Session) == 0 {
+		return nil, errors.New("container: incomplete session")
+	}
+	if s.Key, err = parseKey("key", fields["key"]); err != nil {
+		return nil, err
+	}
+	if s.priv, err = parseKey("private", fields["private"]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Open the sealed share of a response.
+ * @param r *Response - response of a reviewer
+ * @return *Share - share of document key
+ * @return error - error object (or nil)
+ */
+func (s *Session) Open(r *Response) (*Share, error) {
+	if r.Session != s.Session {
+		return nil, errors.New("container: response belongs to a different session")
+	}
+	if r.Document != s.Document {
+		return nil, fmt.Errorf("container: response belongs to document '%s'", r.Document)
+	}
+	data, ok := box.Open(nil, r.Sealed, r.Nonce, r.Key, s.priv)
+	if !ok {
+		return nil, errors.New("container: can't open response (modified or sealed for a different session)")
+	}
+	defer wipe(data)
+	share, err := ParseShare(data)
+	if err != nil {
+		return nil, err
+	}
+	if share.Version > 0 && share.Document != s.Document {
+		return nil, fmt.Errorf("container: share belongs to document '%s'", share.Document)
+	}
+	return share, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Close session: the private key is cleared.
+ */
+func (s *Session) Close() {
+	wipe(s.priv[:])
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Parse a (hex-encoded) key of an exchange record.
+ * @param name string - name of key
+ * @param val string - hex representation of key
+ * @return *[32]byte - key
+ * @return error - error object (or nil)
+ */
+func parseKey(name, val string) (*[32]byte, error) {
+	data, err := hex.DecodeString(val)
+	if err != nil || len(data) != 32 {
+		return nil, fmt.Errorf("container: invalid value '%s' in record", name)
+	}
+	key := new([32]byte)
+	copy(key[:], data)
+	wipe(data)
+	return key, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Overwrite sensitive data in memory.
+ * @param data []byte - data to be cleared
+ */
+func wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Share exchange: request, response and session tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package container
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Record of the share exchange.
+ */
+type record interface {
+	Write(wrt io.Writer) error
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write a record and return it as bytes.
+ * @param t *testing.T - test instance
+ * @param rec record - record
+ * @return []byte - record data
+ */
+func recordData(t *testing.T, rec record) []byte {
+	buf := new(bytes.Buffer)
+	if err := rec.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * A share sealed for a request can be opened by the session of the
+ * request (with all records passed in their written form).
+ */
+func TestExchangeRoundTrip(t *testing.T) {
+	share := testShare(5, "98765432109876543210")
+	sess, err := NewSession(share.Document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// combining party: session and request records
+	sessRec := recordData(t, sess)
+	reqRec := recordData(t, &sess.Request)
+	if bytes.Contains(reqRec, []byte("private")) {
+		t.Fatal("private key in request")
+	}
+
+	// reviewer: sealed response
+	req, err := ParseRequest(reqRec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Fingerprint() != sess.Fingerprint() {
+		t.Fatal("fingerprint of request changed")
+	}
+	if !regexp.MustCompile("^[0-9A-F]{4}(-[0-9A-F]{4}){4}$").MatchString(req.Fingerprint()) {
+		t.Fatalf("wrong fingerprint '%s'", req.Fingerprint())
+	}
+	resp, err := req.Seal(share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respRec := recordData(t, resp)
+	if !IsResponse(respRec) || IsResponse(sessRec) {
+		t.Fatal("response record not detected")
+	}
+	if bytes.Contains(respRec, []byte("98765432109876543210")) {
+		t.Fatal("share not sealed")
+	}
+
+	// combining party: open response
+	s, err := ParseSession(sessRec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ParseResponse(respRec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := s.Open(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.Document != share.Document || ss.P.Cmp(share.P) != 0 || ss.X.Cmp(share.X) != 0 || ss.Y.Cmp(share.Y) != 0 {
+		t.Fatalf("wrong share %v", ss)
+	}
+
+	// legacy shares (without document id) are sealed too
+	legacy := testShare(6, "4711")
+	legacy.Version, legacy.Document = 0, ""
+	if resp, err = req.Seal(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if ss, err = s.Open(resp); err != nil {
+		t.Fatal(err)
+	}
+	if ss.Version != 0 || ss.X.Int64() != 6 || ss.Y.Int64() != 4711 {
+		t.Fatalf("wrong legacy share %v", ss)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Responses can't be opened with the wrong key, in a different session
+ * or for a different document; modified responses are rejected.
+ */
+func TestExchangeWrongKey(t *testing.T) {
+	share := testShare(5, "98765432109876543210")
+	sess, err := NewSession(share.Document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sess.Request.Seal(share)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other session (with the id of the original session)
+	other, err := NewSession(share.Document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Open(resp); err == nil || !strings.Contains(err.Error(), "different session") {
+		t.Fatalf("response opened in other session (%v)", err)
+	}
+	other.Session = sess.Session
+	if _, err = other.Open(resp); err == nil || !strings.Contains(err.Error(), "can't open") {
+		t.Fatalf("response opened with wrong key (%v)", err)
+	}
+
+	// closed session
+	closed, err := ParseSession(recordData(t, sess))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if _, err = closed.Open(resp); err == nil {
+		t.Fatal("response opened by closed session")
+	}
+
+	// modified responses
+	mod := *resp
+	mod.Sealed = append([]byte{}, resp.Sealed...)
+	mod.Sealed[len(mod.Sealed)/2] ^= 1
+	if _, err = sess.Open(&mod); err == nil {
+		t.Fatal("modified share opened")
+	}
+	mod = *resp
+	mod.Document = "fedcba9876543210"
+	if _, err = sess.Open(&mod); err == nil {
+		t.Fatal("response for other document opened")
+	}
+	mod = *resp
+	mod.Nonce = new([24]byte)
+	if _, err = sess.Open(&mod); err == nil {
+		t.Fatal("response with wrong nonce opened")
+	}
+	if _, err = sess.Open(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// shares of other documents are not sealed
+	share.Document = "fedcba9876543210"
+	if _, err = sess.Request.Seal(share); err == nil {
+		t.Fatal("share of other document sealed")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Damaged and incomplete exchange records are rejected.
+ */
+func TestExchangeRecords(t *testing.T) {
+	sess, err := NewSession("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := sess.Request.Seal(testShare(1, "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := string(recordData(t, &sess.Request))
+	rsp := string(recordData(t, resp))
+	key := strings.Split(strings.Split(req, "key=")[1], "\n")[0]
+	for _, data := range []string{
+		strings.Replace(req, "document=0", "document=1", 1),
+		strings.Replace(req, "key="+key, "key="+key[:62], 1),
+		strings.Replace(req, "SID-REQUEST", "SID-RESPONSE", 1),
+		req[:strings.Index(req, "checksum=")],
+		rsp,
+	} {
+		if _, err = ParseRequest([]byte(data)); err == nil {
+			t.Fatalf("invalid request accepted:\n%s", data)
+		}
+	}
+	r := &Request{Document: "0123456789abcdef", Key: sess.Key}
+	if _, err = ParseRequest(recordData(t, r)); err == nil {
+		t.Fatal("request without session id accepted")
+	}
+	for _, data := range []string{
+		strings.Replace(rsp, "session=", "session=0", 1),
+		strings.Replace(rsp, "SID-RESPONSE", "SID-REQUEST", 1),
+		req,
+	} {
+		if _, err = ParseResponse([]byte(data)); err == nil {
+			t.Fatalf("invalid response accepted:\n%s", data)
+		}
+	}
+	if _, err = ParseSession([]byte(req)); err == nil {
+		t.Fatal("request accepted as session")
+	}
+}
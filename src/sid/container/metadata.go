@@ -0,0 +1,129 @@
+/*
+ * Document metadata: Information about an uploaded document (original
+ * file name, content type, size, hash value, time of upload and the
+ * additional form fields sent with the document). The metadata record
+ * is stored next to the document and encrypted with the same key.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package container
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// version of metadata record
+	META_VERSION = 2
+	// format of upload date (day only: the exact time of an upload
+	// could help to identify the source of a document)
+	META_DATE_FORMAT = "2006-01-02"
+)
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Metadata of an uploaded document.
+ */
+type Metadata struct {
+	Version     int               `json:"version"`          // version of record
+	FileName    string            `json:"filename"`         // original file name
+	ContentType string            `json:"content_type"`     // MIME type of document
+	Size        int64             `json:"size"`             // size of document
+	SHA256      string            `json:"sha256"`           // hash value of document (hex)
+	Date        string            `json:"date,omitempty"`   // day of upload (UTC)
+	Fields      map[string]string `json:"fields,omitempty"` // additional form fields
+}
+
+//---------------------------------------------------------------------
+/*
+ * Set the day of upload: only the date (in UTC) is recorded, the time
+ * of day is dropped (see META_DATE_FORMAT).
+ * @param t time.Time - time of upload
+ */
+func (m *Metadata) SetDate(t time.Time) {
+	m.Date = t.UTC().Format(META_DATE_FORMAT)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write metadata record.
+ * @param wrt io.Writer - output of record
+ * @return error - error object (or nil)
+ */
+func (m *Metadata) Write(wrt io.Writer) error {
+	m.Version = META_VERSION
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = wrt.Write(append(data, '\n'))
+	return err
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read metadata record.
+ * @param rdr io.Reader - input of record
+ * @return *Metadata - metadata of document
+ * @return error - error object (or nil)
+ */
+func ReadMetadata(rdr io.Reader) (*Metadata, error) {
+	m := new(Metadata)
+	if err := json.NewDecoder(rdr).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Version > META_VERSION {
+		return nil, fmt.Errorf("container: unsupported metadata version %d", m.Version)
+	}
+	return m, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get printable listing of metadata.
+ * @return []string - list of lines
+ */
+func (m *Metadata) Listing() []string {
+	list := []string{
+		"File name:    " + m.FileName,
+		"Content type: " + m.ContentType,
+		fmt.Sprintf("Size:         %d bytes", m.Size),
+		"SHA-256:      " + m.SHA256,
+	}
+	if len(m.Date) > 0 {
+		list = append(list, "Uploaded:     "+m.Date)
+	}
+	names := make([]string, 0, len(m.Fields))
+	for name := range m.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list = append(list, fmt.Sprintf("Field '%s': %s", name, m.Fields[name]))
+	}
+	return list
+}
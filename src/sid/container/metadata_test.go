@@ -0,0 +1,72 @@
+/*
+ * Metadata of uploaded documents: record tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package container
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Metadata records only contain the day of upload (not the time).
+ */
+func TestMetadataDate(t *testing.T) {
+	m := &Metadata{
+		FileName: "report.pdf",
+		Size:     1234,
+		Fields:   map[string]string{"contact": "nobody"},
+	}
+	loc := time.FixedZone("UTC+2", 2*3600)
+	m.SetDate(time.Date(2013, 5, 24, 1, 37, 12, 0, loc))
+
+	buf := new(bytes.Buffer)
+	if err := m.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"01:37", "23:37", "started", "completed"} {
+		if strings.Contains(buf.String(), s) {
+			t.Fatalf("time of upload in record:\n%s", buf.String())
+		}
+	}
+	mm, err := ReadMetadata(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm.Date != "2013-05-23" || mm.FileName != m.FileName || mm.Fields["contact"] != "nobody" {
+		t.Fatalf("metadata mismatch: %v", mm)
+	}
+
+	// records of older versions are readable
+	old := `{"version":1,"filename":"a.txt","started":"2013-05-24T01:37:12Z","completed":"2013-05-24T01:38:00Z"}`
+	if mm, err = ReadMetadata(strings.NewReader(old)); err != nil || mm.FileName != "a.txt" {
+		t.Fatal("metadata version 1 not readable")
+	}
+	if _, err = ReadMetadata(strings.NewReader(`{"version":99}`)); err == nil {
+		t.Fatal("unsupported metadata version accepted")
+	}
+}
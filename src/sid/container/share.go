@@ -0,0 +1,300 @@
+/*
+ * Share records: a share of a document key (secret sharing scheme) as
+ * it is encrypted for a reviewer, and the key commitment that allows
+ * to verify a recovered document key.
+ *
+ * Share record format (version 1):
+ *
+ *	SID-SHARE 1
+ *	document=<document id>
+ *	p=<prime (decimal)>
+ *	x=<x coordinate (decimal)>
+ *	y=<y coordinate (decimal)>
+ *	checksum=<hex>
+ *
+ * The checksum is the first 8 bytes of the SHA-256 hash value of all
+ * preceding lines. Shares in the legacy format are three lines with
+ * the prime, x and y (decimal) and have neither document id nor
+ * checksum.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package container
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	SHARE_MAGIC   = "SID-SHARE" // first word of a share record
+	SHARE_VERSION = 1           // current version of share records
+
+	checksumSize = 8  // size of record checksum (bytes)
+	primeRounds  = 32 // rounds of probable-prime test
+)
+
+// label for key commitments
+const commitLabel = "SID document key commitment\x00"
+
+// error for damaged records
+var ErrChecksum = errors.New("container: checksum mismatch (record damaged)")
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Share of a document key.
+ */
+type Share struct {
+	Version  int      // version of share record (0: legacy)
+	Document string   // document id ("": unknown)
+	P        *big.Int // prime of the underlying field
+	X, Y     *big.Int // coordinates of share
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write share record.
+ * @param wrt io.Writer - output of record
+ * @return error - error object (or nil)
+ */
+func (s *Share) Write(wrt io.Writer) error {
+	return writeRecord(wrt, SHARE_MAGIC, SHARE_VERSION, []string{
+		"document", s.Document,
+		"p", s.P.String(),
+		"x", s.X.String(),
+		"y", s.Y.String(),
+	})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse share record (current or legacy format).
+ * @param data []byte - share record
+ * @return *Share - share of document key
+ * @return error - error object (or nil)
+ */
+func ParseShare(data []byte) (*Share, error) {
+	// legacy format: prime, x and y
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte(SHARE_MAGIC)) {
+		lines := strings.Fields(string(data))
+		if len(lines) != 3 {
+			return nil, errors.New("container: invalid share format")
+		}
+		s := &Share{Version: 0}
+		var err error
+		if s.P, err = parseNumber("p", lines[0]); err != nil {
+			return nil, err
+		}
+		if s.X, err = parseNumber("x", lines[1]); err != nil {
+			return nil, err
+		}
+		if s.Y, err = parseNumber("y", lines[2]); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	// versioned share record
+	version, fields, err := parseRecord(data, SHARE_MAGIC, SHARE_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	s := &Share{Version: version, Document: fields["document"]}
+	if len(s.Document) == 0 {
+		return nil, errors.New("container: missing document id in share")
+	}
+	if s.P, err = parseNumber("p", fields["p"]); err != nil {
+		return nil, err
+	}
+	if s.X, err = parseNumber("x", fields["x"]); err != nil {
+		return nil, err
+	}
+	if s.Y, err = parseNumber("y", fields["y"]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check share for consistency (prime modulus, coordinates in the field).
+ * @return error - error object (or nil)
+ */
+func (s *Share) Check() error {
+	if s.P.Cmp(big.NewInt(2)) < 0 || !s.P.ProbablyPrime(primeRounds) {
+		return errors.New("container: modulus of share is not prime")
+	}
+	if s.X.Sign() <= 0 || s.X.Cmp(s.P) >= 0 {
+		return errors.New("container: x coordinate of share out of range")
+	}
+	if s.Y.Sign() < 0 || s.Y.Cmp(s.P) >= 0 {
+		return errors.New("container: y coordinate of share out of range")
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Compute the commitment to a document key: the commitment is stored
+ * with the document and allows to verify a recovered key without
+ * revealing anything about the key.
+ * @param id string - document id
+ * @param key []byte - document key
+ * @return string - key commitment (hex)
+ */
+func KeyCommitment(id string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(commitLabel + id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//---------------------------------------------------------------------
+/*
+ * Verify a document key against its commitment.
+ * @param id string - document id
+ * @param key []byte - document key
+ * @param commitment string - key commitment (hex)
+ * @return bool - key matches commitment?
+ */
+func VerifyKey(id string, key []byte, commitment string) bool {
+	return hmac.Equal([]byte(strings.ToLower(strings.TrimSpace(commitment))), []byte(KeyCommitment(id, key)))
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Write a record: a header line (magic and version) is followed by
+ * lines with key/value pairs and the checksum of the record.
+ * @param wrt io.Writer - output of record
+ * @param magic string - type of record
+ * @param version int - version of record
+ * @param fields []string - list of keys and values
+ * @return error - error object (or nil)
+ */
+func writeRecord(wrt io.Writer, magic string, version int, fields []string) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s %d\n", magic, version)
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(buf, "%s=%s\n", fields[i], fields[i+1])
+	}
+	fmt.Fprintf(buf, "checksum=%s\n", recordChecksum(buf.Bytes()))
+	_, err := wrt.Write(buf.Bytes())
+	return err
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse a record and verify its checksum.
+ * @param data []byte - record
+ * @param magic string - expected type of record
+ * @param maxVersion int - max. supported version of record
+ * @return int - version of record
+ * @return map[string]string - key/value pairs of record
+ * @return error - error object (or nil)
+ */
+func parseRecord(data []byte, magic string, maxVersion int) (int, map[string]string, error) {
+	lines := make([]string, 0, 8)
+	rdr := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := rdr.ReadString('\n')
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], magic+" ") {
+		return 0, nil, fmt.Errorf("container: not a %s record", magic)
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(lines[0], magic)))
+	if err != nil || version < 1 {
+		return 0, nil, fmt.Errorf("container: invalid %s header", magic)
+	}
+	if version > maxVersion {
+		return 0, nil, fmt.Errorf("container: unsupported %s version %d", magic, version)
+	}
+	fields := make(map[string]string)
+	body := lines[0] + "\n"
+	checksum := ""
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return 0, nil, fmt.Errorf("container: invalid line '%s' in %s record", line, magic)
+		}
+		if kv[0] == "checksum" {
+			checksum = kv[1]
+			break
+		}
+		fields[kv[0]] = kv[1]
+		body += line + "\n"
+	}
+	if len(checksum) == 0 {
+		return 0, nil, fmt.Errorf("container: missing checksum in %s record", magic)
+	}
+	if !hmac.Equal([]byte(checksum), []byte(recordChecksum([]byte(body)))) {
+		return 0, nil, ErrChecksum
+	}
+	return version, fields, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Compute checksum of a record.
+ * @param data []byte - record (without checksum line)
+ * @return string - checksum (hex)
+ */
+func recordChecksum(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:checksumSize])
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse a decimal number of a share.
+ * @param name string - name of value
+ * @param val string - decimal representation
+ * @return *big.Int - value
+ * @return error - error object (or nil)
+ */
+func parseNumber(name, val string) (*big.Int, error) {
+	if len(val) == 0 {
+		return nil, fmt.Errorf("container: missing value '%s' in share", name)
+	}
+	n, ok := new(big.Int).SetString(val, 10)
+	if !ok {
+		return nil, fmt.Errorf("container: invalid value '%s' in share", name)
+	}
+	return n, nil
+}
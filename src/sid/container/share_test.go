@@ -0,0 +1,213 @@
+/*
+ * Share records: parsing, validation and key commitment tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package container
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Create a share (in the field of the prime 2^127-1).
+ * @param x int64 - x coordinate
+ * @param y string - y coordinate (decimal)
+ * @return *Share - new share
+ */
+func testShare(x int64, y string) *Share {
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1))
+	v, _ := new(big.Int).SetString(y, 10)
+	return &Share{
+		Version:  SHARE_VERSION,
+		Document: "0123456789abcdef",
+		P:        p,
+		X:        big.NewInt(x),
+		Y:        v,
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get share record as string.
+ * @param t *testing.T - test instance
+ * @param s *Share - share
+ * @return string - share record
+ */
+func shareRecord(t *testing.T, s *Share) string {
+	buf := new(bytes.Buffer)
+	if err := s.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Share records are parsed in the current and the legacy format.
+ */
+func TestParseShare(t *testing.T) {
+	s := testShare(3, "123456789012345678901234567890")
+	rec := shareRecord(t, s)
+	if !strings.HasPrefix(rec, "SID-SHARE 1\ndocument=0123456789abcdef\np=170141183460469231731687303715884105727\n") {
+		t.Fatalf("wrong share record:\n%s", rec)
+	}
+	for _, data := range []string{rec, "\n" + rec + "\n", strings.Replace(rec, "\n", "\r\n", -1)} {
+		ss, err := ParseShare([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ss.Version != 1 || ss.Document != s.Document || ss.P.Cmp(s.P) != 0 || ss.X.Cmp(s.X) != 0 || ss.Y.Cmp(s.Y) != 0 {
+			t.Fatalf("wrong share %v", ss)
+		}
+	}
+
+	// legacy format
+	ss, err := ParseShare([]byte("170141183460469231731687303715884105727\n3\n123456789012345678901234567890\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.Version != 0 || len(ss.Document) != 0 || ss.P.Cmp(s.P) != 0 || ss.X.Int64() != 3 || ss.Y.Cmp(s.Y) != 0 {
+		t.Fatalf("wrong legacy share %v", ss)
+	}
+	for _, data := range []string{
+		"170141183460469231731687303715884105727\n3\n",
+		"170141183460469231731687303715884105727\n3\n12\n13\n",
+		"170141183460469231731687303715884105727\nthree\n12\n",
+		"",
+	} {
+		if _, err = ParseShare([]byte(data)); err == nil {
+			t.Fatalf("invalid legacy share '%s' accepted", data)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Damaged, incomplete and unsupported share records are rejected.
+ */
+func TestParseShareInvalid(t *testing.T) {
+	rec := shareRecord(t, testShare(3, "42"))
+
+	// damaged record: checksum mismatch
+	for _, data := range []string{
+		strings.Replace(rec, "x=3", "x=4", 1),
+		strings.Replace(rec, "y=42", "y=43", 1),
+		strings.Replace(rec, "document=0123456789abcdef", "document=0123456789abcdee", 1),
+		rec[:len(rec)-2] + "0\n",
+	} {
+		if _, err := ParseShare([]byte(data)); err != ErrChecksum {
+			t.Fatalf("damaged record accepted (%v):\n%s", err, data)
+		}
+	}
+
+	// missing document id (with a valid checksum)
+	s := testShare(3, "42")
+	s.Document = ""
+	if _, err := ParseShare([]byte(shareRecord(t, s))); err == nil || !strings.Contains(err.Error(), "document id") {
+		t.Fatalf("share without document id accepted (%v)", err)
+	}
+
+	// other invalid records
+	pos := strings.Index(rec, "checksum=")
+	for _, data := range []string{
+		rec[:pos],
+		strings.Replace(rec, "SID-SHARE 1", "SID-SHARE 2", 1),
+		strings.Replace(rec, "SID-SHARE 1", "SID-SHARE x", 1),
+		strings.Replace(rec, "x=3", "x 3", 1),
+	} {
+		if _, err := ParseShare([]byte(data)); err == nil {
+			t.Fatalf("invalid record accepted:\n%s", data)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Shares must be points in the field of a prime modulus.
+ */
+func TestShareCheck(t *testing.T) {
+	if err := testShare(1, "0").Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testShare(2, "170141183460469231731687303715884105726").Check(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		s   *Share
+		err string
+	}{
+		{&Share{P: big.NewInt(15), X: big.NewInt(1), Y: big.NewInt(2)}, "not prime"},
+		{&Share{P: big.NewInt(1), X: big.NewInt(1), Y: big.NewInt(0)}, "not prime"},
+		{&Share{P: big.NewInt(-7), X: big.NewInt(1), Y: big.NewInt(2)}, "not prime"},
+		{testShare(0, "42"), "x coordinate"},
+		{testShare(-1, "42"), "x coordinate"},
+		{&Share{P: big.NewInt(13), X: big.NewInt(13), Y: big.NewInt(2)}, "x coordinate"},
+		{testShare(1, "-1"), "y coordinate"},
+		{testShare(1, "170141183460469231731687303715884105727"), "y coordinate"},
+		{&Share{P: big.NewInt(13), X: big.NewInt(12), Y: big.NewInt(14)}, "y coordinate"},
+	} {
+		if err := tc.s.Check(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("share (%v,%v,%v): error '%v' (expected '%s')", tc.s.P, tc.s.X, tc.s.Y, err, tc.err)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Key commitments verify the document key for a given document only.
+ */
+func TestKeyCommitment(t *testing.T) {
+	key := randomData(32)
+	c := KeyCommitment("0123456789abcdef", key)
+	if len(c) != 64 || c != KeyCommitment("0123456789abcdef", key) {
+		t.Fatalf("wrong commitment '%s'", c)
+	}
+	for _, s := range []string{c, strings.ToUpper(c), " " + c + "\n"} {
+		if !VerifyKey("0123456789abcdef", key, s) {
+			t.Fatalf("commitment '%s' not verified", s)
+		}
+	}
+	other := append([]byte{}, key...)
+	other[31] ^= 1
+	for _, tc := range []struct {
+		id  string
+		key []byte
+		c   string
+	}{
+		{"0123456789abcdef", other, c},
+		{"0123456789abcdee", key, c},
+		{"0123456789abcdef", key, c[:63]},
+		{"0123456789abcdef", key, ""},
+		{"", key, c},
+	} {
+		if VerifyKey(tc.id, tc.key, tc.c) {
+			t.Fatalf("wrong key/document verified ('%s')", tc.id)
+		}
+	}
+}
@@ -26,34 +26,141 @@ package sid
 
 import (
 	"bufio"
+	"errors"
 	"github.com/bfix/gospel/logger"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// max. length of a command line
+	MAX_CMD_SIZE = 1024
+)
+
+//---------------------------------------------------------------------
+/*
+ * Error for command lines exceeding MAX_CMD_SIZE.
+ */
+var ErrCmdSize = errors.New("command line too long")
+
 ///////////////////////////////////////////////////////////////////////
 // Control service instance
 
+/*
+ * Control service: Control sessions use a line-based command protocol
+ * that can be used by scripts; the old interactive menu is available
+ * with the "MENU" command.
+ */
 type ControlSrv struct {
-	Ch chan bool // channel to invoker
+	Ch      chan bool  // channel to invoker (closed on termination)
+	pool    *CoverPool // pool of cover servers
+	started time.Time  // start time of service
+	once    sync.Once  // signal termination only once
+
+	lock    sync.Mutex        // lock for list of sessions
+	clients map[net.Conn]bool // connections of active sessions
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new control service instance.
+ * @param ch chan bool - channel to invoker (closed to signal termination)
+ * @param pool *CoverPool - pool of cover servers
+ * @return *ControlSrv - new control service instance
+ */
+func NewControlSrv(ch chan bool, pool *CoverPool) *ControlSrv {
+	return &ControlSrv{
+		Ch:      ch,
+		pool:    pool,
+		started: time.Now(),
+		clients: make(map[net.Conn]bool),
+	}
 }
 
 ///////////////////////////////////////////////////////////////////////
 // ControlService methods (implements Service interface)
 
 /*
- * Handle client connection.
+ * Handle client connection: Every command line is answered with a
+ * reply (see 'ctrlReply' for the reply formats).
  * @param client net.Conn - connection to client
  */
 func (c *ControlSrv) Process(client net.Conn) {
+	c.lock.Lock()
+	c.clients[client] = true
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.clients, client)
+		c.lock.Unlock()
+	}()
 
 	b := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
-	for repeat := true; repeat; {
+	sess := &ctrlSession{
+		rw:   b,
+		json: false,
+		quit: false,
+	}
+	for !sess.quit {
+		// get next command line
+		line, err := readCmd(b)
+		if err != nil {
+			if err == ErrCmdSize {
+				logger.Println(logger.WARN, "[sid.ctrl] Command line too long -- session terminated")
+				ctrlError(err.Error()).write(b, sess.json)
+				b.Flush()
+			}
+			break
+		}
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		args := strings.Fields(line)
+		name := strings.ToUpper(args[0])
+		logger.Println(logger.INFO, "[sid.ctrl] command '"+line+"'")
 
+		// execute command
+		cmd, ok := ctrlCommands[name]
+		var reply *ctrlReply
+		switch {
+		case !ok:
+			reply = ctrlError("unknown command '" + args[0] + "'")
+		case len(args)-1 < cmd.MinArgs || len(args)-1 > cmd.MaxArgs:
+			reply = ctrlError("usage: " + cmd.Usage)
+		default:
+			reply = cmd.Handler(c, sess, args[1:])
+		}
+		if reply != nil {
+			reply.write(b, sess.json)
+			b.Flush()
+		}
+		// deferred actions (after reply has been sent)
+		if sess.action != nil {
+			sess.action()
+			sess.action = nil
+		}
+	}
+	client.Close()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Interactive control menu.
+ * @param b *bufio.ReadWriter - connection to client
+ * @return bool - end control session?
+ */
+func (c *ControlSrv) menu(b *bufio.ReadWriter) bool {
+	for {
 		// show control menu
 		b.WriteString("\n-----------------------------------\n")
 		b.WriteString("Change (L)og level [" + logger.GetLogLevel() + "]\n")
 		b.WriteString("(T)erminate application\n")
+		b.WriteString("(C)ommand mode\n")
 		b.WriteString("e(X)it\n")
 		b.WriteString("-----------------------------------\n")
 		b.WriteString("Enter command: ")
@@ -62,11 +169,11 @@ func (c *ControlSrv) Process(client net.Conn) {
 		// get command input
 		cmd, err := readCmd(b)
 		if err != nil {
-			break
+			return true
 		}
 
 		// handle command
-		logger.Println(logger.INFO, "[sid.ctrl] command '"+cmd+"'")
+		logger.Println(logger.INFO, "[sid.ctrl] menu command '"+cmd+"'")
 		switch cmd {
 		//-------------------------------------------------
 		// Terminate application
@@ -79,7 +186,8 @@ func (c *ControlSrv) Process(client net.Conn) {
 				logger.Println(logger.WARN, "[sid.ctrl] Terminating application")
 				b.WriteString("Terminating application...")
 				b.Flush()
-				c.Ch <- true
+				c.terminate()
+				return true
 			} else {
 				logger.Println(logger.WARN, "[sid.ctrl] Response '"+cmd+"' -- Termination aborted!")
 				b.WriteString("Wrong response -- Termination aborted!")
@@ -90,16 +198,22 @@ func (c *ControlSrv) Process(client net.Conn) {
 		// Change logging level
 		//-------------------------------------------------
 		case "L":
-			b.WriteString("Enter new log level (ERROR,WARN,INFO,DBG_HIGH,DBG,DBG_ALL): ")
+			b.WriteString("Enter new log level (" + strings.Join(logLevels, ",") + "): ")
 			b.Flush()
 			cmd, _ = readCmd(b)
 			logger.SetLogLevelFromName(cmd)
 
+		//-------------------------------------------------
+		//	Back to command mode
+		//-------------------------------------------------
+		case "C":
+			return false
+
 		//-------------------------------------------------
 		//	Quit control session
 		//-------------------------------------------------
 		case "X":
-			repeat = false
+			return true
 
 		//-------------------------------------------------
 		//	Unknown command
@@ -108,7 +222,6 @@ func (c *ControlSrv) Process(client net.Conn) {
 			b.WriteString("Unkonwn command '" + cmd + "'\n")
 		}
 	}
-	client.Close()
 }
 
 //---------------------------------------------------------------------
@@ -127,18 +240,12 @@ func (c *ControlSrv) CanHandle(protocol string) bool {
 
 //---------------------------------------------------------------------
 /*
- * Check for local connection.
+ * Check for allowed (usually local) connection.
  * @param add string - remote address
- * @return bool - local address?
+ * @return bool - allowed address?
  */
 func (c *ControlSrv) IsAllowed(addr string) bool {
-	idx := strings.Index(addr, ":")
-	ip := addr[:idx]
-	if strings.Index(CfgData.CtrlAllow, ip) == -1 {
-		logger.Println(logger.WARN, "[sid.ctrl] Unsupported remote address '"+addr+"'")
-		return false
-	}
-	return true
+	return GetConfig().CtrlACL().IsAllowed(addr)
 }
 
 //---------------------------------------------------------------------
@@ -153,6 +260,31 @@ func (c *ControlSrv) GetName() string {
 ///////////////////////////////////////////////////////////////////////
 // Private helper methods
 
+/*
+ * Signal termination to the invoker: the channel is closed (once), so
+ * repeated termination requests never block.
+ */
+func (c *ControlSrv) terminate() {
+	c.once.Do(func() {
+		close(c.Ch)
+	})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Terminate active control sessions (on shutdown): the connections are
+ * closed, so the sessions end with the next read or write.
+ */
+func (c *ControlSrv) closeSessions() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for client := range c.clients {
+		logger.Printf(logger.WARN, "[sid.ctrl] Terminating control session (client '%s')\n", client.RemoteAddr().String())
+		client.Close()
+	}
+}
+
+//---------------------------------------------------------------------
 /*
  * Read command/input from connection.
  * @param b *bufioReadWriter - reader
@@ -160,10 +292,33 @@ func (c *ControlSrv) GetName() string {
  * @return err error - error state
  */
 func readCmd(b *bufio.ReadWriter) (cmd string, err error) {
-	line, err := b.ReadBytes('\n')
+	line, err := readLine(b, MAX_CMD_SIZE)
 	if err != nil {
 		return "", err
 	}
 	// get rid of enclosing white spaces
 	return strings.Trim(string(line), " \t\n\v\r"), nil
 }
+
+//---------------------------------------------------------------------
+/*
+ * Read a line of limited length from connection (the line is not read
+ * completely into memory if it exceeds the limit).
+ * @param b *bufio.ReadWriter - reader
+ * @param max int - max. length of line (including line break)
+ * @return []byte - line
+ * @return error - error object (ErrCmdSize if line is too long)
+ */
+func readLine(b *bufio.ReadWriter, max int) ([]byte, error) {
+	line := make([]byte, 0)
+	for {
+		frag, err := b.ReadSlice('\n')
+		if len(line)+len(frag) > max {
+			return nil, ErrCmdSize
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
@@ -0,0 +1,355 @@
+/*
+ * Control service: termination tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/bfix/gospel/logger"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Run a control session with given commands.
+ * @param c *ControlSrv - control service
+ * @param cmds string - command lines
+ * @return bool - session ended in time?
+ */
+func runControlSession(c *ControlSrv, cmds string) bool {
+	client, srv := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		c.Process(srv)
+		srv.Close()
+		close(done)
+	}()
+	go func() {
+		client.Write([]byte(cmds))
+	}()
+	go ioutil.ReadAll(bufio.NewReader(client))
+	select {
+	case <-done:
+		return true
+	case <-time.After(2 * time.Second):
+		return false
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Run a control session with given commands and collect the replies.
+ * @param t *testing.T - test instance
+ * @param c *ControlSrv - control service
+ * @param cmds string - command lines
+ * @return string - replies of control service
+ */
+func controlReplies(t *testing.T, c *ControlSrv, cmds string) string {
+	client, srv := net.Pipe()
+	defer client.Close()
+	go func() {
+		c.Process(srv)
+		srv.Close()
+	}()
+	go func() {
+		client.Write([]byte(cmds))
+	}()
+	out := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(client)
+		out <- data
+	}()
+	select {
+	case data := <-out:
+		return string(data)
+	case <-time.After(2 * time.Second):
+		t.Fatal("control session blocked")
+	}
+	return ""
+}
+
+//---------------------------------------------------------------------
+/*
+ * Decode JSON replies (one per line).
+ * @param t *testing.T - test instance
+ * @param out string - replies of control service
+ * @return []map[string]interface{} - list of decoded replies
+ */
+func jsonReplies(t *testing.T, out string) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+		r := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid JSON reply '%s': %s", line, err.Error())
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Repeated termination requests don't block (even if nobody waits for
+ * the termination signal anymore).
+ */
+func TestControlShutdownTwice(t *testing.T) {
+	ch := make(chan bool)
+	c := NewControlSrv(ch, NewCoverPool(nil))
+	if !runControlSession(c, "SHUTDOWN\n") {
+		t.Fatal("first SHUTDOWN blocked")
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatal("termination not signalled")
+	}
+	if !runControlSession(c, "SHUTDOWN\n") {
+		t.Fatal("second SHUTDOWN blocked")
+	}
+	if !runControlSession(c, "MENU\nT\nYES\nX\n") {
+		t.Fatal("termination from menu blocked")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Replies in key=value format: status line, values (quoted if required),
+ * records and the terminating line.
+ */
+func TestControlRepliesKV(t *testing.T) {
+	c := NewControlSrv(make(chan bool), NewCoverPool(nil))
+	out := controlReplies(t, c, "\n# comment\nloglevel\nFOO bar\nKILL\nKILL abc\nFORMAT XML\nHELP\nquit\nSTATUS\n")
+	expect := []string{
+		"OK\nloglevel=" + logger.GetLogLevel() + "\n.\n",
+		"ERR unknown command 'FOO'\n.\n",
+		"ERR usage: KILL <id>\n.\n",
+		"ERR invalid session id 'abc'\n.\n",
+		"ERR unknown format 'XML'\n.\n",
+		"OK\n",
+		"command=\"FORMAT KV|JSON\" help=\"select reply format\"\n",
+		"command=\"KILL <id>\" help=\"terminate an active session\"\n",
+		"command=QUIT help=\"end control session\"\n",
+		".\nOK bye\n.\n",
+	}
+	pos := 0
+	for _, e := range expect {
+		i := strings.Index(out[pos:], e)
+		if i == -1 {
+			t.Fatalf("reply '%s' missing in\n%s", e, out[pos:])
+		}
+		pos += i + len(e)
+	}
+	// no commands after QUIT
+	if pos != len(out) {
+		t.Fatalf("unexpected replies:\n%s", out[pos:])
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Replies in JSON format: one JSON object per reply.
+ */
+func TestControlRepliesJSON(t *testing.T) {
+	c := NewControlSrv(make(chan bool), NewCoverPool(nil))
+	out := controlReplies(t, c, "FORMAT json\nSTATUS\nFOO\nHELP\nFORMAT KV\nQUIT\n")
+	lines := strings.SplitN(out, "\n", 5)
+	if lines[0] != `{"status":"OK","data":{"format":"JSON"}}` {
+		t.Fatalf("wrong reply '%s'", lines[0])
+	}
+	list := jsonReplies(t, strings.Join(lines[:4], "\n"))
+	status := list[1]["data"].(map[string]interface{})
+	if list[1]["status"] != "OK" || status["version"] != SID_VERSION || status["covers"] != 0.0 || status["sessions"] != 0.0 {
+		t.Fatalf("wrong STATUS reply: %v", list[1])
+	}
+	if list[2]["status"] != "ERR" || list[2]["message"] != "unknown command 'FOO'" {
+		t.Fatalf("wrong error reply: %v", list[2])
+	}
+	items := list[3]["items"].([]interface{})
+	if len(items) != len(ctrlCommands) {
+		t.Fatalf("%d commands listed", len(items))
+	}
+	for _, item := range items {
+		rec := item.(map[string]interface{})
+		if cmd, ok := ctrlCommands[strings.Fields(rec["command"].(string))[0]]; !ok || cmd.Help != rec["help"] {
+			t.Fatalf("wrong HELP record: %v", rec)
+		}
+	}
+	// back to key=value format
+	if lines[4] != "OK\nformat=KV\n.\nOK bye\n.\n" {
+		t.Fatalf("wrong replies:\n%s", lines[4])
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Command lines are limited in length: a longer line terminates the
+ * session with an error reply.
+ */
+func TestControlLineSize(t *testing.T) {
+	c := NewControlSrv(make(chan bool), NewCoverPool(nil))
+	// longest possible line
+	out := controlReplies(t, c, "#"+strings.Repeat("x", MAX_CMD_SIZE-2)+"\nQUIT\n")
+	if out != "OK bye\n.\n" {
+		t.Fatalf("wrong replies:\n%s", out)
+	}
+	// line too long
+	out = controlReplies(t, c, "FORMAT JSON\n"+strings.Repeat("x", MAX_CMD_SIZE+1)+"\nQUIT\n")
+	if out != `{"status":"OK","data":{"format":"JSON"}}`+"\n"+`{"status":"ERR","message":"command line too long"}`+"\n" {
+		t.Fatalf("wrong replies:\n%s", out)
+	}
+	// endless line
+	client, srv := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		c.Process(srv)
+		srv.Close()
+		close(done)
+	}()
+	go ioutil.ReadAll(client)
+	buf := []byte(strings.Repeat("x", 4096))
+	for i := 0; ; i++ {
+		client.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		if _, err := client.Write(buf); err != nil {
+			break
+		}
+		if i > MAX_CMD_SIZE/len(buf)+1 {
+			t.Fatal("endless command line accepted")
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("control session not terminated")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Active sessions are listed (in both reply formats) and can be killed.
+ */
+func TestControlSessions(t *testing.T) {
+	ln, port := startDummyCover(t)
+	defer ln.Close()
+	cover := NewCover("127.0.0.1", port, "http")
+	pool := NewCoverPool(nil)
+	pool.Add(cover, 1)
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+	conn := cover.connect(client)
+	if conn == nil {
+		t.Fatal("can't connect to cover server")
+	}
+	defer cover.disconnect(conn)
+	s := cover.GetState(conn)
+	s.ReqMode = REQ_GET
+	s.ReqResource = "/index.html"
+	s.BytesIn = 123
+	id := strconv.FormatUint(s.Id, 10)
+	name := "http://127.0.0.1:" + strconv.Itoa(port)
+
+	c := NewControlSrv(make(chan bool), pool)
+	out := controlReplies(t, c, "SESSIONS\nQUIT\n")
+	lines := strings.Split(out, "\n")
+	if len(lines) != 7 || lines[0] != "OK" || lines[1] != "total=1" || lines[3] != "." {
+		t.Fatalf("wrong SESSIONS reply:\n%s", out)
+	}
+	prefix := "id=" + id + " cover=" + name + " " + kvValue(ctrlField{"client", s.Client}) + " age="
+	suffix := " mode=GET resource=/index.html bytes_in=123 bytes_out=0 post_pos=0 post_size=0 upload=false uploads=0 upload_ok=false"
+	if !strings.HasPrefix(lines[2], prefix) || !strings.HasSuffix(lines[2], suffix) {
+		t.Fatalf("wrong session record '%s'", lines[2])
+	}
+
+	out = controlReplies(t, c, "FORMAT JSON\nSESSIONS\nKILL "+id+"\nKILL 0\nQUIT\n")
+	list := jsonReplies(t, out)
+	items := list[1]["items"].([]interface{})
+	if len(items) != 1 || list[1]["data"].(map[string]interface{})["total"] != 1.0 {
+		t.Fatalf("wrong SESSIONS reply: %v", list[1])
+	}
+	rec := items[0].(map[string]interface{})
+	if rec["id"] != float64(s.Id) || rec["cover"] != name || rec["mode"] != "GET" || rec["bytes_in"] != 123.0 || rec["upload"] != false {
+		t.Fatalf("wrong session record: %v", rec)
+	}
+	if list[2]["status"] != "OK" || list[2]["data"].(map[string]interface{})["id"] != float64(s.Id) {
+		t.Fatalf("wrong KILL reply: %v", list[2])
+	}
+	if !s.Killed() {
+		t.Fatal("session not killed")
+	}
+	if list[3]["status"] != "ERR" || list[3]["message"] != "unknown session 0" {
+		t.Fatalf("wrong KILL reply: %v", list[3])
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Idle control sessions are terminated on shutdown.
+ */
+func TestControlCloseSessions(t *testing.T) {
+	c := NewControlSrv(make(chan bool), NewCoverPool(nil))
+	done := make(chan bool)
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, srv := net.Pipe()
+		defer client.Close()
+		clients = append(clients, client)
+		go func() {
+			c.Process(srv)
+			done <- true
+		}()
+	}
+	for i := 0; ; i++ {
+		c.lock.Lock()
+		n := len(c.clients)
+		c.lock.Unlock()
+		if n == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("%d active control sessions", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.closeSessions()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("control session not terminated")
+		}
+	}
+	if len(c.clients) != 0 {
+		t.Fatal("terminated sessions still listed")
+	}
+}
@@ -23,13 +23,15 @@ package sid
 // Import external declarations.
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/x509"
 	"github.com/bfix/gospel/logger"
 	"github.com/bfix/gospel/network"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 ///////////////////////////////////////////////////////////////////////
@@ -50,6 +52,9 @@ const (
 	RS_HDR_COMPLETE        // parsing header completed
 	RS_CONTENT             // parsing content (POST request)
 	RS_DONE                // parsing complete
+
+	// max. size of a (non-file) form field
+	MAX_FIELD_SIZE = 4096
 )
 
 ///////////////////////////////////////////////////////////////////////
@@ -60,67 +65,153 @@ type State struct {
 	//-----------------------------------------------------------------
 	// Request state
 	//-----------------------------------------------------------------
-	ReqMode          int    // request type (GET, POST)
-	ReqState         int    // request processing (HDR,APPEND)
-	ReqResource      string // resource requested by client
-	ReqBoundaryIn    string // POST boundary separator (incoming,client)
-	ReqBoundaryOut   string // POST boundary separator (outgoing,cover)
-	ReqCoverPost     []byte // cover POST content
-	ReqCoverPostPos  int    // index into POST content
-	ReqUpload        bool   // parsing client document upload?
-	ReqUploadData    string // client document data
-	ReqUploadOK      bool   // successful upload to SID?
-	ReqContentLength int    // content length of request
+	ReqMode          int               // request type (GET, POST)
+	ReqState         int               // request processing (HDR,APPEND)
+	ReqParser        *MsgParser        // incremental request parser
+	ReqBalance       int               // balance between incoming and outgoing bytes
+	ReqMethods       []string          // methods of requests awaiting a response
+	ReqResource      string            // resource requested by client
+	ReqHost          string            // host of requested resource (cover server)
+	ReqLineDone      bool              // request line transformed?
+	ReqHdrPos        int               // number of transformed header fields
+	ReqQueue         []byte            // transformed request data (not sent yet)
+	ReqFlush         int               // queued data of complete requests (must be sent)
+	ReqReply         []byte            // interim response for client (e.g. "100 Continue")
+	ReqBoundaryIn    string            // POST boundary separator (incoming,client)
+	ReqBoundaryOut   string            // POST boundary separator (outgoing,cover)
+	ReqCoverPost     []byte            // cover POST content
+	ReqCoverPostPos  int               // index into POST content
+	ReqForm          *MultipartParser  // parser for multipart POST content
+	ReqFormFields    map[string]string // (non-file) form fields of POST content
+	ReqSink          *UploadSink       // sink for current document upload
+	ReqPending       []*UploadSink     // received document uploads (waiting for end of form)
+	ReqUpload        bool              // parsing client document upload?
+	ReqUploadCount   int               // number of document uploads in request
+	ReqUploadOK      bool              // successful upload to SID?
+	ReqContentLength int               // content length of request (-1: chunked content)
+	ReqFailed        bool              // request refused (session must end)
 
 	//-----------------------------------------------------------------
 	// Response state
 	//-----------------------------------------------------------------
-	RespPending string   // pending (HTML) response
-	RespEnc     string   // response encoding
-	RespMode    int      // response mode (0=init,1=hdr,2=body)
-	RespSize    int      // expected response size (total length)
-	RespType    string   // format identifier for response content (mime type)
-	RespHdr     *TagList // list of tags for header
-	RespTags    *TagList // list of tags to be included in response body
-	RespXtra    *TagList // list of tags with extra information (e.g. hidden input fields)
+	RespParser  *MsgParser    // incremental response parser
+	RespPending string        // pending (HTML) response
+	RespEnc     string        // response encoding
+	RespCoder   *ContentCoder // coder for compressed content
+	RespMode    int           // response mode (0=init,1=hdr,2=body,3=closing,4=closed)
+	RespSize    int           // expected response size (total length)
+	RespType    string        // format identifier for response content (mime type)
+	RespPass    bool          // pass response content unchanged?
+	RespRaw     bool          // response framing lost (pass all data unchanged)?
+	RespHdr     *TagList      // list of tags for header
+	RespTags    *TagList      // list of tags to be included in response body
+	RespXtra    *TagList      // list of tags with extra information (e.g. hidden input fields)
 
 	//-----------------------------------------------------------------
 	// Shared additional data
 	//-----------------------------------------------------------------
 	Data map[string]string // additional data
+
+	//-----------------------------------------------------------------
+	// Session information
+	//-----------------------------------------------------------------
+	Cfg      *Config          // configuration (snapshot at session start)
+	docs     *DocumentHandler // document handler (at session start)
+	Id       uint64           // session identifier
+	Client   string           // remote address of client
+	Started  time.Time        // start of session
+	BytesIn  int64            // number of bytes received from client
+	BytesOut int64            // number of bytes sent to client
+	lock     sync.Mutex       // lock for access from control sessions
+	killed   bool             // session terminated by control service?
 }
 
 ///////////////////////////////////////////////////////////////////////
 /*
- * Cover server instance (stateful)
+ * Cover server instance (stateful): the list of states and the list
+ * of POST contents are initialized on first use, so instances can
+ * also be created without NewCover.
  */
 type Cover struct {
-	Name     string              // hostname of cover server
-	Port     int                 // target port of cover server
-	Protocol string              // HTTP/HTTPS protocol spec
-	States   map[net.Conn]*State // state of active connections
-	Posts    map[string]([]byte) // list of cover POST replacements
+	Name     string          // hostname of cover server
+	Port     int             // target port of cover server
+	Protocol string          // HTTP/HTTPS protocol spec
+	States   SessionRegistry // state of active connections
+
+	ServerName string         // server name for TLS (default: hostname)
+	Pins       []string       // pinned public keys (base64 SHA-256 of SPKI)
+	RootCAs    *x509.CertPool // trusted CA certificates (nil: system pool)
+	tlsLock    sync.Mutex     // lock for certificate pins
+
+	postLock sync.Mutex          // lock for POST replacements
+	posts    map[string]([]byte) // list of cover POST replacements
 
 	HandleRequest func(*Cover, *State) (string, string) // Handle HTML request (w/ special cases)
 	SyncCover     func(*Cover, *State)                  // synchronize cover content with response HTML
 	FinalizeCover func(*Cover, *State) []byte           // Finalize cover content
+
+	OnSessionStart func(*Cover, *State) // (optional) called when a session starts
+	OnSessionEnd   func(*Cover, *State) // (optional) called when a session ends
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Create a new cover instance for given cover server. Handler functions
+ * must be assigned by the caller.
+ * @param name string - hostname of cover server
+ * @param port int - target port of cover server
+ * @param protocol string - HTTP/HTTPS protocol spec
+ * @return *Cover - new cover instance
+ */
+func NewCover(name string, port int, protocol string) *Cover {
+	return &Cover{
+		Name:     name,
+		Port:     port,
+		Protocol: protocol,
+		posts:    make(map[string]([]byte)),
+	}
 }
 
 ///////////////////////////////////////////////////////////////////////
 // Public methods for Cover instance
 
+/*
+ * Create a copy of a cover instance for a different cover server: the
+ * new instance shares the handler functions (and trusted CAs), but has
+ * its own list of states and POST contents. Registered POST contents
+ * are not copied: they are tailored to the forms of a specific cover
+ * server.
+ * @param name string - hostname of cover server
+ * @param port int - target port of cover server
+ * @param protocol string - HTTP/HTTPS protocol spec
+ * @return *Cover - new cover instance
+ */
+func (c *Cover) Clone(name string, port int, protocol string) *Cover {
+	cc := NewCover(name, port, protocol)
+	cc.HandleRequest = c.HandleRequest
+	cc.SyncCover = c.SyncCover
+	cc.FinalizeCover = c.FinalizeCover
+	cc.OnSessionStart = c.OnSessionStart
+	cc.OnSessionEnd = c.OnSessionEnd
+	cc.RootCAs = c.RootCAs
+	return cc
+}
+
+//---------------------------------------------------------------------
 /*
  * Connect to cover server
+ * @param client net.Conn - connection to client
  * @return net.Conn - connection to cover server (or nil)
  */
-func (c *Cover) connect() net.Conn {
+func (c *Cover) connect(client net.Conn) net.Conn {
 	// establish connection directly or via proxy.
 	var (
 		conn net.Conn
 		err  error
 	)
-	if CfgData.UseSocks {
-		conn, err = network.Socks5Connect("tcp", c.Name, c.Port, CfgData.SocksAddr)
+	cfg := GetConfig()
+	if cfg.UseSocks {
+		conn, err = network.Socks5Connect("tcp", c.Name, c.Port, cfg.SocksAddr)
 		if err != nil {
 			// can't connect
 			logger.Printf(logger.ERROR, "[sid.cover] failed to connect to cover server through SOCKS5 proxy: %s\n", err.Error())
@@ -137,32 +228,60 @@ func (c *Cover) connect() net.Conn {
 		}
 		logger.Println(logger.INFO, "[sid.cover] directly connected to cover server...")
 	}
+	// use TLS for HTTPS cover servers
+	if c.Protocol == "https" {
+		tc, err := c.wrapTLS(conn)
+		if err != nil {
+			logger.Printf(logger.ERROR, "[sid.cover] TLS handshake with cover server failed: %s\n", err.Error())
+			conn.Close()
+			return nil
+		}
+		conn = tc
+	}
 
 	// allocate state information and add to state list
 	// initialize struct with default data
-	c.States[conn] = &State{
+	s := &State{
 		//-------------------------------------------------------------
 		// Request state
 		//-------------------------------------------------------------
 		ReqMode:         REQ_UNKNOWN,
 		ReqState:        RS_HDR,
+		ReqParser:       NewMsgParser(),
+		ReqBalance:      0,
+		ReqMethods:      make([]string, 0),
 		ReqResource:     "",
+		ReqHost:         "",
+		ReqLineDone:     false,
+		ReqHdrPos:       0,
+		ReqQueue:        nil,
+		ReqFlush:        0,
+		ReqReply:        nil,
 		ReqBoundaryIn:   "",
 		ReqBoundaryOut:  "",
 		ReqCoverPost:    nil,
 		ReqCoverPostPos: 0,
+		ReqForm:         nil,
+		ReqFormFields:   make(map[string]string),
+		ReqSink:         nil,
+		ReqPending:      nil,
 		ReqUpload:       false,
+		ReqUploadCount:  0,
 		ReqUploadOK:     false,
-		ReqUploadData:   "",
+		ReqFailed:       false,
 
 		//-------------------------------------------------------------
 		// Response state
 		//-------------------------------------------------------------
+		RespParser:  NewMsgParser(),
 		RespPending: "",
 		RespEnc:     "",
+		RespCoder:   nil,
 		RespMode:    0,
 		RespSize:    0,
 		RespType:    "text/html",
+		RespPass:    false,
+		RespRaw:     false,
 		RespHdr:     NewTagList(),
 		RespTags:    NewTagList(),
 		RespXtra:    NewTagList(),
@@ -171,6 +290,22 @@ func (c *Cover) connect() net.Conn {
 		// Additional data
 		//-------------------------------------------------------------
 		Data: make(map[string]string),
+
+		//-------------------------------------------------------------
+		// Session information
+		//-------------------------------------------------------------
+		Cfg:      cfg,
+		docs:     GetDocumentHandler(),
+		Id:       nextSessionId(),
+		Client:   client.RemoteAddr().String(),
+		Started:  time.Now(),
+		BytesIn:  0,
+		BytesOut: 0,
+		killed:   false,
+	}
+	c.States.Add(conn, s)
+	if c.OnSessionStart != nil {
+		c.OnSessionStart(c, s)
 	}
 	return conn
 }
@@ -183,7 +318,18 @@ func (c *Cover) connect() net.Conn {
  * @param conn net.Conn - client connection
  */
 func (c *Cover) disconnect(conn net.Conn) {
-	delete(c.States, conn)
+	if s := c.States.Remove(conn); s != nil {
+		// a pending upload is incomplete, a running decoder is stopped
+		s.lock.Lock()
+		c.abortUpload(s)
+		if s.RespCoder != nil {
+			s.RespCoder.Close()
+		}
+		s.lock.Unlock()
+		if c.OnSessionEnd != nil {
+			c.OnSessionEnd(c, s)
+		}
+	}
 	conn.Close()
 }
 
@@ -194,10 +340,23 @@ func (c *Cover) disconnect(conn net.Conn) {
  * @return *state - reference to state instance
  */
 func (c *Cover) GetState(conn net.Conn) *State {
-	if s, ok := c.States[conn]; ok {
-		return s
+	return c.States.Get(conn)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Register cover site POST content for given boundary id. This method
+ * can safely be called from custom handlers while sessions are active.
+ * @param id string - boundary id (key used to store POST content)
+ * @param post []byte - POST content
+ */
+func (c *Cover) AddPostContent(id string, post []byte) {
+	c.postLock.Lock()
+	defer c.postLock.Unlock()
+	if c.posts == nil {
+		c.posts = make(map[string]([]byte))
 	}
-	return nil
+	c.posts[id] = post
 }
 
 //---------------------------------------------------------------------
@@ -207,9 +366,11 @@ func (c *Cover) GetState(conn net.Conn) *State {
  * @return []byte - POST content
  */
 func (c *Cover) GetPostContent(id string) []byte {
-	if post, ok := c.Posts[id]; ok {
+	c.postLock.Lock()
+	defer c.postLock.Unlock()
+	if post, ok := c.posts[id]; ok {
 		// delete POST from list
-		delete(c.Posts, id)
+		delete(c.posts, id)
 		return post
 	}
 	return nil
@@ -217,8 +378,62 @@ func (c *Cover) GetPostContent(id string) []byte {
 
 //---------------------------------------------------------------------
 /*
- * Transform client request: this is supposed to work on fragmented
- * requests if necessary (currently not really supported)
+ * Reset request state for the next request on a persistent connection.
+ * Unprocessed request data is kept.
+ */
+func (s *State) resetRequest() {
+	s.ReqMode = REQ_UNKNOWN
+	s.ReqState = RS_HDR
+	s.ReqParser.Reset()
+	s.ReqResource = ""
+	s.ReqHost = ""
+	s.ReqLineDone = false
+	s.ReqHdrPos = 0
+	s.ReqBoundaryIn = ""
+	s.ReqBoundaryOut = ""
+	s.ReqCoverPost = nil
+	s.ReqCoverPostPos = 0
+	s.ReqForm = nil
+	s.ReqFormFields = make(map[string]string)
+	s.ReqSink = nil
+	s.ReqPending = nil
+	s.ReqUpload = false
+	s.ReqContentLength = 0
+}
+
+//---------------------------------------------------------------------
+/*
+ * Reset response state for the next response on a persistent connection.
+ * Unprocessed response data is kept.
+ */
+func (s *State) resetResponse() {
+	s.RespParser.Reset()
+	s.RespPending = ""
+	s.RespEnc = ""
+	if s.RespCoder != nil {
+		s.RespCoder.Close()
+	}
+	s.RespCoder = nil
+	s.RespMode = 0
+	s.RespSize = 0
+	s.RespType = "text/html"
+	s.RespPass = false
+	s.RespHdr = NewTagList()
+	s.RespTags = NewTagList()
+	s.RespXtra = NewTagList()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Transform client request: the request is processed incrementally;
+ * the header is transformed line by line (it may span multiple
+ * fragments), the body of POST requests is replaced by the cover
+ * content on the fly (chunk by chunk for chunked content). The
+ * transformed request follows the size of the incoming fragments: no
+ * more data than received is sent, except for the end of a request
+ * that is always sent completely (and padded if it is shorter than the
+ * incoming request). On persistent connections a fragment can contain
+ * data of multiple requests.
  * @param s *state - reference to state information
  * @param data []byte - request data from client
  * @param num int - length of request in bytes
@@ -226,52 +441,191 @@ func (c *Cover) GetPostContent(id string) []byte {
  */
 func (c *Cover) xformReq(s *State, data []byte, num int) []byte {
 
-	inStr := string(data[0:num])
 	logger.Printf(logger.DBG_HIGH, "[sid.cover] %d bytes received from client.\n", num)
-	logger.Println(logger.DBG_ALL, "[sid.cover] Incoming request:\n"+inStr+"\n")
+	logger.Println(logger.DBG_ALL, "[sid.cover] Incoming request:\n"+string(data[0:num])+"\n")
+
+	// add fragment to request parser
+	p := s.ReqParser
+	p.Feed(data[0:num])
+	s.ReqBalance += num
+
+loop:
+	for {
+		// start of next request on a persistent connection
+		if s.ReqState == RS_DONE {
+			if p.Pending() == 0 {
+				break loop
+			}
+			s.resetRequest()
+		}
 
-	// assemble transformed request
-	rdr := bufio.NewReader(strings.NewReader(inStr))
-	req := ""
-	hasContentEncoding := false // expected content encoding defined?
-	//hasTransferEncoding := false		// expected transfer encoding defined?
-	mime := "text/html"  // expected content type
-	targetHost := c.Name // request resource from this host (default)
-	balance := 0         // balance between incoming and outgoing information
-
-	// use identical line break sequence
-	lb := "\r\n"
-	if strings.Index(inStr, lb) == -1 {
-		lb = "\n"
-	}
-	for s.ReqState == RS_HDR {
-		// get next line (terminated by line break)
-		b, broken, _ := rdr.ReadLine()
-		if b == nil || len(b) == 0 {
-			if !broken {
-				s.ReqState = RS_HDR_COMPLETE
+		// handle request header
+		if s.ReqState == RS_HDR {
+			done, err := p.ParseHeader(false)
+			if err != nil {
+				// never pass client data to the cover server
+				logger.Printf(logger.ERROR, "[sid.cover] Invalid request: %s -- request dropped\n", err.Error())
+				return c.refuseReq(s)
 			}
-			break
+			// transform the complete part of the header
+			s.ReqQueue = append(s.ReqQueue, c.xformReqHeader(s, p, done)...)
+			if !done {
+				// header is not complete: wait for next request fragment
+				logger.Println(logger.DBG, "[sid.cover] Request header fragmented -- waiting for more data")
+				break loop
+			}
+			s.ReqState = RS_HDR_COMPLETE
+			c.handleExpect(s, p)
+			s.ReqMethods = append(s.ReqMethods, p.Method)
+
+			if p.HasBody() {
+				// switch state
+				s.ReqState = RS_CONTENT
+				// parse multipart content for document uploads
+				if s.ReqMode == REQ_POST && len(s.ReqBoundaryIn) > 0 {
+					s.ReqForm = c.newFormParser(s)
+				}
+			} else {
+				// we are done
+				s.ReqState = RS_DONE
+			}
+		}
+
+		// handle processing of request contents for POST requests: the
+		// content is replaced by cover content of the same size.
+		if s.ReqState == RS_CONTENT {
+			segs, done, err := p.ReadBody()
+			if err != nil {
+				logger.Printf(logger.ERROR, "[sid.cover] Invalid request body: %s -- request dropped\n", err.Error())
+				return c.refuseReq(s)
+			}
+			for _, seg := range segs {
+				s.ReqQueue = append(s.ReqQueue, c.xformReqBody(s, p, seg)...)
+			}
+			if !done {
+				break loop
+			}
+			s.ReqState = RS_DONE
+			// drop incomplete uploads
+			c.abortUpload(s)
+		}
+		// complete requests are always sent
+		if s.ReqState == RS_DONE {
+			s.ReqFlush = len(s.ReqQueue)
 		}
-		line := strings.TrimRight(string(b), "\r\n")
+	}
 
-		// transform request data
-		switch {
+	// send transformed data (as much as received from the client)
+	n := s.ReqBalance
+	if n > len(s.ReqQueue) {
+		n = len(s.ReqQueue)
+	}
+	if n < s.ReqFlush {
+		n = s.ReqFlush
+	}
+	if n < 0 {
+		n = 0
+	}
+	req := append([]byte{}, s.ReqQueue[:n]...)
+	s.ReqQueue = s.ReqQueue[n:]
+	s.ReqFlush = 0
+	s.ReqBalance -= n
+
+	// check for completed request processing
+	if s.ReqState == RS_DONE {
+		// padding of request with line breaks (if assembled request is
+		// smaller); excess data is balanced by the following requests.
+		if s.ReqBalance > 0 {
+			req = append(req, bytes.Repeat([]byte("\n"), s.ReqBalance)...)
+			s.ReqBalance = 0
+		} else if s.ReqBalance < 0 {
+			logger.Printf(logger.WARN, "[sid.cover] Unbalanced request: %d bytes diff\n", -s.ReqBalance)
+		}
+	}
+	if num != len(req) {
+		logger.Printf(logger.WARN, "[sid.cover] DIFF(request) = %d\n", len(req)-num)
+	}
+	logger.Println(logger.DBG_ALL, "[sid.cover] Transformed request:\n"+string(req)+"\n")
+	return req
+}
+
+//---------------------------------------------------------------------
+/*
+ * Refuse the current client request: the request is dropped and the
+ * session is terminated after the transformed data of preceding
+ * (complete) requests has been sent to the cover server.
+ * @param s *State - reference to state information
+ * @return []byte - transformed request (send to cover server)
+ */
+func (c *Cover) refuseReq(s *State) []byte {
+	req := s.ReqQueue[:s.ReqFlush]
+	s.ReqQueue = nil
+	s.ReqFlush = 0
+	s.ReqState = RS_DONE
+	s.ReqBalance = 0
+	s.ReqFailed = true
+	c.abortUpload(s)
+	return req
+}
+
+//---------------------------------------------------------------------
+/*
+ * Handle expectations of a client request: the "Expect" header field
+ * is never passed to the cover server; a client that expects a "100
+ * Continue" response before it sends the request content gets it from
+ * SID (if no other response is pending on the connection; otherwise the
+ * client sends the content after a timeout).
+ * @param s *State - reference to state information
+ * @param p *MsgParser - parsed request (complete header)
+ */
+func (c *Cover) handleExpect(s *State, p *MsgParser) {
+	if !strings.EqualFold(p.Get("Expect"), "100-continue") || p.Proto != "HTTP/1.1" || !p.HasBody() {
+		return
+	}
+	if len(s.ReqMethods) > 0 || s.RespMode != 0 || s.RespParser.Pending() > 0 {
+		logger.Println(logger.DBG, "[sid.cover] Response pending -- no '100 Continue' sent")
+		return
+	}
+	s.ReqReply = append(s.ReqReply, []byte("HTTP/1.1 100 Continue"+p.Lb+p.Lb)...)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Transform the client request header: the request line and all header
+ * fields that can't be continued are transformed as soon as they are
+ * received; the content length is added at the end of the header (when
+ * the size of the cover content is known).
+ * @param s *State - reference to state information
+ * @param p *MsgParser - request parser
+ * @param done bool - header complete?
+ * @return string - transformed part of the request header
+ */
+func (c *Cover) xformReqHeader(s *State, p *MsgParser, done bool) string {
+
+	lb := p.Lb
+	req := ""
+
+	// transform request line
+	if !s.ReqLineDone && len(p.Method) > 0 {
+		s.ReqLineDone = true
+		s.ReqHost = c.Name // request resource from this host (default)
+
+		switch p.Method {
 		//---------------------------------------------------------
 		// POST command: upload document
 		// This command triggers the upload of a document to SID
 		// that is covered by an upload to the cover site of the
 		// same length.
 		//---------------------------------------------------------
-		case strings.HasPrefix(line, "POST "):
-			// split line into parts
-			parts := strings.Split(line, " ")
-			logger.Printf(logger.DBG_HIGH, "[sid.cover] POST '%s'\n", parts[1])
+		case "POST":
+			logger.Printf(logger.DBG_HIGH, "[sid.cover] POST '%s'\n", p.URI)
 
 			// POST uri encodes the key to the cover POST content and the
 			// target POST URL
-			elem := strings.Split(parts[1], "/")
-			s.ReqBoundaryOut = elem[1]
+			elem := strings.Split(p.URI, "/")
+			if len(elem) > 1 {
+				s.ReqBoundaryOut = elem[1]
+			}
 			uri := ""
 			for i := 2; i < len(elem); i++ {
 				uri += "/" + elem[i]
@@ -284,144 +638,67 @@ func (c *Cover) xformReq(s *State, data []byte, num int) []byte {
 			s.ReqCoverPost = c.GetPostContent(s.ReqBoundaryOut)
 			s.ReqCoverPostPos = 0
 
-			// if URI refers to an external host, split into
-			// host reference and resource specification
-			if pos := strings.Index(uri, "://"); pos != -1 {
-				rem := string(uri[pos+3:])
-				pos = strings.Index(rem, "/")
-				if pos != -1 {
-					targetHost = rem[0:pos]
-					uri = rem[pos:]
-					logger.Printf(logger.INFO, "[sid.cover] URI split: '%s', '%s'\n", targetHost, uri)
-				} else {
-					logger.Printf(logger.WARN, "[sid.cover] URI split failed on '%s'\n", uri)
-				}
-			} else {
-				targetHost = c.Name
-			}
-
 			// assemble new POST request
+			s.ReqHost, uri = splitURI(c.Name, uri)
 			s.ReqResource = uri
-			req += "POST " + uri + " HTTP/1.0" + lb
+			req += "POST " + uri + " " + p.Proto + lb
 			s.ReqMode = REQ_POST
 
-			// keep balance
-			balance += (len(parts[1]) - len(uri))
-
 		//---------------------------------------------------------
 		// GET command: request resource
 		// If the requested resource identifier is a translated
 		// entry, we need to translate that back into its original
 		// form. Translated entries start with "/&".
-		// It is assumed, that a "GET" line is one of the first
-		// lines in a request and therefore never fragmented.
-		// N.B.: We also force HTTP/1.0 to ensure that no
-		// chunking is used by the server (easier parsing).
 		//---------------------------------------------------------
-		case strings.HasPrefix(line, "GET "):
-			// split line into parts
-			parts := strings.Split(line, " ")
-			logger.Printf(logger.DBG_HIGH, "[sid.cover] resource='%s'\n", parts[1])
+		case "GET":
+			logger.Printf(logger.DBG_HIGH, "[sid.cover] resource='%s'\n", p.URI)
 
 			// perform translation (if required)
-			uri := translateURI(parts[1])
-			logger.Printf(logger.INFO, "[sid.cover] URI translation: '%s' => '%s'\n", parts[1], uri)
-
-			// if URI refers to an external host, split into
-			// host reference and resource specification
-			if pos := strings.Index(uri, "://"); pos != -1 {
-				rem := string(uri[pos+3:])
-				pos = strings.Index(rem, "/")
-				if pos != -1 {
-					targetHost = rem[0:pos]
-					uri = rem[pos:]
-					logger.Printf(logger.INFO, "[sid.cover] URI split: '%s', '%s'\n", targetHost, uri)
-				} else {
-					logger.Printf(logger.WARN, "[sid.cover] URI split failed on '%s'\n", uri)
-				}
-			} else {
-				targetHost = c.Name
-			}
+			uri := translateURI(p.URI)
+			logger.Printf(logger.INFO, "[sid.cover] URI translation: '%s' => '%s'\n", p.URI, uri)
 
 			// assemble new resource request
+			s.ReqHost, uri = splitURI(c.Name, uri)
 			s.ReqResource = uri
-			req += "GET " + uri + " HTTP/1.0" + lb
+			req += "GET " + uri + " " + p.Proto + lb
 			s.ReqMode = REQ_GET
 
-			// keep balance
-			balance += (len(parts[1]) - len(uri))
-
 		//---------------------------------------------------------
-		// Host reference: change to hostname of cover server
-		// This translation may leed to unbalanced request sizes;
-		// the balance will be equalled in a later line
-		// It is assumed, that a "Host:" line is one of the first
-		// lines in a request and therefore never fragmented.
+		// other commands are passed unchanged.
 		//---------------------------------------------------------
-		case strings.HasPrefix(line, "Host: "):
-			// split line into parts
-			parts := strings.Split(line, " ")
-			// replace hostname reference
-			logger.Printf(logger.DBG_HIGH, "[sid.cover] Host replaced with '%s'\n", targetHost)
-			req += "Host: " + targetHost + lb
-			// keep track of balance
-			balance += (len(parts[1]) - len(targetHost))
+		default:
+			logger.Printf(logger.WARN, "[sid.cover] Unhandled request method '%s'\n", p.Method)
+			req += p.Method + " " + p.URI + " " + p.Proto + lb
+		}
+	}
 
+	// transform header fields (folded lines of the last field can
+	// follow while the header is incomplete)
+	last := p.Settled
+	if done {
+		last = len(p.Header)
+	}
+	for ; s.ReqHdrPos < last; s.ReqHdrPos++ {
+		f := p.Header[s.ReqHdrPos]
+		line := f.Name + ": " + f.Value
+		switch strings.ToLower(f.Name) {
 		//---------------------------------------------------------
-		// try to get balance straight on language header line:
-		// "Accept-Language: de-de,de;q=0.8,en-us;q=0.5,en;q=0.3"
+		// Host reference: change to hostname of cover server
 		//---------------------------------------------------------
-		//case s.ReqBalance != 0 && strings.HasPrefix (line, "Accept-Language: "):
-		// @@@TODO: Is this the right place to balance the translation?
+		case "host":
+			logger.Printf(logger.DBG_HIGH, "[sid.cover] Host replaced with '%s'\n", s.ReqHost)
+			req += "Host: " + s.ReqHost + lb
 
-		//---------------------------------------------------------
-		// Acceptable content encoding: we only want plain HTML
-		//---------------------------------------------------------
-		case strings.HasPrefix(line, "Accept-Encoding: "):
-			// split line into parts
-			parts := strings.Split(line, " ")
-			hasContentEncoding = true
-			if mime == "text/html" && parts[1] != "identity" {
-				// change to identity encoding for HTML pages
-				repl := "Accept-Encoding: identity"
-				balance += len(repl) - len(line)
-				req += repl + lb
-			} else {
-				req += line + lb
-			}
-			/*
-				//---------------------------------------------------------
-				// Acceptable transfer encoding: we only want no chunking
-				//---------------------------------------------------------
-				case strings.HasPrefix (line, "Transfer-Encoding: "):
-					// split line into parts
-					parts := strings.Split (line, " ")
-					hasTransferEncoding = true
-					if mime == "text/html" && parts[1] != "identity" {
-						// change to identity transfer for HTML pages
-						repl := "Transfer-Encoding: identity"
-						balance += len(repl) - len(line)
-						req += repl + lb
-					} else {
-						req += line + lb
-					}
-			*/
 		//---------------------------------------------------------
 		// Expected content type
 		//---------------------------------------------------------
-		case strings.HasPrefix(line, "Content-Type: "):
-			// split line into parts
-			parts := strings.Split(line, " ")
-			mime = parts[1]
+		case "content-type":
+			mime := strings.TrimRight(strings.Split(f.Value, " ")[0], ";")
 			// remember boundary definition
-			if s.ReqMode == REQ_POST {
-				// strip "boundary="
-				s.ReqBoundaryIn = string(parts[2][9:])
+			if pos := strings.Index(f.Value, "boundary="); s.ReqMode == REQ_POST && pos != -1 {
+				s.ReqBoundaryIn = strings.Trim(f.Value[pos+9:], "\"")
 				logger.Println(logger.DBG_HIGH, "[sid.cover] Boundary="+s.ReqBoundaryIn)
-				repl := parts[0] + " " + mime +
-					" boundary=---------------------------" + s.ReqBoundaryOut
-				balance += len(repl) - len(line)
-				req += repl + lb
+				req += f.Name + ": " + mime + "; boundary=---------------------------" + s.ReqBoundaryOut + lb
 			} else {
 				req += line + lb
 			}
@@ -429,182 +706,260 @@ func (c *Cover) xformReq(s *State, data []byte, num int) []byte {
 		//---------------------------------------------------------
 		// Referer
 		//---------------------------------------------------------
-		case strings.HasPrefix(line, "Referer: "):
-			repl := "Referer: " + c.Protocol + "://" + targetHost + "/"
-			balance += len(repl) - len(line)
-			req += repl + lb
+		case "referer":
+			req += "Referer: " + c.Protocol + "://" + s.ReqHost + "/" + lb
 
 		//---------------------------------------------------------
-		// Connection
+		// Content-Length: added at the end of the header;
+		// Expect: handled by SID.
 		//---------------------------------------------------------
-		case strings.HasPrefix(line, "Connection: "):
-			// split line into parts
-			parts := strings.Split(line, " ")
-			if parts[1] != "close" {
-				repl := "Connection: close"
-				balance += len(repl) - len(line)
-				req += repl + lb
-			} else {
-				req += line + lb
-			}
-
-		//---------------------------------------------------------
-		// Keep-Alive:
-		//---------------------------------------------------------
-		case strings.HasPrefix(line, "Keep-Alive: "):
-			// don't add spec
-			balance -= len(line)
-
-		//---------------------------------------------------------
-		// Content-Length
-		//---------------------------------------------------------
-		case strings.HasPrefix(line, "Content-Length: "):
-			// do we have a pre-defined cover content?
-			if s.ReqCoverPost == nil || s.ReqCoverPost[0] == '!' {
-				// split line into parts
-				parts := strings.Split(line, " ")
-				// get incoming content length
-				s.ReqContentLength, _ = strconv.Atoi(parts[1])
-				// construct/expand cover content for given size
-				s.ReqCoverPost = c.FinalizeCover(c, s)
-			}
-			// use cover content to construct a content length
-			repl := "Content-Length: " + strconv.Itoa(len(s.ReqCoverPost))
-			balance += len(repl) - len(line)
-			req += repl + lb
+		case "content-length", "expect":
 
 		//---------------------------------------------------------
 		// add unchanged request lines.
 		//---------------------------------------------------------
 		default:
-			req += line
-			if !broken {
-				req += lb
-			}
+			req += line + lb
 		}
 	}
+	if !done {
+		return req
+	}
 
-	// check for completed header in this pass
-	if s.ReqState == RS_HDR_COMPLETE {
-		// add delimiting empty line
-		req += lb
-
-		// post-process header
-		if mime == "text/html" {
-			if !hasContentEncoding {
-				// enforce identity encoding for HTML pages
-				repl := "Accept-Encoding: identity"
-				balance += len(repl)
-				req += repl + lb
+	// construct the cover content: chunked content is replaced chunk by
+	// chunk (the size of the content is not known in advance).
+	if p.Chunked || p.Length >= 0 {
+		// do we have a pre-defined cover content?
+		if len(s.ReqCoverPost) == 0 || s.ReqCoverPost[0] == '!' {
+			// get incoming content length
+			s.ReqContentLength = p.Length
+			if p.Chunked {
+				s.ReqContentLength = -1
 			}
-			/*
-				if !hasTransferEncoding {
-					// enforce identity transfer for HTML pages
-					repl := "Transfer-Encoding: identity"
-					balance += len(repl)
-					req += repl + lb
-				}
-			*/
+			// construct/expand cover content for given size
+			s.ReqCoverPost = c.FinalizeCover(c, s)
 		}
-
-		if s.ReqMode == REQ_POST {
-			// switch state
-			s.ReqState = RS_CONTENT
-		} else {
-			// we are done
-			s.ReqState = RS_DONE
+		// use cover content to construct a content length
+		if !p.Chunked {
+			req += "Content-Length: " + strconv.Itoa(len(s.ReqCoverPost)) + lb
 		}
 	}
+	// add delimiting empty line
+	req += lb
 
-	// handle processing of request contents for POST requests
-	if s.ReqState == RS_CONTENT {
-
-		// parse data until end of request
-		for {
-			// get next line (terminated by line break)
-			// and adjust number of bytes read
-			b, _, err := rdr.ReadLine()
-			if err != nil {
-				break
-			}
-			line := strings.TrimRight(string(b), "\r\n")
-
-			//logger.Println (logger.DBG_ALL, "[sid.cover] POST content: " + line + "\n")
+	if diff := len(req) - p.HdrSize; diff != 0 {
+		logger.Printf(logger.DBG, "[sid.cover] Request header size changed: %d bytes diff\n", diff)
+	}
+	return req
+}
 
-			if !s.ReqUpload {
-				// check for start of document
-				if strings.Index(line, "name=\"file\";") != -1 {
-					s.ReqUpload = true
-					s.ReqUploadData = ""
-				}
-			} else {
-				if strings.Index(line, s.ReqBoundaryIn) != -1 {
-					s.ReqUpload = false
-					s.ReqUploadOK = PostprocessUploadData([]byte(s.ReqUploadData))
-				}
-				// we are uploading client data
-				s.ReqUploadData += line + lb
+//---------------------------------------------------------------------
+/*
+ * Transform a segment of the request body: content is replaced by cover
+ * content of the same size. The transfer framing of chunked content is
+ * rebuilt (chunk extensions and trailer fields are dropped); remaining
+ * cover content is sent in an additional chunk before the last chunk.
+ * @param s *State - reference to state information
+ * @param p *MsgParser - request parser
+ * @param seg *BodySegment - segment of request body
+ * @return []byte - transformed segment
+ */
+func (c *Cover) xformReqBody(s *State, p *MsgParser, seg *BodySegment) []byte {
+	out := make([]byte, 0, len(seg.Data))
+	switch seg.Kind {
+	case SEG_SIZE:
+		if seg.Size == 0 {
+			if rem := len(s.ReqCoverPost) - s.ReqCoverPostPos; rem > 0 {
+				out = append(out, strconv.FormatInt(int64(rem), 16)+p.Lb...)
+				out = append(out, c.coverPostData(s, rem)...)
+				out = append(out, p.Lb...)
 			}
 		}
+		return append(out, strconv.FormatInt(int64(seg.Size), 16)+p.Lb...)
+	case SEG_LB:
+		return append(out, p.Lb...)
+	case SEG_TRAILER:
+		if len(bytes.TrimSpace(seg.Data)) > 0 {
+			return out
+		}
+		return append(out, p.Lb...)
+	}
+	c.scanUpload(s, seg.Data)
+	return append(out, c.coverPostData(s, len(seg.Data))...)
+}
 
-		// build new request data
-		binReq := []byte(req)
-		copy(data, binReq)
-		pos := len(binReq)
-		count := num - pos
-
-		// we have "count" bytes of response data to sent out
-		start := s.ReqCoverPostPos
-		total := len(s.ReqCoverPost)
-		if start < total {
-			end := start + count
-			s.ReqCoverPostPos = end
-			if end > total {
-				end = total
-			}
-			copy(data[pos:], s.ReqCoverPost[start:end])
-			pos += (end - start)
+//---------------------------------------------------------------------
+/*
+ * Get next part of the cover POST content; if the cover content is
+ * exhausted, line breaks are used as filler.
+ * @param s *State - reference to state information
+ * @param n int - number of bytes requested
+ * @return []byte - cover content
+ */
+func (c *Cover) coverPostData(s *State, n int) []byte {
+	out := make([]byte, 0, n)
+	start := s.ReqCoverPostPos
+	total := len(s.ReqCoverPost)
+	if start < total {
+		end := start + n
+		if end > total {
+			end = total
 		}
+		out = append(out, s.ReqCoverPost[start:end]...)
+	}
+	s.ReqCoverPostPos += n
+	if len(out) < n {
+		out = append(out, bytes.Repeat([]byte("\n"), n-len(out))...)
+	}
+	return out
+}
+
+//---------------------------------------------------------------------
+/*
+ * Scan client POST content for document uploads.
+ * @param s *State - reference to state information
+ * @param data []byte - (decoded) POST content
+ */
+func (c *Cover) scanUpload(s *State, data []byte) {
+	if s.ReqForm == nil || s.ReqForm.Done() {
+		return
+	}
+	if _, err := s.ReqForm.Write(data); err != nil {
+		logger.Printf(logger.ERROR, "[sid.cover] Invalid multipart content: %s\n", err.Error())
+		s.ReqForm = nil
+		c.abortUpload(s)
+		return
+	}
+	// all form fields are known at the end of the form
+	if s.ReqForm.Done() {
+		c.completeUploads(s)
+	}
+}
 
-		// fill up with line breaks
-		if pos < num {
-			fill := ""
-			for count = num - pos; count > 0; count-- {
-				fill += "\n"
+//---------------------------------------------------------------------
+/*
+ * Create a multipart parser for client POST content: the content of
+ * document uploads is passed to an upload sink, other form fields are
+ * collected in the state. Uploads are completed at the end of the form
+ * (when all form fields are known).
+ * @param s *State - reference to state information
+ * @return *MultipartParser - new multipart parser
+ */
+func (c *Cover) newFormParser(s *State) *MultipartParser {
+	m := NewMultipartParser(s.ReqBoundaryIn)
+	m.OnPartStart = func(part *FormPart) {
+		if isFileField(s.Cfg, part.Name) && len(part.FileName) > 0 {
+			logger.Printf(logger.INFO, "[sid.cover] Document upload started (field '%s')\n", part.Name)
+			s.ReqUpload = true
+			s.ReqSink = NewUploadSink(s.docs)
+			s.ReqSink.Meta.FileName = part.FileName
+			s.ReqSink.Meta.ContentType = part.ContentType
+		}
+	}
+	m.OnPartData = func(part *FormPart, data []byte) {
+		if s.ReqSink != nil {
+			s.ReqSink.Write(data)
+		} else if len(part.FileName) == 0 {
+			// limit size of collected form fields
+			val := s.ReqFormFields[part.Name] + string(data)
+			if len(val) > MAX_FIELD_SIZE {
+				val = val[:MAX_FIELD_SIZE]
 			}
-			data = append(data[0:pos], []byte(fill)...)
-			pos = num
+			s.ReqFormFields[part.Name] = val
+		}
+	}
+	m.OnPartEnd = func(part *FormPart) {
+		if s.ReqSink != nil {
+			s.ReqPending = append(s.ReqPending, s.ReqSink)
+			s.ReqSink = nil
+			s.ReqUpload = false
 		}
+	}
+	return m
+}
+
+//---------------------------------------------------------------------
+/*
+ * Complete received document uploads (with the form fields of the
+ * request as additional information).
+ * @param s *State - reference to state information
+ */
+func (c *Cover) completeUploads(s *State) {
+	for _, sink := range s.ReqPending {
+		ok := (sink.Complete(s.ReqFormFields) == nil)
+		s.ReqUploadOK = ok && (s.ReqUploadCount == 0 || s.ReqUploadOK)
+		s.ReqUploadCount++
+	}
+	s.ReqPending = nil
+}
 
-		outStr := string(data[0:pos])
-		logger.Printf(logger.DBG_HIGH, "[sid.cover] %d bytes send to cover server.\n", pos)
-		logger.Println(logger.DBG_ALL, "[sid.cover] Outgoing request:\n"+outStr+"\n")
-		return data[0:pos]
+//---------------------------------------------------------------------
+/*
+ * Abort a pending (incomplete) document upload.
+ * @param s *State - reference to state information
+ */
+func (c *Cover) abortUpload(s *State) {
+	if s.ReqSink != nil {
+		s.ReqPending = append(s.ReqPending, s.ReqSink)
+		s.ReqSink = nil
+		s.ReqUpload = false
 	}
+	for _, sink := range s.ReqPending {
+		logger.Println(logger.WARN, "[sid.cover] Document upload aborted.")
+		sink.Abort()
+		s.ReqUploadOK = false
+	}
+	s.ReqPending = nil
+}
 
-	// check for completed request processing
-	if s.ReqState == RS_DONE {
-		if balance != 0 {
-			logger.Printf(logger.WARN, "[sid.cover] Unbalanced request: %d bytes diff\n", balance)
-		}
-	} else {
-		// padding of request with line breaks (if assembled request is smaller; GET only)
-		for num > len(req) && s.ReqMode == REQ_GET {
-			req += "\n"
+//---------------------------------------------------------------------
+/*
+ * Check if a form field is used for document uploads.
+ * @param cfg *Config - configuration (nil: current configuration)
+ * @param name string - name of form field
+ * @return bool - document upload field?
+ */
+func isFileField(cfg *Config, name string) bool {
+	if cfg == nil {
+		cfg = GetConfig()
+	}
+	for _, f := range strings.Split(cfg.Upload.FileField, ";") {
+		if strings.TrimSpace(f) == name {
+			return true
 		}
-		// return transformed request
-		if num != len(req) {
-			logger.Printf(logger.WARN, "[sid.cover] DIFF(request) = %d\n", len(req)-num)
+	}
+	return false
+}
+
+//---------------------------------------------------------------------
+/*
+ * Split URI into host reference and resource specification if the URI
+ * refers to an external host.
+ * @param host string - default host
+ * @param uri string - requested URI
+ * @return string - target host
+ * @return string - resource specification
+ */
+func splitURI(host, uri string) (string, string) {
+	if pos := strings.Index(uri, "://"); pos != -1 {
+		rem := string(uri[pos+3:])
+		pos = strings.Index(rem, "/")
+		if pos != -1 {
+			logger.Printf(logger.INFO, "[sid.cover] URI split: '%s', '%s'\n", rem[0:pos], rem[pos:])
+			return rem[0:pos], rem[pos:]
 		}
-		logger.Printf(logger.DBG_ALL, "[sid.cover] Transformed request:\n"+req+"\n")
+		logger.Printf(logger.WARN, "[sid.cover] URI split failed on '%s'\n", uri)
 	}
-	return []byte(req)
+	return host, uri
 }
 
 //---------------------------------------------------------------------
 /*
  * Transform cover server response: Substitute absolute URLs in the
  * response to local links to be handled by the request translations.
+ * The response body is replaced by content of the same size; the
+ * transfer framing (chunked encoding) is kept. On persistent
+ * connections a fragment can contain data of multiple responses.
  * @param s *state - reference to state information
  * @param data []byte - response data from cover server
  * @param num int - length of response data
@@ -613,168 +968,209 @@ func (c *Cover) xformReq(s *State, data []byte, num int) []byte {
 func (c *Cover) xformResp(s *State, data []byte, num int) []byte {
 
 	// log incoming packet
-	inStr := string(data[0:num])
 	logger.Printf(logger.DBG_HIGH, "[sid.cover] %d bytes received from cover server.\n", num)
-	logger.Println(logger.DBG_ALL, "[sid.cover] Incoming response:\n"+inStr+"\n")
-
-	// setup reader and response
-	size := num
-	rdr := bytes.NewBuffer(data[0:num])
-	resp := ""
+	logger.Println(logger.DBG_ALL, "[sid.cover] Incoming response:\n"+string(data[0:num])+"\n")
 
-	// initial response package
-	if s.RespMode == 0 {
-
-		// use identical line break sequence
-		lb := "\r\n"
-		if strings.Index(inStr, lb) == -1 {
-			lb = "\n"
-		}
-		// start of new response encountered: parse header fields
-	hdr:
-		for {
-			// get next line (terminated by line break)
-			line, err := rdr.ReadString('\n')
-			line = strings.TrimRight(line, "\n\r")
+	// response framing lost: pass data unchanged
+	if s.RespRaw {
+		return data[0:num]
+	}
+	// add fragment to response parser
+	p := s.RespParser
+	p.Feed(data[0:num])
+	resp := make([]byte, 0, num)
+
+	for p.Pending() > 0 {
+		// start of a new response: parse header
+		if s.RespMode == 0 {
+			noBody := len(s.ReqMethods) > 0 && s.ReqMethods[0] == "HEAD"
+			done, err := p.ParseHeader(noBody)
 			if err != nil {
+				logger.Printf(logger.ERROR, "[sid.cover] Invalid response: %s\n", err.Error())
+				s.RespRaw = true
+				resp = append(resp, p.take(p.Pending())...)
+				break
+			}
+			if !done {
 				// header is not complete: wait for next response fragment
 				logger.Println(logger.WARN, "[sid.cover] Response header fragmented!")
-				logger.Println(logger.DBG, "[sid.cover] Assembled response:\n"+resp)
-				if size != len(resp) {
-					logger.Printf(logger.WARN, "[sid.cover] DIFF(response:1) = %d\n", len(resp)-size)
-				}
-				return []byte(resp)
-			}
-			// check if header is available at all..
-			if strings.HasPrefix(line, "<!") {
-				logger.Println(logger.INFO, "[sid.cover] No response header found: "+line)
-				break hdr
+				break
 			}
+			resp = append(resp, []byte(c.xformRespHeader(s, p))...)
 
-			// parse response header
-			switch {
-			//-----------------------------------------------------
-			// Header parsing complete
-			//-----------------------------------------------------
-			case len(line) == 0:
-				// we have parsed the header; continue with body
-				logger.Println(logger.DBG_ALL, "[sid.cover] Incoming response header:\n"+resp)
-				// drop length encoding on gzip content
-				break hdr
-
-			//-----------------------------------------------------
-			// Status line
-			//-----------------------------------------------------
-			case strings.HasPrefix(line, "HTTP/"):
-				// split line into parts
-				parts := strings.Split(line, " ")
-				status, _ := strconv.Atoi(parts[1])
-				logger.Printf(logger.DBG, "[sid.cover] response status: %d\n", status)
-				if status != 200 {
-					return data[:size]
+			// interim responses (like "100 Continue") don't finish a request
+			if p.Status >= 200 && len(s.ReqMethods) > 0 {
+				s.ReqMethods = s.ReqMethods[1:]
+			}
+			if !p.HasBody() {
+				s.resetResponse()
+				continue
+			}
+			// handle compressed content
+			if !s.RespPass && len(s.RespEnc) > 0 && !strings.EqualFold(s.RespEnc, "identity") {
+				if s.RespCoder = NewContentCoder(s.RespEnc); s.RespCoder == nil {
+					logger.Println(logger.WARN, "[sid.cover] Unsupported content encoding '"+s.RespEnc+"' -- response passed")
+					s.RespPass = true
 				}
+			}
+			//---------------------------------------------------------
+			// start HTML response
+			//---------------------------------------------------------
+			if !s.RespPass && strings.HasPrefix(s.RespType, "text/html") {
+				// start of a new HTML response. Use pre-defined HTML page
+				// to initialize response.
+				var coverId string = ""
+				s.RespPending, coverId = c.HandleRequest(c, s)
+				s.Data["CoverId"] = coverId
+			}
+			// switch to next mode
+			s.RespMode = 1
+		}
 
-			//-----------------------------------------------------
-			// Content-Type:
-			//-----------------------------------------------------
-			case strings.HasPrefix(line, "Content-Type: "):
-				// split line into parts
-				parts := strings.Split(line, " ")
-				s.RespType = strings.TrimRight(parts[1], ";")
-				logger.Println(logger.DBG_HIGH, "[sid.cover] response type: "+s.RespType)
-
-			//-----------------------------------------------------
-			// Content-Encoding:
-			//-----------------------------------------------------
-			case strings.HasPrefix(line, "Content-Encoding: "):
-				// split line into parts
-				parts := strings.Split(line, " ")
-				s.RespEnc = parts[1]
-				logger.Println(logger.DBG_HIGH, "[sid.cover] response encoding: "+s.RespEnc)
-
-			//-----------------------------------------------------
-			// location:
-			//-----------------------------------------------------
-			case strings.HasPrefix(line, "location: "):
-				// split line into parts
-				parts := strings.Split(line, " ")
-				line = "location: " + translateURI(parts[1])
-				logger.Println(logger.DBG_HIGH, "[sid.cover] changing location => "+line)
+		// handle response body
+		segs, done, err := p.ReadBody()
+		if err != nil {
+			logger.Printf(logger.ERROR, "[sid.cover] Invalid response body: %s\n", err.Error())
+			s.RespRaw = true
+			done = true
+		}
+		// find last content segment: the size of the remaining body
+		// (if known) applies to the last segment only.
+		last := -1
+		for i, seg := range segs {
+			if !seg.Framing {
+				last = i
+			}
+		}
+		for i, seg := range segs {
+			if seg.Framing {
+				// keep transfer framing
+				resp = append(resp, seg.Data...)
+				continue
+			}
+			rem := -1
+			if i == last {
+				rem = p.Remaining()
 			}
-			// assemble response
-			resp += line + lb
+			resp = append(resp, c.xformContent(s, seg.Data, rem)...)
+		}
+		if s.RespRaw {
+			resp = append(resp, p.take(p.Pending())...)
+			break
+		}
+		if !done {
+			break
 		}
-		// add delimiter line
-		resp += lb
-		// adjust remaining content size
-		num -= len(resp)
+		s.resetResponse()
 	}
 
-	// start of HTML response?
-	if s.RespMode == 0 {
-		//-------------------------------------------------------------
-		// start HTML response
-		//-------------------------------------------------------------
-		if strings.HasPrefix(s.RespType, "text/html") {
-			// start of a new HTML response. Use pre-defined HTML page
-			// to initialize response.
-			var coverId string = ""
-			s.RespPending, coverId = c.HandleRequest(c, s)
-			s.Data["CoverId"] = coverId
+	// return response data
+	if num != len(resp) {
+		logger.Printf(logger.WARN, "[sid.cover] DIFF(response) = %d\n", len(resp)-num)
+	}
+	logger.Println(logger.DBG_ALL, "[sid.cover] Translated response:\n"+string(resp))
+	return resp
+}
+
+//---------------------------------------------------------------------
+/*
+ * Transform the (complete) header of a cover server response.
+ * @param s *State - reference to state information
+ * @param p *MsgParser - parsed response
+ * @return string - transformed response header
+ */
+func (c *Cover) xformRespHeader(s *State, p *MsgParser) string {
+
+	lb := p.Lb
+	logger.Printf(logger.DBG, "[sid.cover] response status: %d\n", p.Status)
+	resp := p.Proto + " " + strconv.Itoa(p.Status)
+	if len(p.Reason) > 0 {
+		resp += " " + p.Reason
+	}
+	resp += lb
+	// only successful responses are transformed
+	s.RespPass = (p.Status != 200)
+
+	for _, f := range p.Header {
+		line := f.Name + ": " + f.Value
+		switch strings.ToLower(f.Name) {
+		//-----------------------------------------------------
+		// Content-Type:
+		//-----------------------------------------------------
+		case "content-type":
+			s.RespType = strings.TrimRight(strings.Split(f.Value, " ")[0], ";")
+			logger.Println(logger.DBG_HIGH, "[sid.cover] response type: "+s.RespType)
+
+		//-----------------------------------------------------
+		// Content-Encoding:
+		//-----------------------------------------------------
+		case "content-encoding":
+			s.RespEnc = f.Value
+			logger.Println(logger.DBG_HIGH, "[sid.cover] response encoding: "+s.RespEnc)
+
+		//-----------------------------------------------------
+		// location:
+		//-----------------------------------------------------
+		case "location":
+			line = f.Name + ": " + translateURI(f.Value)
+			logger.Println(logger.DBG_HIGH, "[sid.cover] changing location => "+line)
 		}
-		// switch to next mode
-		s.RespMode = 1
+		// assemble response
+		resp += line + lb
+	}
+	// add delimiter line
+	resp += lb
+	logger.Println(logger.DBG_ALL, "[sid.cover] Incoming response header:\n"+resp)
+	return resp
+}
+
+//---------------------------------------------------------------------
+/*
+ * Transform response content: the transformed content has the same size
+ * as the incoming content. Compressed content is decoded for parsing;
+ * the transformed content is encoded with the same content encoding.
+ * @param s *State - reference to state information
+ * @param data []byte - response content
+ * @param rem int - size of remaining response body (-1 if unknown)
+ * @return []byte - transformed content
+ */
+func (c *Cover) xformContent(s *State, data []byte, rem int) []byte {
+
+	num := len(data)
+	// content must be finalized if the remaining body is too small to
+	// hold the closing sequences.
+	reserve := len(htmlOutro)
+	if s.RespCoder != nil {
+		reserve += s.RespCoder.Reserve()
 	}
+	final := rem == 0 || (rem > 0 && rem < reserve)
 
 	switch {
+	//-------------------------------------------------------------
+	// unsuccessful responses are passed unchanged
+	//-------------------------------------------------------------
+	case s.RespPass:
+		return data
+
 	//-------------------------------------------------------------
 	// assemble HTML response
 	//-------------------------------------------------------------
 	case strings.HasPrefix(s.RespType, "text/html"):
 		// do content translation (collect resource tags)
-		done := parseHTML(rdr, s.RespHdr, s.RespTags, s.RespXtra)
+		plain := data
+		if s.RespCoder != nil {
+			plain = s.RespCoder.Decode(data)
+		}
+		done := parseHTML(bytes.NewBuffer(plain), s.RespHdr, s.RespTags, s.RespXtra)
 		// sync replacement body (cover content) if response has
 		// been completely processed.
-		if done {
+		if (done || final) && s.RespMode < 3 {
 			c.SyncCover(c, s)
 		}
-
-		// start of HTML?
-		if s.RespMode == 1 {
-			// initial HTML sequence
-			resp += htmlIntro
-			// output header if available
-			if s.RespHdr.Count() > 0 {
-				hdr := c.assembleHeader(s.RespHdr, num)
-				resp += hdr
-				num -= len(hdr)
-			}
-			// handle HTML body
-			s.RespMode = 2
-			// open body tag
-			str := "<body>\n"
-			resp += str
-			num -= len(str)
-		}
-		// continue to assemble HTML body
-		body := c.assembleBody(s, num, done)
-		resp += body
-		num -= len(body)
-		if done {
-			// close body and HTML
-			resp += htmlOutro
-			num -= len(htmlOutro)
-		}
-		// we are done with this response packer, but have still response
-		// data to transfer. Fill up with padding sequence.
-		resp += padding(num)
-
-		// return response data
-		if size != len(resp) {
-			logger.Printf(logger.WARN, "[sid.cover] DIFF(response:2) = %d\n", len(resp)-size)
-		}
-		logger.Println(logger.DBG_ALL, "[sid.cover] Translated response:\n"+resp)
-		return []byte(resp)
+		return encodeContent(s, num, rem, func(size int) ([]byte, bool) {
+			html := c.assembleHTML(s, size, done || final)
+			return []byte(html), s.RespMode == 4
+		})
 
 	//-------------------------------------------------------------
 	// Images: Images are considered harmless, so we simply
@@ -782,7 +1178,7 @@ func (c *Cover) xformResp(s *State, data []byte, num int) []byte {
 	//-------------------------------------------------------------
 	case strings.HasPrefix(s.RespType, "image/"):
 		logger.Println(logger.DBG, "[sid.cover] Image data passed to client")
-		return data[0:size]
+		return data
 
 	//-------------------------------------------------------------
 	// JavaScript: Simply replace any JavaScript content with
@@ -790,16 +1186,8 @@ func (c *Cover) xformResp(s *State, data []byte, num int) []byte {
 	// JavaScript).
 	//-------------------------------------------------------------
 	case strings.HasPrefix(s.RespType, "application/x-javascript"):
-		// padding to requested size
-		for n := 0; n < num; n++ {
-			resp += " "
-		}
-		// return response data
 		logger.Println(logger.DBG, "[sid.cover] JavaScript scrubbed")
-		if size != len(resp) {
-			logger.Printf(logger.WARN, "[sid.cover] DIFF(response:3) = %d\n", len(resp)-size)
-		}
-		return []byte(resp)
+		return encodeContent(s, num, rem, scrub)
 
 	//-------------------------------------------------------------
 	// CSS: Simply replace any style sheets with spaces. No image
@@ -807,21 +1195,99 @@ func (c *Cover) xformResp(s *State, data []byte, num int) []byte {
 	// resources to an eavesdropper)
 	//-------------------------------------------------------------
 	case strings.HasPrefix(s.RespType, "text/css"):
-		// padding to requested size
-		for n := 0; n < num; n++ {
-			resp += " "
-		}
-		// return response data
 		logger.Println(logger.DBG, "[sid.cover] CSS scrubbed")
-		if size != len(resp) {
-			logger.Printf(logger.WARN, "[sid.cover] DIFF(response:4) = %d\n", len(resp)-size)
-		}
-		return []byte(resp)
+		return encodeContent(s, num, rem, scrub)
 	}
 
 	//return untranslated response
 	logger.Println(logger.ERROR, "[sid.cover] Unhandled response!")
-	return data[0:size]
+	return data
+}
+
+//---------------------------------------------------------------------
+/*
+ * Encode transformed content of given size with the content encoding
+ * of the response.
+ * @param s *State - reference to state information
+ * @param num int - size of encoded content
+ * @param rem int - size of remaining response body (-1 if unknown)
+ * @param gen func(int) ([]byte, bool) - content generator
+ * @return []byte - encoded content
+ */
+func encodeContent(s *State, num, rem int, gen func(int) ([]byte, bool)) []byte {
+	if s.RespCoder == nil {
+		out, _ := gen(num)
+		return out
+	}
+	return s.RespCoder.Encode(num, rem, gen)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Content generator for scrubbed content (white space).
+ * @param size int - size of content
+ * @return []byte - generated content
+ * @return bool - content complete?
+ */
+func scrub(size int) ([]byte, bool) {
+	return bytes.Repeat([]byte(" "), size), true
+}
+
+//=====================================================================
+/*
+ * Assemble HTML response content of given size. Content that doesn't
+ * fit into the requested size is kept pending for the next fragment.
+ * @param s *State - current state info
+ * @param num int - size of response content
+ * @param done bool - can we close the HTML
+ * @return string - assembled HTML content
+ */
+func (c *Cover) assembleHTML(s *State, num int, done bool) string {
+
+	resp := ""
+	// start of HTML?
+	if s.RespMode == 1 {
+		// initial HTML sequence
+		resp += htmlIntro
+		// output header if available
+		if s.RespHdr.Count() > 0 {
+			resp += c.assembleHeader(s.RespHdr, num-len(resp))
+		}
+		// open body tag and handle HTML body
+		resp += "<body>\n"
+		s.RespMode = 2
+	}
+	// continue to assemble HTML body
+	if s.RespMode == 2 {
+		resp += c.assembleBody(s, num-len(resp), done)
+		if done {
+			// close body and HTML after all pending data is out
+			s.RespPending += htmlOutro
+			s.RespMode = 3
+		}
+	}
+	// emit pending response data (including the closing sequence)
+	if s.RespMode == 3 {
+		n := num - len(resp)
+		if n > len(s.RespPending) {
+			n = len(s.RespPending)
+		}
+		if n > 0 {
+			resp += s.RespPending[:n]
+			s.RespPending = s.RespPending[n:]
+		}
+		if len(s.RespPending) == 0 {
+			s.RespMode = 4
+		}
+	}
+	// keep content that doesn't fit for the next fragment
+	if len(resp) > num {
+		s.RespPending = resp[num:] + s.RespPending
+		return resp[:num]
+	}
+	// we are done with this response packet, but have still response
+	// data to transfer. Fill up with padding sequence.
+	return resp + padding(num-len(resp))
 }
 
 //=====================================================================
@@ -836,8 +1302,9 @@ func (c *Cover) xformResp(s *State, data []byte, num int) []byte {
  */
 func (c *Cover) assembleBody(s *State, size int, done bool) string {
 
-	// check if requested size can hold HTML wrapper at all.
-	if size < 10 {
+	// check if requested size can hold HTML wrapper at all (pending
+	// response data can be split at any position).
+	if size <= 0 || (size < 10 && len(s.RespPending) == 0) {
 		return ""
 	}
 	// continue HTML body
@@ -0,0 +1,453 @@
+/*
+ * Cover server instance: concurrent session and POST content tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Start a dummy cover server that accepts (and holds) connections.
+ * @param t *testing.T - test instance
+ * @return net.Listener - listener of dummy server
+ * @return int - port of dummy server
+ */
+func startDummyCover(t *testing.T) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// drain connection until the client hangs up
+			go func() {
+				buf := make([]byte, 256)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						conn.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Run go-routines that register POST content, connect to the cover
+ * server, look up their state, fetch the POST content and disconnect.
+ * The cover is created as a literal (without NewCover).
+ */
+func TestCoverConcurrent(t *testing.T) {
+	ln, port := startDummyCover(t)
+	defer ln.Close()
+
+	var started, ended int32
+	c := &Cover{
+		Name:     "127.0.0.1",
+		Port:     port,
+		Protocol: "http",
+		OnSessionStart: func(c *Cover, s *State) {
+			atomic.AddInt32(&started, 1)
+		},
+		OnSessionEnd: func(c *Cover, s *State) {
+			atomic.AddInt32(&ended, 1)
+		},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 2*numRoutines)
+	for i := 0; i < numRoutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := "boundary" + strconv.Itoa(i)
+			post := bytes.Repeat([]byte{byte('a' + i%26)}, 100+i)
+			c.AddPostContent(id, post)
+
+			client, peer := net.Pipe()
+			defer client.Close()
+			defer peer.Close()
+			conn := c.connect(client)
+			if conn == nil {
+				errs <- "can't connect to cover server"
+				return
+			}
+			s := c.GetState(conn)
+			if s == nil {
+				errs <- "no state for connection"
+			}
+			if got := c.GetPostContent(id); !bytes.Equal(got, post) {
+				errs <- "wrong POST content for " + id
+			}
+			if c.GetPostContent(id) != nil {
+				errs <- "POST content for " + id + " not removed"
+			}
+			c.disconnect(conn)
+			if c.GetState(conn) != nil {
+				errs <- "state still registered after disconnect"
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for msg := range errs {
+		t.Error(msg)
+	}
+	if n := c.States.Count(); n != 0 {
+		t.Fatalf("%d sessions left after disconnect", n)
+	}
+	if started != numRoutines || ended != numRoutines {
+		t.Fatalf("session callbacks: %d started, %d ended", started, ended)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Concurrent access to the same POST content: exactly one go-routine
+ * gets the content.
+ */
+func TestCoverPostContentOnce(t *testing.T) {
+	c := &Cover{}
+	if c.GetPostContent("none") != nil {
+		t.Fatal("POST content in empty cover")
+	}
+	c.AddPostContent("id", []byte("content"))
+
+	var wg sync.WaitGroup
+	var hits int32
+	for i := 0; i < numRoutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.GetPostContent("id") != nil {
+				atomic.AddInt32(&hits, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if hits != 1 {
+		t.Fatalf("POST content fetched %d times", hits)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * A cloned cover shares the handlers but has its own (empty) lists of
+ * sessions and POST contents.
+ */
+func TestCoverClone(t *testing.T) {
+	c := NewCover("example.org", 80, "http")
+	c.FinalizeCover = func(c *Cover, s *State) []byte { return nil }
+	c.AddPostContent("id", []byte("content"))
+	cc := c.Clone("example.net", 443, "https")
+	if cc.Name != "example.net" || cc.Port != 443 || cc.Protocol != "https" {
+		t.Fatal("clone has wrong cover server")
+	}
+	if cc.FinalizeCover == nil {
+		t.Fatal("clone has no handlers")
+	}
+	if got := cc.GetPostContent("id"); got != nil {
+		t.Fatalf("clone has POST content '%s'", got)
+	}
+	cc.AddPostContent("id", []byte("other"))
+	if got := c.GetPostContent("id"); string(got) != "content" {
+		t.Fatalf("original has POST content '%s'", got)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a state for request transformation tests.
+ * @return *State - new state
+ */
+func newTestState() *State {
+	return &State{
+		ReqMode:       REQ_UNKNOWN,
+		ReqState:      RS_HDR,
+		ReqParser:     NewMsgParser(),
+		ReqFormFields: make(map[string]string),
+		RespParser:    NewMsgParser(),
+		Data:          make(map[string]string),
+		Cfg:           GetConfig(),
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * The content of a POST request (with content length) is replaced by
+ * the finalized cover content.
+ */
+func TestXformReqPost(t *testing.T) {
+	c := NewCover("example.org", 80, "http")
+	c.FinalizeCover = func(c *Cover, s *State) []byte {
+		return bytes.Repeat([]byte("x"), s.ReqContentLength)
+	}
+	s := newTestState()
+	body := "secret=document+content"
+	msg := "POST /id/upload HTTP/1.1\r\nHost: sid.onion\r\nContent-Length: " +
+		strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	// feed request in fragments
+	out := make([]byte, 0)
+	for _, frag := range []string{msg[:10], msg[10:50], msg[50:]} {
+		out = append(out, c.xformReq(s, []byte(frag), len(frag))...)
+	}
+	if s.ReqFailed {
+		t.Fatal("request refused")
+	}
+	if bytes.Contains(out, []byte("secret")) {
+		t.Fatal("client content passed to cover server")
+	}
+	// (the request is padded to its original size)
+	if !bytes.Contains(out, append([]byte("\r\n\r\n"), bytes.Repeat([]byte("x"), len(body))...)) {
+		t.Fatalf("cover content missing in request:\n%s", out)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * The content of chunked requests is replaced chunk by chunk (keeping
+ * the chunk sizes); chunk extensions and trailer fields are dropped and
+ * remaining cover content is sent in an additional chunk.
+ */
+func TestXformReqChunked(t *testing.T) {
+	c := NewCover("example.org", 80, "http")
+	c.FinalizeCover = func(c *Cover, s *State) []byte {
+		if s.ReqContentLength != -1 {
+			t.Fatalf("content length %d for chunked request", s.ReqContentLength)
+		}
+		return bytes.Repeat([]byte("x"), 20)
+	}
+	get := "GET / HTTP/1.1\r\nHost: sid.onion\r\n\r\n"
+	post := "POST /id/upload HTTP/1.1\r\nHost: sid.onion\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"6;name=secret\r\nsecret\r\n5\r\nstuff\r\n0\r\nChecksum: secret\r\n\r\n"
+	expect := "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n" +
+		"POST /upload HTTP/1.1\r\nHost: example.org\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"6\r\nxxxxxx\r\n5\r\nxxxxx\r\n9\r\nxxxxxxxxx\r\n0\r\n\r\n"
+	msg := get + post
+
+	// feed request at once and in small fragments
+	for _, size := range []int{len(msg), 5} {
+		s := newTestState()
+		out := make([]byte, 0)
+		for pos := 0; pos < len(msg); pos += size {
+			end := pos + size
+			if end > len(msg) {
+				end = len(msg)
+			}
+			out = append(out, c.xformReq(s, []byte(msg[pos:end]), end-pos)...)
+			if s.ReqFailed {
+				t.Fatalf("%d: chunked request refused", size)
+			}
+		}
+		if bytes.Contains(out, []byte("secret")) || bytes.Contains(out, []byte("stuff")) {
+			t.Fatalf("%d: client content passed to cover server:\n%s", size, out)
+		}
+		// the request is padded to its original size
+		if !bytes.HasPrefix(out, []byte(expect)) || len(bytes.Trim(out[len(expect):], "\n")) > 0 {
+			t.Fatalf("%d: wrong transformed request:\n%s", size, out)
+		}
+		if len(out) != len(msg) {
+			t.Fatalf("%d: %d bytes sent for %d bytes", size, len(out), len(msg))
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Folded header lines are joined with their header field, even if the
+ * continuation is in another fragment.
+ */
+func TestXformReqFolded(t *testing.T) {
+	c := NewCover("example.org", 80, "http")
+	msg := "GET /index.html HTTP/1.1\r\nHost:\r\n sid.onion\r\nX-List: one,\r\n"
+	s := newTestState()
+	out := string(c.xformReq(s, []byte(msg), len(msg)))
+	if s.ReqFailed {
+		t.Fatal("request refused")
+	}
+	// the last field can still be continued
+	if out != "GET /index.html HTTP/1.1\r\nHost: example.org\r\n" {
+		t.Fatalf("wrong partial request:\n%s", out)
+	}
+	msg = "\ttwo\r\n  three\r\n\r\n"
+	out += string(c.xformReq(s, []byte(msg), len(msg)))
+	if !strings.HasPrefix(out, "GET /index.html HTTP/1.1\r\nHost: example.org\r\nX-List: one, two three\r\n\r\n") {
+		t.Fatalf("wrong request:\n%s", out)
+	}
+
+	// continuation without a header field
+	s = newTestState()
+	msg = "GET / HTTP/1.1\r\n secret\r\n\r\n"
+	if out := c.xformReq(s, []byte(msg), len(msg)); !s.ReqFailed || len(out) > 0 {
+		t.Fatal("continuation line without field accepted")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * "Expect: 100-continue" is never passed to the cover server; the client
+ * gets the interim response from SID if no other response is pending.
+ */
+func TestXformReqExpect(t *testing.T) {
+	c := NewCover("example.org", 80, "http")
+	c.FinalizeCover = func(c *Cover, s *State) []byte {
+		return bytes.Repeat([]byte("x"), s.ReqContentLength)
+	}
+	hdr := "POST /id/upload HTTP/1.1\r\nHost: sid.onion\r\nExpect: 100-continue\r\nContent-Length: 6\r\n\r\n"
+	s := newTestState()
+	out := c.xformReq(s, []byte(hdr), len(hdr))
+	if bytes.Contains(bytes.ToLower(out), []byte("expect")) {
+		t.Fatalf("expectation passed to cover server:\n%s", out)
+	}
+	if string(s.ReqReply) != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Fatalf("wrong interim response '%s'", s.ReqReply)
+	}
+	s.ReqReply = nil
+	out = c.xformReq(s, []byte("secret"), 6)
+	if !bytes.HasPrefix(out, []byte("xxxxxx")) {
+		t.Fatalf("cover content missing in request:\n%s", out)
+	}
+
+	// no interim response while another response is pending
+	get := "GET / HTTP/1.1\r\nHost: sid.onion\r\n\r\n"
+	s = newTestState()
+	c.xformReq(s, []byte(get), len(get))
+	out = c.xformReq(s, []byte(hdr), len(hdr))
+	if len(s.ReqReply) > 0 {
+		t.Fatal("interim response sent while response is pending")
+	}
+	if bytes.Contains(bytes.ToLower(out), []byte("expect")) {
+		t.Fatalf("expectation passed to cover server:\n%s", out)
+	}
+	// HTTP/1.0 clients and requests without body
+	for _, msg := range []string{
+		"POST /id/upload HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 6\r\n\r\n",
+		"GET / HTTP/1.1\r\nExpect: 100-continue\r\n\r\n",
+	} {
+		s = newTestState()
+		c.xformReq(s, []byte(msg), len(msg))
+		if len(s.ReqReply) > 0 {
+			t.Fatalf("interim response sent for '%s'", msg)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * The transformed request follows the size of the incoming fragments:
+ * complete header lines are passed on, no more data than received is
+ * sent before the request is complete and the complete request matches
+ * the size of the incoming request.
+ */
+func TestXformReqFragments(t *testing.T) {
+	c := NewCover("example.org", 80, "http")
+	c.FinalizeCover = func(c *Cover, s *State) []byte {
+		return bytes.Repeat([]byte("x"), s.ReqContentLength)
+	}
+	body := "secret=document+content"
+	msg := "POST /id/upload HTTP/1.1\r\nHost: sid.onion\r\nUser-Agent: test\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\nAccept: */*\r\n\r\n" + body
+
+	for _, size := range []int{1, 7, 16, 40} {
+		s := newTestState()
+		in, sent := 0, 0
+		for pos := 0; pos < len(msg); pos += size {
+			end := pos + size
+			if end > len(msg) {
+				end = len(msg)
+			}
+			out := c.xformReq(s, []byte(msg[pos:end]), end-pos)
+			in += end - pos
+			sent += len(out)
+			if in < len(msg) && sent > in {
+				t.Fatalf("%d: %d bytes sent for %d bytes", size, sent, in)
+			}
+		}
+		if sent != len(msg) {
+			t.Fatalf("%d: %d bytes sent for %d bytes", size, sent, len(msg))
+		}
+	}
+
+	// header split across fragments: complete lines are sent
+	split := strings.Index(msg, "Accept")
+	for pos, size := range []int{strings.Index(msg, "Host"), strings.Index(msg, "User"), split} {
+		s := newTestState()
+		out := c.xformReq(s, []byte(msg[:size]), size)
+		if len(out) == 0 || len(out) > size {
+			t.Fatalf("%d: %d bytes sent for %d bytes", pos, len(out), size)
+		}
+	}
+	s := newTestState()
+	out := c.xformReq(s, []byte(msg[:split]), split)
+	if string(out) != "POST /upload HTTP/1.1\r\nHost: example.org\r\nUser-Agent: test\r\n" {
+		t.Fatalf("wrong partial request:\n%s", out)
+	}
+	// the content length is sent at the end of the header
+	out = c.xformReq(s, []byte(msg[split:]), len(msg)-split)
+	if !bytes.HasPrefix(out, []byte("Accept: */*\r\nContent-Length: 23\r\n\r\nxxxx")) {
+		t.Fatalf("wrong request:\n%s", out)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Invalid requests are dropped (the client data is not passed on).
+ */
+func TestXformReqInvalid(t *testing.T) {
+	c := NewCover("example.org", 80, "http")
+	c.FinalizeCover = func(c *Cover, s *State) []byte { return nil }
+	for _, msg := range []string{
+		"secret\r\n\r\n",
+		"GET / HTTP/1.1\r\nsecret\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: secret\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: secret\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nsecret\r\n",
+	} {
+		s := newTestState()
+		out := c.xformReq(s, []byte(msg), len(msg))
+		if !s.ReqFailed {
+			t.Fatalf("invalid request '%s' not refused", msg)
+		}
+		if len(out) > 0 {
+			t.Fatalf("invalid request passed to cover server:\n%s", out)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * TLS connections to cover servers: HTTPS cover servers are accessed
+ * through TLS (with server name indication); the server certificate can
+ * be pinned (SHA-256 hash of the public key) in addition to the standard
+ * certificate verification.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/bfix/gospel/logger"
+	tls "github.com/refraction-networking/utls"
+	"net"
+	"strings"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// max. duration of a TLS handshake with a cover server
+	TLS_TIMEOUT = 30 * time.Second
+)
+
+///////////////////////////////////////////////////////////////////////
+// Local variables
+
+/*
+ * Browser profile for the TLS handshake: the ClientHello of SID looks
+ * like that of a current web browser (cipher suites, extensions and
+ * their order), so connections to the cover server can't be told apart
+ * from browser connections by their TLS fingerprint.
+ */
+var coverHello = tls.HelloChrome_Auto
+
+///////////////////////////////////////////////////////////////////////
+// Public methods
+
+/*
+ * Add a certificate pin for the cover server: if pins are defined, the
+ * certificate chain of the cover server must contain a certificate with
+ * a matching public key. The base64 padding of a pin is optional (the
+ * configuration parser doesn't handle '=' in values).
+ * @param pin string - base64-encoded SHA-256 hash of public key (SPKI)
+ * @return error - error object (or nil)
+ */
+func (c *Cover) AddPin(pin string) error {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+	h, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(pin, "="))
+	if err != nil {
+		return err
+	}
+	if len(h) != sha256.Size {
+		return errors.New("invalid pin length")
+	}
+	c.tlsLock.Lock()
+	c.Pins = append(c.Pins, base64.StdEncoding.EncodeToString(h))
+	c.tlsLock.Unlock()
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Compute the pin for a certificate.
+ * @param cert *x509.Certificate - certificate
+ * @return string - base64-encoded SHA-256 hash of public key (SPKI)
+ */
+func PublicKeyPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+//---------------------------------------------------------------------
+/*
+ * Apply configured certificate pins to the cover servers in a pool.
+ * A pin specification has the form "<host>;<pin>".
+ * @param pool *CoverPool - pool of cover servers
+ * @param specs []string - list of pin specifications
+ * @return error - error object (or nil)
+ */
+func ApplyCoverPins(pool *CoverPool, specs []string) error {
+	for _, spec := range specs {
+		pos := strings.Index(spec, ";")
+		if pos == -1 {
+			return errors.New("invalid pin specification '" + spec + "'")
+		}
+		host := strings.TrimSpace(spec[:pos])
+		found := false
+		for _, c := range pool.Covers() {
+			if strings.EqualFold(c.Name, host) {
+				if err := c.AddPin(spec[pos+1:]); err != nil {
+					return err
+				}
+				found = true
+			}
+		}
+		if !found {
+			logger.Printf(logger.WARN, "[sid.tls] pin for unknown cover server '%s' ignored\n", host)
+		}
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Private methods
+
+/*
+ * Wrap a connection to the cover server in TLS: the ClientHello mimics
+ * a web browser (see 'coverHello'). Every connection uses a fresh
+ * configuration without a session cache (resumed sessions would link
+ * the connections of different clients) and checks the current pins.
+ * @param conn net.Conn - (plain) connection to cover server
+ * @return net.Conn - TLS connection
+ * @return error - error object (or nil)
+ */
+func (c *Cover) wrapTLS(conn net.Conn) (net.Conn, error) {
+	spec, err := tls.UTLSIdToSpec(coverHello)
+	if err != nil {
+		return nil, err
+	}
+	// HTTP/2 is not supported by the cover transformation, so only
+	// HTTP/1.1 is offered.
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*tls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+	cfg := &tls.Config{
+		ServerName:            c.serverName(),
+		RootCAs:               c.RootCAs,
+		MinVersion:            tls.VersionTLS12,
+		VerifyPeerCertificate: c.verifyPins,
+	}
+	tc := tls.UClient(conn, cfg, tls.HelloCustom)
+	if err = tc.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Now().Add(TLS_TIMEOUT))
+	if err = tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	state := tc.ConnectionState()
+	logger.Printf(logger.DBG, "[sid.tls] TLS connection to '%s' established (version %04x, cipher %04x)\n", c.serverName(), state.Version, state.CipherSuite)
+	return tc, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get server name used for TLS (SNI and certificate verification).
+ * @return string - server name
+ */
+func (c *Cover) serverName() string {
+	if len(c.ServerName) > 0 {
+		return c.ServerName
+	}
+	return c.Name
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check certificate chains of the cover server for pinned public keys
+ * (if pins are defined).
+ * @param raw [][]byte - certificates presented by the server
+ * @param chains [][]*x509.Certificate - verified certificate chains
+ * @return error - error object (or nil if a pin matches)
+ */
+func (c *Cover) verifyPins(raw [][]byte, chains [][]*x509.Certificate) error {
+	c.tlsLock.Lock()
+	pins := c.Pins
+	c.tlsLock.Unlock()
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := PublicKeyPin(cert)
+			for _, p := range pins {
+				if p == pin {
+					return nil
+				}
+			}
+		}
+	}
+	logger.Printf(logger.ERROR, "[sid.tls] no pinned public key in certificate chain of '%s'\n", c.serverName())
+	return errors.New("certificate pin mismatch")
+}
@@ -0,0 +1,428 @@
+/*
+ * TLS connections to cover servers: handshake, server name indication
+ * and certificate pinning tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	utls "github.com/refraction-networking/utls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper types and functions
+
+/*
+ * HTTPS test server that records the server names requested by clients
+ * (and the last ClientHello).
+ */
+type tlsTestServer struct {
+	*httptest.Server
+	lock  sync.Mutex
+	names []string
+	hello tls.ClientHelloInfo
+}
+
+//---------------------------------------------------------------------
+/*
+ * Start a HTTPS test server.
+ * @return *tlsTestServer - running test server
+ */
+func startTLSServer() *tlsTestServer {
+	ts := new(tlsTestServer)
+	ts.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("cover"))
+	}))
+	ts.Server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			ts.lock.Lock()
+			ts.names = append(ts.names, hello.ServerName)
+			ts.hello = *hello
+			ts.lock.Unlock()
+			return nil, nil
+		},
+	}
+	ts.StartTLS()
+	return ts
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get last server name requested by a client.
+ * @return string - server name ("": no SNI)
+ */
+func (ts *tlsTestServer) lastName() string {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if len(ts.names) == 0 {
+		return "<none>"
+	}
+	return ts.names[len(ts.names)-1]
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a HTTPS cover instance for the test server that trusts the
+ * certificate of the test server.
+ * @param ts *tlsTestServer - test server
+ * @return *Cover - cover instance
+ */
+func (ts *tlsTestServer) cover() *Cover {
+	addr := ts.Listener.Addr().(*net.TCPAddr)
+	c := NewCover(addr.IP.String(), addr.Port, "https")
+	c.RootCAs = x509.NewCertPool()
+	c.RootCAs.AddCert(ts.Certificate())
+	return c
+}
+
+//---------------------------------------------------------------------
+/*
+ * Connect to the test server through TLS.
+ * @param ts *tlsTestServer - test server
+ * @param c *Cover - cover instance
+ * @return net.Conn - TLS connection
+ * @return error - error object (or nil)
+ */
+func (ts *tlsTestServer) dial(c *Cover) (net.Conn, error) {
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	tc, err := c.wrapTLS(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Server name indication: the configured server name (or the hostname)
+ * is sent to the server and used for certificate verification.
+ */
+func TestCoverTLSServerName(t *testing.T) {
+	ts := startTLSServer()
+	defer ts.Close()
+
+	// IP address as hostname: no SNI, certificate valid for the address
+	c := ts.cover()
+	conn, err := ts.dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if name := ts.lastName(); name != "" {
+		t.Fatalf("SNI '%s' sent for IP address", name)
+	}
+
+	// explicit server name
+	c = ts.cover()
+	c.ServerName = "example.com"
+	if conn, err = ts.dial(c); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if name := ts.lastName(); name != "example.com" {
+		t.Fatalf("SNI '%s' sent instead of 'example.com'", name)
+	}
+	state := conn.(*utls.UConn).ConnectionState()
+	if state.NegotiatedProtocol != "" && state.NegotiatedProtocol != "http/1.1" {
+		t.Fatalf("protocol '%s' negotiated", state.NegotiatedProtocol)
+	}
+
+	// server name not covered by the certificate
+	c = ts.cover()
+	c.ServerName = "www.example.org"
+	if _, err = ts.dial(c); err == nil {
+		t.Fatal("handshake with wrong server name succeeded")
+	}
+	if name := ts.lastName(); name != "www.example.org" {
+		t.Fatalf("SNI '%s' sent instead of 'www.example.org'", name)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * The ClientHello looks like that of a web browser (GREASE values and
+ * extensions a Go client doesn't send), but only offers HTTP/1.1.
+ */
+func TestCoverTLSClientHello(t *testing.T) {
+	ts := startTLSServer()
+	defer ts.Close()
+
+	conn, err := ts.dial(ts.cover())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	ts.lock.Lock()
+	hello := ts.hello
+	ts.lock.Unlock()
+
+	isGrease := func(v uint16) bool {
+		return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+	}
+	if len(hello.CipherSuites) == 0 || !isGrease(hello.CipherSuites[0]) {
+		t.Fatalf("cipher suites %04x offered", hello.CipherSuites)
+	}
+	grease, compress := false, false
+	for _, ext := range hello.Extensions {
+		grease = grease || isGrease(ext)
+		// compress_certificate (RFC 8879)
+		compress = compress || ext == 27
+	}
+	if !grease || !compress {
+		t.Fatalf("extensions %v offered", hello.Extensions)
+	}
+	if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != "http/1.1" {
+		t.Fatalf("protocols %v offered", hello.SupportedProtos)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * TLS sessions are never resumed (connections of different clients
+ * can't be linked).
+ */
+func TestCoverTLSNoResumption(t *testing.T) {
+	ts := startTLSServer()
+	defer ts.Close()
+
+	c := ts.cover()
+	for i := 0; i < 3; i++ {
+		conn, err := ts.dial(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// read session tickets (sent after the handshake in TLS 1.3)
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"))
+		ioutil.ReadAll(conn)
+		state := conn.(*utls.UConn).ConnectionState()
+		conn.Close()
+		if state.DidResume {
+			t.Fatalf("connection %d: TLS session resumed", i)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Untrusted server certificates are rejected (even if pinned).
+ */
+func TestCoverTLSUntrusted(t *testing.T) {
+	ts := startTLSServer()
+	defer ts.Close()
+
+	c := ts.cover()
+	c.RootCAs = x509.NewCertPool()
+	c.Pins = []string{PublicKeyPin(ts.Certificate())}
+	if _, err := ts.dial(c); err == nil {
+		t.Fatal("handshake with untrusted certificate succeeded")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Pinned public keys: the connection succeeds if one of the pins
+ * matches the certificate chain of the server.
+ */
+func TestCoverTLSPinMatch(t *testing.T) {
+	ts := startTLSServer()
+	defer ts.Close()
+
+	other := sha256.Sum256([]byte("backup key"))
+	c := ts.cover()
+	if err := c.AddPin(base64.StdEncoding.EncodeToString(other[:])); err != nil {
+		t.Fatal(err)
+	}
+	// unpadded pin with prefix (as used in the configuration file)
+	pin := strings.TrimRight(PublicKeyPin(ts.Certificate()), "=")
+	if err := c.AddPin("sha256/" + pin); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ts.dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the connection is usable
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d from cover server", resp.StatusCode)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Pinned public keys: the handshake fails if no pin matches.
+ */
+func TestCoverTLSPinMismatch(t *testing.T) {
+	ts := startTLSServer()
+	defer ts.Close()
+
+	other := sha256.Sum256([]byte("some other key"))
+	c := ts.cover()
+	if err := c.AddPin(base64.StdEncoding.EncodeToString(other[:])); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ts.dial(c)
+	if err == nil {
+		t.Fatal("handshake with pin mismatch succeeded")
+	}
+	if !strings.Contains(err.Error(), "pin mismatch") {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// connect through the cover instance
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+	if conn := c.connect(client); conn != nil {
+		conn.Close()
+		t.Fatal("connected to cover server with pin mismatch")
+	}
+	if n := c.States.Count(); n != 0 {
+		t.Fatalf("%d sessions after failed connect", n)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Pins added after the first connection are checked for new
+ * connections.
+ */
+func TestCoverTLSPinAdded(t *testing.T) {
+	ts := startTLSServer()
+	defer ts.Close()
+
+	c := ts.cover()
+	conn, err := ts.dial(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	other := sha256.Sum256([]byte("some other key"))
+	if err = c.AddPin(base64.StdEncoding.EncodeToString(other[:])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ts.dial(c); err == nil {
+		t.Fatal("handshake with pin mismatch succeeded")
+	}
+	if err = c.AddPin(PublicKeyPin(ts.Certificate())); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err = ts.dial(c); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Pin verification without a matching certificate.
+ */
+func TestVerifyPins(t *testing.T) {
+	ts := startTLSServer()
+	defer ts.Close()
+	cert := ts.Certificate()
+
+	c := NewCover("example.com", 443, "https")
+	other := sha256.Sum256([]byte("some other key"))
+	c.Pins = []string{base64.StdEncoding.EncodeToString(other[:])}
+
+	// no verified chains
+	if c.verifyPins(nil, nil) == nil {
+		t.Fatal("pin verified without certificate chain")
+	}
+	if c.verifyPins([][]byte{cert.Raw}, [][]*x509.Certificate{{}}) == nil {
+		t.Fatal("pin verified with empty certificate chain")
+	}
+	// chain without pinned key
+	chains := [][]*x509.Certificate{{cert}}
+	if c.verifyPins([][]byte{cert.Raw}, chains) == nil {
+		t.Fatal("pin verified for wrong key")
+	}
+	// pin of the raw certificate only counts in a verified chain
+	c.Pins = append(c.Pins, PublicKeyPin(cert))
+	if c.verifyPins([][]byte{cert.Raw}, nil) == nil {
+		t.Fatal("pin verified for unverified certificate")
+	}
+	if err := c.verifyPins([][]byte{cert.Raw}, chains); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Invalid pin specifications are rejected.
+ */
+func TestAddPin(t *testing.T) {
+	c := NewCover("example.com", 443, "https")
+	for _, pin := range []string{
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte("too short")),
+		"",
+	} {
+		if c.AddPin(pin) == nil {
+			t.Fatalf("invalid pin '%s' accepted", pin)
+		}
+	}
+	if len(c.Pins) != 0 {
+		t.Fatal("invalid pins added")
+	}
+
+	pool := NewCoverPool(nil)
+	pool.Add(c, 1)
+	if ApplyCoverPins(pool, []string{"example.com"}) == nil {
+		t.Fatal("pin specification without pin accepted")
+	}
+	h := sha256.Sum256([]byte("key"))
+	pin := base64.StdEncoding.EncodeToString(h[:])
+	if err := ApplyCoverPins(pool, []string{"EXAMPLE.com;" + pin, "unknown.org;" + pin}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Pins) != 1 || c.Pins[0] != pin {
+		t.Fatalf("pins %v applied", c.Pins)
+	}
+}
@@ -0,0 +1,557 @@
+/*
+ * Control protocol: Commands of a control session are single lines
+ * with a command name followed by optional (space-separated) arguments.
+ * Every command is answered with a reply in the selected format
+ * (key=value lines or single-line JSON objects) so that control
+ * sessions can easily be driven by scripts.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bfix/gospel/logger"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Local types and variables
+
+/*
+ * Names of logging levels (in ascending verbosity).
+ */
+var logLevels = []string{"ERROR", "WARN", "INFO", "DBG_HIGH", "DBG", "DBG_ALL"}
+
+//---------------------------------------------------------------------
+/*
+ * State of a control session.
+ */
+type ctrlSession struct {
+	rw     *bufio.ReadWriter // connection to client
+	json   bool              // reply in JSON format?
+	quit   bool              // end control session?
+	action func()            // action to perform after reply is sent
+}
+
+//---------------------------------------------------------------------
+/*
+ * Named value in a reply.
+ */
+type ctrlField struct {
+	Key   string      // name of value
+	Value interface{} // value (string, int, bool)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Reply to a control command: A reply consists of a status, an optional
+ * message, a list of values and an optional list of records (e.g. the
+ * list of sessions).
+ *
+ * Key=value format:
+ *     OK|ERR [<message>]
+ *     <key>=<value>                  (for every value)
+ *     <key>=<value> <key>=<value>... (for every record)
+ *     .
+ * Values containing white spaces, quotes or '=' are quoted.
+ *
+ * JSON format (single line):
+ *     {"status":"OK|ERR","message":...,"data":{...},"items":[{...},...]}
+ */
+type ctrlReply struct {
+	ok     bool          // successful command?
+	msg    string        // optional message
+	fields []ctrlField   // list of values
+	items  [][]ctrlField // list of records
+}
+
+//---------------------------------------------------------------------
+/*
+ * Control command definition.
+ */
+type ctrlCommand struct {
+	Usage   string // usage of command
+	Help    string // short description of command
+	MinArgs int    // min. number of arguments
+	MaxArgs int    // max. number of arguments
+	Handler func(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply
+}
+
+//---------------------------------------------------------------------
+/*
+ * List of available control commands.
+ */
+var ctrlCommands map[string]*ctrlCommand
+
+//---------------------------------------------------------------------
+/*
+ * Initialize command table (the HELP command references the table).
+ */
+func init() {
+	ctrlCommands = map[string]*ctrlCommand{
+		"HELP":      {"HELP", "list available commands", 0, 0, cmdHelp},
+		"STATUS":    {"STATUS", "show status of SID instance", 0, 0, cmdStatus},
+		"SESSIONS":  {"SESSIONS", "list active sessions", 0, 0, cmdSessions},
+		"KILL":      {"KILL <id>", "terminate an active session", 1, 1, cmdKill},
+		"RELOAD":    {"RELOAD", "reload configuration file", 0, 0, cmdReload},
+		"LOGLEVEL":  {"LOGLEVEL [<level>]", "show or set logging level", 0, 1, cmdLogLevel},
+		"REVIEWERS": {"REVIEWERS", "list reviewer keys", 0, 0, cmdReviewers},
+		"REVIEWER":  {"REVIEWER ADD|REMOVE <id>", "add (ASCII-armored key follows) or remove a reviewer key", 1, 2, cmdReviewer},
+		"SHUTDOWN":  {"SHUTDOWN", "terminate SID instance", 0, 0, cmdShutdown},
+		"FORMAT":    {"FORMAT KV|JSON", "select reply format", 1, 1, cmdFormat},
+		"MENU":      {"MENU", "switch to interactive menu", 0, 0, cmdMenu},
+		"QUIT":      {"QUIT", "end control session", 0, 0, cmdQuit},
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+// Reply handling
+
+/*
+ * Create a successful reply.
+ * @param msg string - optional message
+ * @return *ctrlReply - new reply
+ */
+func ctrlOk(msg string) *ctrlReply {
+	return &ctrlReply{ok: true, msg: msg}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create an error reply.
+ * @param msg string - error message
+ * @return *ctrlReply - new reply
+ */
+func ctrlError(msg string) *ctrlReply {
+	return &ctrlReply{ok: false, msg: msg}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Add a value to the reply.
+ * @param key string - name of value
+ * @param val interface{} - value
+ * @return *ctrlReply - same reply (for chaining)
+ */
+func (r *ctrlReply) add(key string, val interface{}) *ctrlReply {
+	r.fields = append(r.fields, ctrlField{key, val})
+	return r
+}
+
+//---------------------------------------------------------------------
+/*
+ * Add a record to the reply.
+ * @param rec []ctrlField - record
+ */
+func (r *ctrlReply) addItem(rec []ctrlField) {
+	r.items = append(r.items, rec)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write reply in the requested format.
+ * @param b *bufio.ReadWriter - connection to client
+ * @param asJSON bool - use JSON format?
+ */
+func (r *ctrlReply) write(b *bufio.ReadWriter, asJSON bool) {
+	status := "OK"
+	if !r.ok {
+		status = "ERR"
+	}
+	if asJSON {
+		b.WriteString("{\"status\":" + jsonValue(status))
+		if len(r.msg) > 0 {
+			b.WriteString(",\"message\":" + jsonValue(r.msg))
+		}
+		if len(r.fields) > 0 {
+			b.WriteString(",\"data\":" + jsonObject(r.fields))
+		}
+		if r.items != nil {
+			list := make([]string, len(r.items))
+			for i, rec := range r.items {
+				list[i] = jsonObject(rec)
+			}
+			b.WriteString(",\"items\":[" + strings.Join(list, ",") + "]")
+		}
+		b.WriteString("}\n")
+		return
+	}
+	if len(r.msg) > 0 {
+		status += " " + r.msg
+	}
+	b.WriteString(status + "\n")
+	for _, f := range r.fields {
+		b.WriteString(kvValue(f) + "\n")
+	}
+	for _, rec := range r.items {
+		list := make([]string, len(rec))
+		for i, f := range rec {
+			list[i] = kvValue(f)
+		}
+		b.WriteString(strings.Join(list, " ") + "\n")
+	}
+	b.WriteString(".\n")
+}
+
+//---------------------------------------------------------------------
+/*
+ * Format a field as "key=value" (quoted value if required).
+ * @param f ctrlField - field
+ * @return string - formatted field
+ */
+func kvValue(f ctrlField) string {
+	val := fmt.Sprint(f.Value)
+	if len(val) == 0 || strings.ContainsAny(val, " \t\r\n\"=") {
+		val = strconv.Quote(val)
+	}
+	return f.Key + "=" + val
+}
+
+//---------------------------------------------------------------------
+/*
+ * Format a list of fields as JSON object (keeps order of fields).
+ * @param list []ctrlField - list of fields
+ * @return string - JSON object
+ */
+func jsonObject(list []ctrlField) string {
+	out := make([]string, len(list))
+	for i, f := range list {
+		out[i] = jsonValue(f.Key) + ":" + jsonValue(f.Value)
+	}
+	return "{" + strings.Join(out, ",") + "}"
+}
+
+//---------------------------------------------------------------------
+/*
+ * Format a value as JSON.
+ * @param val interface{} - value
+ * @return string - JSON representation
+ */
+func jsonValue(val interface{}) string {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return "null"
+	}
+	return string(data)
+}
+
+///////////////////////////////////////////////////////////////////////
+// Command handlers
+
+/*
+ * HELP: list available commands.
+ */
+func cmdHelp(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	names := make([]string, 0, len(ctrlCommands))
+	for name := range ctrlCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	r := ctrlOk("")
+	r.items = make([][]ctrlField, 0)
+	for _, name := range names {
+		cmd := ctrlCommands[name]
+		r.addItem([]ctrlField{{"command", cmd.Usage}, {"help", cmd.Help}})
+	}
+	return r
+}
+
+//---------------------------------------------------------------------
+/*
+ * STATUS: show status of SID instance.
+ */
+func cmdStatus(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	covers, sessions := 0, 0
+	if c.pool != nil {
+		for _, cover := range c.pool.Covers() {
+			covers++
+			sessions += cover.States.Count()
+		}
+	}
+	cfg := GetConfig()
+	return ctrlOk("").
+		add("version", SID_VERSION).
+		add("uptime", int64(time.Since(c.started)/time.Second)).
+		add("loglevel", logger.GetLogLevel()).
+		add("covers", covers).
+		add("sessions", sessions).
+		add("ctrl_port", cfg.CtrlPort).
+		add("http_port", cfg.HttpPort).
+		add("https_port", cfg.HttpsPort)
+}
+
+//---------------------------------------------------------------------
+/*
+ * SESSIONS: list active sessions (summary of session states).
+ */
+func cmdSessions(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	r := ctrlOk("")
+	r.items = make([][]ctrlField, 0)
+	if c.pool != nil {
+		for _, cover := range c.pool.Covers() {
+			name := cover.Protocol + "://" + cover.Name + ":" + strconv.Itoa(cover.Port)
+			for _, state := range cover.States.List() {
+				info := state.Summary()
+				r.addItem([]ctrlField{
+					{"id", info.Id},
+					{"cover", name},
+					{"client", info.Client},
+					{"age", int64(time.Since(info.Started) / time.Second)},
+					{"mode", info.Mode},
+					{"resource", info.Resource},
+					{"bytes_in", info.BytesIn},
+					{"bytes_out", info.BytesOut},
+					{"post_pos", info.PostPos},
+					{"post_size", info.PostSize},
+					{"upload", info.Upload},
+					{"uploads", info.UploadCount},
+					{"upload_ok", info.UploadOK},
+				})
+			}
+		}
+	}
+	return r.add("total", len(r.items))
+}
+
+//---------------------------------------------------------------------
+/*
+ * KILL <id>: terminate an active session.
+ */
+func cmdKill(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return ctrlError("invalid session id '" + args[0] + "'")
+	}
+	if c.pool != nil {
+		for _, cover := range c.pool.Covers() {
+			if state := cover.States.Find(id); state != nil {
+				state.Kill()
+				logger.Printf(logger.WARN, "[sid.ctrl] Session %d terminated\n", id)
+				return ctrlOk("").add("id", id)
+			}
+		}
+	}
+	return ctrlError("unknown session " + args[0])
+}
+
+//---------------------------------------------------------------------
+/*
+ * LOGLEVEL [<level>]: show or set logging level.
+ */
+func cmdLogLevel(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	if len(args) == 1 {
+		level := strings.ToUpper(args[0])
+		valid := false
+		for _, l := range logLevels {
+			if l == level {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return ctrlError("invalid log level '" + args[0] + "' (" + strings.Join(logLevels, ",") + ")")
+		}
+		logger.SetLogLevelFromName(level)
+		logger.Println(logger.WARN, "[sid.ctrl] log level set to "+level)
+	}
+	return ctrlOk("").add("loglevel", logger.GetLogLevel())
+}
+
+//---------------------------------------------------------------------
+/*
+ * REVIEWERS: list reviewer keys.
+ */
+func cmdReviewers(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	reg, r := ctrlReviewers()
+	if reg == nil {
+		return r
+	}
+	r.items = make([][]ctrlField, 0)
+	for _, rev := range reg.List() {
+		r.addItem(reviewerRecord(rev))
+	}
+	return r.add("total", len(r.items))
+}
+
+//---------------------------------------------------------------------
+/*
+ * REVIEWER ADD|REMOVE <id>: add or remove a reviewer key. The command
+ * "REVIEWER ADD" is followed by lines with an ASCII-armored public key
+ * (up to the "-----END PGP PUBLIC KEY BLOCK-----" line).
+ */
+func cmdReviewer(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	switch strings.ToUpper(args[0]) {
+	case "ADD":
+		data, err := readKeyBlock(s.rw)
+		if err != nil {
+			return ctrlError(err.Error())
+		}
+		reg, r := ctrlReviewers()
+		if reg == nil {
+			return r
+		}
+		added, err := reg.Add(data)
+		if err != nil {
+			return ctrlError(err.Error())
+		}
+		r.items = make([][]ctrlField, 0)
+		for _, rev := range added {
+			r.addItem(reviewerRecord(rev))
+		}
+		return r.add("added", len(added))
+	case "REMOVE":
+		if len(args) < 2 {
+			return ctrlError("usage: REVIEWER REMOVE <id>")
+		}
+		reg, r := ctrlReviewers()
+		if reg == nil {
+			return r
+		}
+		rev, deleted, err := reg.Remove(args[1])
+		if err != nil {
+			return ctrlError(err.Error())
+		}
+		return r.add("id", rev.Id).add("fingerprint", rev.Fingerprint).add("deleted", deleted)
+	}
+	return ctrlError("unknown operation '" + args[0] + "'")
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get reviewer registry of the current document handler.
+ * @return *ReviewerRegistry - reviewer registry (or nil)
+ * @return *ctrlReply - reply (error reply if no registry is available)
+ */
+func ctrlReviewers() (*ReviewerRegistry, *ctrlReply) {
+	h := GetDocumentHandler()
+	if h == nil || h.Reviewers() == nil {
+		return nil, ctrlError("secret sharing disabled")
+	}
+	return h.Reviewers(), ctrlOk("")
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get record describing a reviewer.
+ * @param rev *Reviewer - reviewer
+ * @return []ctrlField - record
+ */
+func reviewerRecord(rev *Reviewer) []ctrlField {
+	exp := "never"
+	if !rev.Expires.IsZero() {
+		exp = rev.Expires.Format("2006-01-02")
+	}
+	return []ctrlField{
+		{"id", rev.Id},
+		{"fingerprint", rev.Fingerprint},
+		{"name", rev.Name},
+		{"expires", exp},
+		{"source", rev.Source},
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read an ASCII-armored key block from a control session.
+ * @param b *bufio.ReadWriter - connection to client
+ * @return []byte - key block
+ * @return error - error object (or nil)
+ */
+func readKeyBlock(b *bufio.ReadWriter) ([]byte, error) {
+	data := make([]byte, 0)
+	for {
+		line, err := readLine(b, REVIEWER_MAX_KEYSIZE-len(data))
+		if err == ErrCmdSize {
+			return nil, errors.New("key block too large")
+		} else if err != nil {
+			return nil, errors.New("incomplete key block")
+		}
+		data = append(data, line...)
+		if strings.TrimSpace(string(line)) == "-----END PGP PUBLIC KEY BLOCK-----" {
+			return data, nil
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * RELOAD: reload configuration file (applies to new sessions).
+ */
+func cmdReload(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	if err := ReloadConfig(); err != nil {
+		return ctrlError("reload failed: " + err.Error())
+	}
+	return ctrlOk("").add("config", GetConfig().CfgFile)
+}
+
+//---------------------------------------------------------------------
+/*
+ * SHUTDOWN: terminate SID instance (after the reply is sent).
+ */
+func cmdShutdown(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	logger.Println(logger.WARN, "[sid.ctrl] Terminating application")
+	s.quit = true
+	s.action = c.terminate
+	return ctrlOk("terminating")
+}
+
+//---------------------------------------------------------------------
+/*
+ * FORMAT KV|JSON: select reply format for the session.
+ */
+func cmdFormat(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	switch strings.ToUpper(args[0]) {
+	case "KV":
+		s.json = false
+	case "JSON":
+		s.json = true
+	default:
+		return ctrlError("unknown format '" + args[0] + "'")
+	}
+	return ctrlOk("").add("format", strings.ToUpper(args[0]))
+}
+
+//---------------------------------------------------------------------
+/*
+ * MENU: switch to the interactive menu (no reply).
+ */
+func cmdMenu(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	s.quit = c.menu(s.rw)
+	if s.quit {
+		return nil
+	}
+	return ctrlOk("command mode")
+}
+
+//---------------------------------------------------------------------
+/*
+ * QUIT: end control session.
+ */
+func cmdQuit(c *ControlSrv, s *ctrlSession, args []string) *ctrlReply {
+	s.quit = true
+	return ctrlOk("bye")
+}
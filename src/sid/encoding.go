@@ -0,0 +1,616 @@
+/*
+ * Content encodings of cover server responses: Compressed response
+ * content (gzip, deflate, brotli) is decoded on the fly for tag
+ * extraction; the substituted content is wrapped in uncompressed
+ * blocks of the same encoding, so that the size of every response
+ * packet sent to the client matches the compressed cover response.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"github.com/andybalholm/brotli"
+	"github.com/bfix/gospel/logger"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	//-----------------------------------------------------------------
+	// Supported content encodings
+	//-----------------------------------------------------------------
+	CE_GZIP    = iota // gzip (RFC 1952)
+	CE_DEFLATE        // deflate with zlib wrapper (RFC 1950)
+	CE_BROTLI         // brotli (RFC 7932)
+
+	// max. size of compressed content decoded for tag extraction
+	MAX_DECODE_SIZE = 4 * 1024 * 1024
+	// min. size of content in an encoded block
+	MIN_BLOCK_SIZE = 32
+)
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Content coder for a single (compressed) response body.
+ */
+type ContentCoder struct {
+	Encoding int            // content encoding (CE_*)
+	head     []byte         // content received before wrapper detection
+	fed      int            // number of compressed bytes received
+	dec      *streamDecoder // decoder for compressed content
+	broken   bool           // decoding failed or stopped (content too large)
+	detect   bool           // "deflate" encoding: wrapper not detected yet
+	raw      bool           // "deflate" encoding without zlib wrapper?
+
+	out      []byte      // encoded output not yet sent
+	check    hash.Hash32 // checksum of encoded content (gzip, zlib)
+	size     uint32      // size of encoded content (gzip)
+	started  bool        // stream header written?
+	window   bool        // window size written (brotli)?
+	complete bool        // all content encoded?
+	finished bool        // stream closed?
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new content coder for given "Content-Encoding".
+ * @param enc string - content encoding of response
+ * @return *ContentCoder - new coder instance (nil if unsupported)
+ */
+func NewContentCoder(enc string) *ContentCoder {
+	cc := &ContentCoder{
+		out: make([]byte, 0),
+	}
+	switch strings.ToLower(strings.TrimSpace(enc)) {
+	case "gzip", "x-gzip":
+		cc.Encoding = CE_GZIP
+		cc.check = crc32.NewIEEE()
+	case "deflate":
+		// "deflate" should be zlib-wrapped, but some servers send
+		// raw deflate data: the wrapper is detected on decoding.
+		cc.Encoding = CE_DEFLATE
+		cc.detect = true
+		cc.check = adler32.New()
+	case "br":
+		cc.Encoding = CE_BROTLI
+	default:
+		return nil
+	}
+	return cc
+}
+
+//---------------------------------------------------------------------
+/*
+ * Decode next fragment of compressed content. The content is decoded
+ * incrementally: the fragment is completely processed when the method
+ * returns, but a decoder can hold back decoded content until it has
+ * received more input (e.g. the end of a compressed block).
+ * @param data []byte - compressed content
+ * @return []byte - newly decoded content
+ */
+func (cc *ContentCoder) Decode(data []byte) []byte {
+	if cc.broken || len(data) == 0 {
+		return nil
+	}
+	if cc.fed += len(data); cc.fed > MAX_DECODE_SIZE {
+		logger.Println(logger.WARN, "[sid.encoding] Compressed content too large -- decoding stopped")
+		cc.Close()
+		return nil
+	}
+	// start decoder
+	if cc.dec == nil {
+		// detect wrapper of "deflate" content
+		if cc.detect {
+			if cc.head = append(cc.head, data...); len(cc.head) < 2 {
+				return nil
+			}
+			cc.raw = (cc.head[0]&0x0f != 8 || binary.BigEndian.Uint16(cc.head)%31 != 0)
+			cc.detect = false
+			data, cc.head = cc.head, nil
+		}
+		cc.dec = newStreamDecoder(cc.reader)
+	}
+	out := cc.dec.feed(data)
+	if cc.dec.done && cc.dec.err != io.EOF {
+		logger.Println(logger.ERROR, "[sid.encoding] Invalid compressed content: "+cc.dec.err.Error())
+		cc.broken = true
+	}
+	return out
+}
+
+//---------------------------------------------------------------------
+/*
+ * Release resources of the coder: a running decoder is stopped (and
+ * no more content is decoded).
+ */
+func (cc *ContentCoder) Close() {
+	if cc.dec != nil {
+		cc.dec.close()
+	}
+	cc.broken = true
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get decompressing reader for encoded content.
+ * @param r io.Reader - compressed content
+ * @return io.Reader - decoded content
+ * @return error - error object (or nil)
+ */
+func (cc *ContentCoder) reader(r io.Reader) (io.Reader, error) {
+	switch cc.Encoding {
+	case CE_GZIP:
+		// the body is a single gzip member: the reader must not wait
+		// for the header of a following member.
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		return zr, nil
+	case CE_DEFLATE:
+		if cc.raw {
+			return flate.NewReader(r), nil
+		}
+		return zlib.NewReader(r)
+	}
+	return brotli.NewReader(r), nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get number of bytes that must be reserved at the end of a response
+ * body to close the encoded stream.
+ * @return int - number of reserved bytes
+ */
+func (cc *ContentCoder) Reserve() int {
+	// closing sequence, (deflate) fillers, two content blocks
+	// and data not yet sent.
+	return cc.finishSize() + 2*cc.overhead() + 2*(MIN_BLOCK_SIZE+cc.overhead()) + len(cc.out)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Encode content for a fragment of given size: the content is provided
+ * by a generator function (called with the max. size of the content and
+ * returning the content and a flag if all content has been generated).
+ * If the remaining size of the response body is known, the stream is
+ * closed as soon as the content is complete (or the body is about to
+ * end); the closing sequence is padded to the end of the body.
+ * @param n int - size of fragment
+ * @param rem int - size of response body after fragment (-1 if unknown)
+ * @param gen func(int) ([]byte, bool) - content generator
+ * @return []byte - encoded fragment of size 'n'
+ */
+func (cc *ContentCoder) Encode(n, rem int, gen func(int) ([]byte, bool)) []byte {
+	if !cc.started {
+		cc.out = append(cc.out, cc.header()...)
+		cc.started = true
+	}
+	for !cc.finished && len(cc.out) < n {
+		need := n - len(cc.out)
+		// close the stream if possible
+		if rem >= 0 {
+			budget := need + rem
+			if budget >= cc.finishSize() && (cc.complete || budget <= cc.finishSize()+2*cc.overhead()) {
+				cc.out = append(cc.out, cc.finish(budget)...)
+				cc.finished = true
+				break
+			}
+		}
+		// add next content block (small blocks are carried over to
+		// the next fragment)
+		size := need - cc.overhead()
+		if size < MIN_BLOCK_SIZE {
+			size = MIN_BLOCK_SIZE
+		}
+		if rem >= 0 && size > need+rem-cc.finishSize()-2*cc.overhead() {
+			size = need + rem - cc.finishSize() - 2*cc.overhead()
+		}
+		if max := cc.maxBlock(); size > max {
+			size = max
+		}
+		var data []byte
+		if data, cc.complete = gen(size); len(data) == 0 {
+			if cc.complete && rem >= 0 {
+				// close the stream in the next round
+				continue
+			}
+			// fill fragment (leave room to close the stream)
+			fill := need
+			if rem >= 0 && fill > need+rem-cc.finishSize() {
+				fill = need + rem - cc.finishSize()
+			}
+			cc.out = append(cc.out, cc.filler(fill)...)
+			continue
+		}
+		cc.out = append(cc.out, cc.block(data, false)...)
+	}
+	if len(cc.out) < n {
+		// stream already closed: should not happen
+		logger.Printf(logger.WARN, "[sid.encoding] Encoded stream closed -- %d bytes appended\n", n-len(cc.out))
+		cc.out = append(cc.out, make([]byte, n-len(cc.out))...)
+	}
+	res := cc.out[:n]
+	cc.out = cc.out[n:]
+	return res
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if the encoded stream is closed.
+ * @return bool - stream closed (and all data delivered)?
+ */
+func (cc *ContentCoder) Finished() bool {
+	return cc.finished && len(cc.out) == 0
+}
+
+///////////////////////////////////////////////////////////////////////
+// Block-level encoding (uncompressed blocks only)
+
+/*
+ * Get size of block framing.
+ * @return int - number of framing bytes per block
+ */
+func (cc *ContentCoder) overhead() int {
+	if cc.Encoding == CE_BROTLI {
+		return 3
+	}
+	return 5
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get max. size of block content.
+ * @return int - max. number of content bytes per block
+ */
+func (cc *ContentCoder) maxBlock() int {
+	if cc.Encoding == CE_BROTLI {
+		return 65536
+	}
+	return 65535
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get min. size of the closing sequence.
+ * @return int - number of bytes required to close the stream
+ */
+func (cc *ContentCoder) finishSize() int {
+	switch cc.Encoding {
+	case CE_GZIP:
+		return 5 + 8
+	case CE_DEFLATE:
+		return 5 + 4
+	}
+	return 1
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get stream header.
+ * @return []byte - stream header
+ */
+func (cc *ContentCoder) header() []byte {
+	switch cc.Encoding {
+	case CE_GZIP:
+		// no timestamp, no flags, unknown OS
+		return []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+	case CE_DEFLATE:
+		// 32k window, no dictionary, fastest compression
+		return []byte{0x78, 0x01}
+	}
+	// brotli: window size is encoded with the first meta-block
+	return []byte{}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Encode content as a single uncompressed block.
+ * @param data []byte - block content (max. 'maxBlock()' bytes)
+ * @param last bool - final block (gzip, deflate only)?
+ * @return []byte - encoded block
+ */
+func (cc *ContentCoder) block(data []byte, last bool) []byte {
+	if cc.check != nil {
+		cc.check.Write(data)
+	}
+	cc.size += uint32(len(data))
+
+	if cc.Encoding == CE_BROTLI {
+		// uncompressed meta-block: ISLAST=0, MNIBBLES=4, MLEN-1,
+		// ISUNCOMPRESSED=1 (padded to byte boundary)
+		bw := cc.brotliBits()
+		bw.put(0, 1)
+		bw.put(0, 2)
+		bw.put(uint(len(data)-1), 16)
+		bw.put(1, 1)
+		return append(bw.bytes(), data...)
+	}
+	// stored deflate block: BFINAL, BTYPE=00, LEN, NLEN
+	hdr := make([]byte, 5)
+	if last {
+		hdr[0] = 1
+	}
+	binary.LittleEndian.PutUint16(hdr[1:], uint16(len(data)))
+	binary.LittleEndian.PutUint16(hdr[3:], ^uint16(len(data)))
+	return append(hdr, data...)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Generate a filler sequence without content. Deflate streams can only
+ * be filled in units of an empty block, so the filler can be larger
+ * than requested.
+ * @param n int - requested size of filler
+ * @return []byte - filler sequence
+ */
+func (cc *ContentCoder) filler(n int) []byte {
+	if cc.Encoding != CE_BROTLI {
+		return cc.block([]byte{}, false)
+	}
+	out := make([]byte, 0, n)
+	for i := 0; i < n; i++ {
+		// empty metadata meta-block: ISLAST=0, MNIBBLES=0,
+		// reserved bit, MSKIPBYTES=0 (padded to byte boundary)
+		bw := cc.brotliBits()
+		bw.put(0, 1)
+		bw.put(3, 2)
+		bw.put(0, 1)
+		bw.put(0, 2)
+		out = append(out, bw.bytes()...)
+	}
+	return out
+}
+
+//---------------------------------------------------------------------
+/*
+ * Close the stream with a closing sequence of given size (padded with
+ * white space content).
+ * @param n int - size of closing sequence (min. 'finishSize()' bytes)
+ * @return []byte - closing sequence
+ */
+func (cc *ContentCoder) finish(n int) []byte {
+	out := make([]byte, 0, n)
+	if cc.Encoding == CE_BROTLI {
+		// content blocks and fillers up to the final meta-block
+		for r := n - 1; r > 0; {
+			if r < 4 {
+				out = append(out, cc.filler(r)...)
+				break
+			}
+			m := r - 3
+			if m > 65536 {
+				m = 65536
+			}
+			out = append(out, cc.block(bytes.Repeat([]byte(" "), m), false)...)
+			r -= 3 + m
+		}
+		// final meta-block: ISLAST=1, ISLASTEMPTY=1
+		bw := cc.brotliBits()
+		bw.put(1, 1)
+		bw.put(1, 1)
+		return append(out, bw.bytes()...)
+	}
+	// stored blocks up to the final stored block
+	r := n - (cc.finishSize() - 5)
+	for r > 5+65535 {
+		m := r - 10
+		if m > 65535 {
+			m = 65535
+		}
+		out = append(out, cc.block(bytes.Repeat([]byte(" "), m), false)...)
+		r -= 5 + m
+	}
+	out = append(out, cc.block(bytes.Repeat([]byte(" "), r-5), true)...)
+
+	// add trailer
+	switch cc.Encoding {
+	case CE_GZIP:
+		tr := make([]byte, 8)
+		binary.LittleEndian.PutUint32(tr, cc.check.Sum32())
+		binary.LittleEndian.PutUint32(tr[4:], cc.size)
+		out = append(out, tr...)
+	case CE_DEFLATE:
+		out = append(out, cc.check.Sum(nil)...)
+	}
+	return out
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get bit writer for the next brotli meta-block header (the first
+ * header is preceded by the window size).
+ * @return *bitWriter - new bit writer
+ */
+func (cc *ContentCoder) brotliBits() *bitWriter {
+	bw := &bitWriter{}
+	if !cc.window {
+		// WBITS=16
+		bw.put(0, 1)
+		cc.window = true
+	}
+	return bw
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Incremental decoder: the decompressing reader runs in its own
+ * go-routine and reads the compressed content from the decoder. A
+ * fragment is handed over when the reader waits for input; the next
+ * request for input (or the end of the reader) signals that the
+ * fragment has been processed.
+ */
+type streamDecoder struct {
+	input chan []byte // fragments of compressed content
+	ready chan bool   // reader waits for input (closed on exit)
+	buf   []byte      // unread data of current fragment
+	out   []byte      // decoded content not yet delivered
+	err   error       // error that terminated the reader
+	done  bool        // reader terminated?
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create and start a new incremental decoder.
+ * @param open func(io.Reader) (io.Reader, error) - create decompressing reader
+ * @return *streamDecoder - new decoder instance
+ */
+func newStreamDecoder(open func(io.Reader) (io.Reader, error)) *streamDecoder {
+	d := &streamDecoder{
+		input: make(chan []byte),
+		ready: make(chan bool),
+	}
+	go d.run(open)
+	d.wait()
+	return d
+}
+
+//---------------------------------------------------------------------
+/*
+ * Decoder loop (go-routine): collect decoded content until the reader
+ * fails or the compressed stream ends.
+ * @param open func(io.Reader) (io.Reader, error) - create decompressing reader
+ */
+func (d *streamDecoder) run(open func(io.Reader) (io.Reader, error)) {
+	defer close(d.ready)
+	rdr, err := open(d)
+	if err != nil {
+		d.err = err
+		return
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := rdr.Read(buf)
+		d.out = append(d.out, buf[:n]...)
+		if err != nil {
+			d.err = err
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read compressed content (called by the decompressing reader).
+ * @param p []byte - buffer
+ * @return int - number of bytes read
+ * @return error - error object (or nil)
+ */
+func (d *streamDecoder) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		d.ready <- true
+		data, ok := <-d.input
+		if !ok {
+			return 0, io.EOF
+		}
+		d.buf = data
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Wait until the reader needs more input or has terminated.
+ */
+func (d *streamDecoder) wait() {
+	if _, ok := <-d.ready; !ok {
+		d.done = true
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Decode a fragment of compressed content.
+ * @param data []byte - compressed content
+ * @return []byte - newly decoded content
+ */
+func (d *streamDecoder) feed(data []byte) []byte {
+	if !d.done {
+		d.input <- data
+		d.wait()
+	}
+	out := d.out
+	d.out = nil
+	return out
+}
+
+//---------------------------------------------------------------------
+/*
+ * Stop the decoder (the reader gets an end-of-file); undelivered
+ * content is discarded.
+ */
+func (d *streamDecoder) close() {
+	if !d.done {
+		close(d.input)
+		d.wait()
+	}
+	d.out = nil
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Bit writer (LSB first) for brotli headers.
+ */
+type bitWriter struct {
+	buf  []byte // written bytes
+	bits uint   // number of bits written
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write bits.
+ * @param val uint - value
+ * @param n uint - number of bits
+ */
+func (w *bitWriter) put(val, n uint) {
+	for i := uint(0); i < n; i++ {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if val&(1<<i) != 0 {
+			w.buf[w.bits/8] |= 1 << (w.bits % 8)
+		}
+		w.bits++
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get written bytes (padded with zero bits to byte boundary).
+ * @return []byte - written bytes
+ */
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
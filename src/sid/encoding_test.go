@@ -0,0 +1,332 @@
+/*
+ * Content encoding: round trip tests of the stored-block encoder (with
+ * the standard decoders) and of the incremental decoder (with the
+ * standard encoders).
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Generate test content (HTML-like, compressible).
+ * @param n int - size of content
+ * @return []byte - content
+ */
+func testContent(n int) []byte {
+	buf := new(bytes.Buffer)
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(buf, "<p>paragraph %d <img src=\"/img%d.png\"></p>\n", i, i%7)
+	}
+	return buf.Bytes()[:n]
+}
+
+//---------------------------------------------------------------------
+/*
+ * Decode content with the standard decoders.
+ * @param enc string - content encoding
+ * @param data []byte - encoded content
+ * @return []byte - decoded content
+ * @return error - error object (or nil)
+ */
+func stdDecode(enc string, data []byte) ([]byte, error) {
+	var (
+		rdr io.Reader
+		err error
+	)
+	switch enc {
+	case "gzip":
+		rdr, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		rdr, err = zlib.NewReader(bytes.NewReader(data))
+	case "raw":
+		rdr = flate.NewReader(bytes.NewReader(data))
+	case "br":
+		rdr = brotli.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(rdr)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Encode content with the standard encoders.
+ * @param enc string - content encoding
+ * @param data []byte - content
+ * @return []byte - encoded content
+ */
+func stdEncode(enc string, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	var wrt io.WriteCloser
+	switch enc {
+	case "gzip":
+		wrt = gzip.NewWriter(buf)
+	case "deflate":
+		wrt = zlib.NewWriter(buf)
+	case "raw":
+		wrt, _ = flate.NewWriter(buf, flate.BestCompression)
+	case "br":
+		wrt = brotli.NewWriter(buf)
+	}
+	wrt.Write(data)
+	wrt.Close()
+	return buf.Bytes()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Encode content into a body of given size (split into fragments).
+ * @param enc string - content encoding
+ * @param content []byte - content
+ * @param total int - size of body (-1: unknown)
+ * @param frags []int - sizes of fragments (repeated)
+ * @return []byte - encoded body
+ */
+func encodeBody(enc string, content []byte, total int, frags []int) []byte {
+	cc := NewContentCoder(enc)
+	pos := 0
+	gen := func(n int) ([]byte, bool) {
+		if n > len(content)-pos {
+			n = len(content) - pos
+		}
+		data := content[pos : pos+n]
+		pos += n
+		return data, pos == len(content)
+	}
+	out := make([]byte, 0)
+	for i := 0; total < 0 || len(out) < total; i++ {
+		n := frags[i%len(frags)]
+		rem := -1
+		if total >= 0 {
+			if n > total-len(out) {
+				n = total - len(out)
+			}
+			rem = total - len(out) - n
+		} else if pos == len(content) && cc.complete {
+			// unknown size: close the stream with the next fragment
+			n, rem = 1<<17, 0
+		}
+		out = append(out, cc.Encode(n, rem, gen)...)
+		if total < 0 && cc.Finished() {
+			break
+		}
+	}
+	return out
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Encoded bodies are decoded by the standard decoders: the content is
+ * followed by white space padding up to the end of the body.
+ */
+func TestEncodeRoundTrip(t *testing.T) {
+	content := testContent(150000)
+	for _, enc := range []string{"gzip", "deflate", "br"} {
+		for _, size := range []int{0, 1, 100, 65535, 65536, 65537, 150000} {
+			for _, frags := range [][]int{{1400}, {1, 7, 4096}, {32768}, {70000}} {
+				data := content[:size]
+				for _, total := range []int{-1, 2 * (size + 4096)} {
+					body := encodeBody(enc, data, total, frags)
+					if total >= 0 && len(body) != total {
+						t.Fatalf("%s/%d/%v: body size %d instead of %d", enc, size, frags, len(body), total)
+					}
+					out, err := stdDecode(enc, body)
+					if err != nil {
+						t.Fatalf("%s/%d/%v/%d: %s", enc, size, frags, total, err.Error())
+					}
+					if !bytes.HasPrefix(out, data) || len(bytes.TrimRight(out[size:], " ")) != 0 {
+						t.Fatalf("%s/%d/%v/%d: content mismatch", enc, size, frags, total)
+					}
+				}
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * The body is closed in time if the content doesn't fit: the decoded
+ * content is a prefix of the content.
+ */
+func TestEncodeTruncated(t *testing.T) {
+	content := testContent(10000)
+	for _, enc := range []string{"gzip", "deflate", "br"} {
+		for _, total := range []int{64, 100, 1000, 5000} {
+			for _, frags := range [][]int{{10}, {333}, {8192}} {
+				body := encodeBody(enc, content, total, frags)
+				if len(body) != total {
+					t.Fatalf("%s/%d/%v: body size %d", enc, total, frags, len(body))
+				}
+				out, err := stdDecode(enc, body)
+				if err != nil {
+					t.Fatalf("%s/%d/%v: %s", enc, total, frags, err.Error())
+				}
+				data := bytes.TrimRight(out, " ")
+				if !bytes.HasPrefix(content, data) {
+					t.Fatalf("%s/%d/%v: content mismatch", enc, total, frags)
+				}
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Stored blocks of the "deflate" encoder are valid raw deflate data.
+ */
+func TestEncodeStoredBlocks(t *testing.T) {
+	content := testContent(70000)
+	body := encodeBody("deflate", content, -1, []int{5000})
+	// strip zlib header and checksum
+	out, err := stdDecode("raw", body[2:len(body)-4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out, content) {
+		t.Fatal("content mismatch")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Content compressed by the standard encoders is decoded incrementally
+ * for any fragmentation.
+ */
+func TestDecodeFragments(t *testing.T) {
+	content := testContent(200000)
+	for _, enc := range []string{"gzip", "deflate", "raw", "br"} {
+		data := stdEncode(enc, content)
+		ce := enc
+		if enc == "raw" {
+			// raw deflate data is accepted for "deflate"
+			ce = "deflate"
+		}
+		for _, frag := range []int{1, 2, 3, 500, 4096, len(data)} {
+			cc := NewContentCoder(ce)
+			out := make([]byte, 0, len(content))
+			for pos := 0; pos < len(data); pos += frag {
+				end := pos + frag
+				if end > len(data) {
+					end = len(data)
+				}
+				out = append(out, cc.Decode(data[pos:end])...)
+			}
+			if cc.broken {
+				t.Fatalf("%s/%d: decoding failed", enc, frag)
+			}
+			cc.Close()
+			if !bytes.Equal(out, content) {
+				t.Fatalf("%s/%d: content mismatch (%d of %d bytes)", enc, frag, len(out), len(content))
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Content of the stored-block encoder is decoded incrementally.
+ */
+func TestDecodeEncoded(t *testing.T) {
+	content := testContent(100000)
+	for _, enc := range []string{"gzip", "deflate", "br"} {
+		body := encodeBody(enc, content, -1, []int{1400})
+		cc := NewContentCoder(enc)
+		out := make([]byte, 0, len(content))
+		for pos := 0; pos < len(body); pos += 777 {
+			end := pos + 777
+			if end > len(body) {
+				end = len(body)
+			}
+			out = append(out, cc.Decode(body[pos:end])...)
+		}
+		cc.Close()
+		if !bytes.HasPrefix(out, content) {
+			t.Fatalf("%s: content mismatch", enc)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Invalid content stops decoding; an unfinished decoder is stopped.
+ */
+func TestDecodeInvalid(t *testing.T) {
+	for _, enc := range []string{"gzip", "deflate", "br"} {
+		cc := NewContentCoder(enc)
+		junk := bytes.Repeat([]byte{0xff, 0x00, 0x13}, 100)
+		cc.Decode(junk)
+		if !cc.broken {
+			t.Fatalf("%s: invalid content decoded", enc)
+		}
+		if cc.Decode(junk) != nil {
+			t.Fatalf("%s: content decoded after failure", enc)
+		}
+		cc.Close()
+
+		// stop decoder in the middle of the stream
+		data := stdEncode(enc, testContent(10000))
+		cc = NewContentCoder(enc)
+		cc.Decode(data[:len(data)/2])
+		cc.Close()
+		cc.Close()
+		if cc.Decode(data[len(data)/2:]) != nil {
+			t.Fatalf("%s: content decoded after close", enc)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Bits are written LSB first and padded to a byte boundary.
+ */
+func TestBitWriter(t *testing.T) {
+	bw := new(bitWriter)
+	bw.put(1, 1)
+	bw.put(0, 2)
+	bw.put(0x1ff, 9)
+	bw.put(5, 3)
+	if out := bw.bytes(); !bytes.Equal(out, []byte{0xf9, 0x5f}) {
+		t.Fatalf("bits written as %x", out)
+	}
+	if bw.bits != 15 {
+		t.Fatalf("%d bits written", bw.bits)
+	}
+	if out := new(bitWriter).bytes(); len(out) != 0 {
+		t.Fatalf("empty bit writer has %d bytes", len(out))
+	}
+}
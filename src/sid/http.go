@@ -36,23 +36,23 @@ import (
 // Public types
 
 /*
- * HTTP service instance: In the current version there is only one
- * Cover server instance available that is shared among all HTTP
- * go-routines.
+ * HTTP service instance: Every client session is assigned a cover
+ * server instance from the pool of cover servers that is shared among
+ * all HTTP go-routines.
  */
 type HttpSrv struct {
-	hndlr *Cover // cover server reference
+	pool *CoverPool // pool of cover servers
 }
 
 ///////////////////////////////////////////////////////////////////////
 /*
  * Create and initialize new HTTP service instance
- * @param cover *Cover - refderence to cover server instance
+ * @param pool *CoverPool - reference to pool of cover servers
  */
-func NewHttpSrv(cover *Cover) *HttpSrv {
+func NewHttpSrv(pool *CoverPool) *HttpSrv {
 	return &HttpSrv{
-		//	Instantiate Cover (content transformer)
-		hndlr: cover,
+		//	Use pool of Covers (content transformers)
+		pool: pool,
 	}
 }
 
@@ -71,19 +71,31 @@ func (s *HttpSrv) Process(client net.Conn) {
 	// allocate buffer
 	data := make([]byte, 32768)
 
+	// select cover server for this session
+	hndlr := s.pool.Select(client)
+	if hndlr == nil {
+		logger.Println(logger.ERROR, "[sid.http] No cover server available.")
+		return
+	}
 	// open a new connection to the cover server
-	cover := s.hndlr.connect()
+	cover := hndlr.connect(client)
 	if cover == nil {
 		// failed to open connection to cover server
 		return
 	}
 	// close connection to cover server on exit
-	defer s.hndlr.disconnect(cover)
+	defer hndlr.disconnect(cover)
 	// get associated state info
-	state := s.hndlr.GetState(cover)
+	state := hndlr.GetState(cover)
 
 	// handle session loop
 	for {
+		// session terminated by control service?
+		if state.Killed() {
+			logger.Printf(logger.WARN, "[sid.http] Session %d terminated by control service.\n", state.Id)
+			return
+		}
+
 		//-------------------------------------------------------------
 		//	Upstream message passing
 		//-------------------------------------------------------------
@@ -97,9 +109,12 @@ func (s *HttpSrv) Process(client net.Conn) {
 		// send pending response to client
 		if n > 0 {
 			// transform response
-			resp := s.hndlr.xformResp(state, data, n)
+			state.lock.Lock()
+			resp := hndlr.xformResp(state, data, n)
+			state.BytesOut += int64(len(resp))
+			state.lock.Unlock()
 			// send incoming response data to client
-			if !network.SendData(client, resp, "http") {
+			if len(resp) > 0 && !network.SendData(client, resp, "http") {
 				// terminate session on failure
 				logger.Println(logger.ERROR, "[sid.http] Failed to send data to client.")
 				return
@@ -119,13 +134,30 @@ func (s *HttpSrv) Process(client net.Conn) {
 		// send pending client request
 		if n > 0 {
 			// transform request
-			req := s.hndlr.xformReq(state, data, n)
+			state.lock.Lock()
+			state.BytesIn += int64(n)
+			req := hndlr.xformReq(state, data, n)
+			failed := state.ReqFailed
+			reply := state.ReqReply
+			state.ReqReply = nil
+			state.BytesOut += int64(len(reply))
+			state.lock.Unlock()
+			// send interim response to client
+			if len(reply) > 0 && !network.SendData(client, reply, "http") {
+				logger.Println(logger.ERROR, "[sid.http] Failed to send data to client.")
+				return
+			}
 			// send request to cover server
-			if !network.SendData(cover, req, "http") {
+			if len(req) > 0 && !network.SendData(cover, req, "http") {
 				// terminate session on failure
 				logger.Println(logger.ERROR, "[sid.http] Failed to send data to cover.")
 				return
 			}
+			// terminate session on refused request
+			if failed {
+				logger.Printf(logger.WARN, "[sid.http] Session %d terminated (request refused).\n", state.Id)
+				return
+			}
 		}
 	}
 }
@@ -146,19 +178,14 @@ func (s *HttpSrv) CanHandle(protocol string) bool {
 
 //---------------------------------------------------------------------
 /*
- * Check for local connection: Only connections from the local
- * TOR exit node are accepted.
+ * Check for allowed connection: Only connections from addresses in
+ * the access control list (usually the local TOR exit node) are
+ * accepted.
  * @param add string - remote address
- * @return bool - local address?
+ * @return bool - allowed address?
  */
 func (s *HttpSrv) IsAllowed(addr string) bool {
-	idx := strings.Index(addr, ":")
-	ip := addr[:idx]
-	if strings.Index(CfgData.HttpAllow, ip) == -1 {
-		logger.Println(logger.WARN, "[sid.http] Invalid remote address '"+addr+"'")
-		return false
-	}
-	return true
+	return GetConfig().HttpACL().IsAllowed(addr)
 }
 
 //---------------------------------------------------------------------
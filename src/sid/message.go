@@ -0,0 +1,446 @@
+/*
+ * Incremental HTTP message parser: Client requests and cover server
+ * responses can arrive in any number of fragments; the parser buffers
+ * incoming data until complete headers (or body segments) are available.
+ * Multiple messages can be handled on a persistent connection.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	//-----------------------------------------------------------------
+	// Body parser states (chunked transfer encoding)
+	//-----------------------------------------------------------------
+	CS_SIZE    = iota // reading chunk size line
+	CS_DATA           // reading chunk data
+	CS_DATA_LB        // reading line break after chunk data
+	CS_TRAILER        // reading trailer lines
+	CS_DONE           // body complete
+
+	// max. size of a message header
+	MAX_HDR_SIZE = 65536
+)
+
+const (
+	//-----------------------------------------------------------------
+	// Kinds of body segments
+	//-----------------------------------------------------------------
+	SEG_CONTENT = iota // content data
+	SEG_SIZE           // chunk size line
+	SEG_LB             // line break after chunk data
+	SEG_TRAILER        // trailer line (or empty line at end of body)
+)
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Header field of a message.
+ */
+type HdrField struct {
+	Name  string // name of header field
+	Value string // value of header field (unfolded)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Body segment: the body of a message is returned as a list of segments
+ * that are either content data or transfer framing (chunk sizes, line
+ * breaks and trailers of chunked bodies).
+ */
+type BodySegment struct {
+	Data    []byte // segment data
+	Framing bool   // framing data (no content)?
+	Kind    int    // kind of segment (SEG_CONTENT, SEG_SIZE, ...)
+	Size    int    // chunk size (SEG_SIZE only)
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Incremental message parser (requests and responses).
+ */
+type MsgParser struct {
+	buf     []byte      // unprocessed input data
+	Lb      string      // line break sequence used by sender
+	Method  string      // request method (requests only)
+	URI     string      // requested resource (requests only)
+	Proto   string      // protocol version
+	Status  int         // status code (responses only)
+	Reason  string      // status text (responses only)
+	Header  []*HdrField // list of header fields (in sequence)
+	Settled int         // number of header fields that can't be continued
+	HdrSize int         // size of (incoming) header in bytes
+
+	Length    int  // content length of body (-1 if undefined)
+	Chunked   bool // chunked transfer encoding?
+	ToClose   bool // body is terminated by closing the connection?
+	bodyRead  int  // number of body bytes read (content length)
+	chunkMode int  // body parser state (chunked)
+	chunkLeft int  // remaining bytes in current chunk
+	started   bool // start line parsed?
+	hdrDone   bool // header completely parsed?
+	bodyDone  bool // body completely parsed?
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new message parser.
+ * @return *MsgParser - reference to new parser instance
+ */
+func NewMsgParser() *MsgParser {
+	p := &MsgParser{
+		buf: make([]byte, 0),
+	}
+	p.Reset()
+	return p
+}
+
+//---------------------------------------------------------------------
+/*
+ * Reset parser for the next message; unprocessed data is kept.
+ */
+func (p *MsgParser) Reset() {
+	p.Lb = "\r\n"
+	p.Method = ""
+	p.URI = ""
+	p.Proto = ""
+	p.Status = 0
+	p.Reason = ""
+	p.Header = make([]*HdrField, 0)
+	p.Settled = 0
+	p.HdrSize = 0
+	p.Length = -1
+	p.Chunked = false
+	p.ToClose = false
+	p.bodyRead = 0
+	p.chunkMode = CS_SIZE
+	p.chunkLeft = 0
+	p.started = false
+	p.hdrDone = false
+	p.bodyDone = false
+}
+
+//---------------------------------------------------------------------
+/*
+ * Add incoming message data.
+ * @param data []byte - message data
+ */
+func (p *MsgParser) Feed(data []byte) {
+	p.buf = append(p.buf, data...)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get number of buffered (unprocessed) bytes.
+ * @return int - number of buffered bytes
+ */
+func (p *MsgParser) Pending() int {
+	return len(p.buf)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if the message is a response.
+ * @return bool - message is a response?
+ */
+func (p *MsgParser) IsResponse() bool {
+	return p.Status != 0
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get value of header field (first occurrence, case-insensitive).
+ * @param name string - name of header field
+ * @return string - value of header field ("" if not present)
+ */
+func (p *MsgParser) Get(name string) string {
+	for _, f := range p.Header {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if the message has a body.
+ * @return bool - body follows header?
+ */
+func (p *MsgParser) HasBody() bool {
+	return p.Chunked || p.ToClose || p.Length > 0
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get number of body bytes still to be read (if known).
+ * @return int - number of remaining content bytes (-1 if unknown)
+ */
+func (p *MsgParser) Remaining() int {
+	if p.bodyDone {
+		return 0
+	}
+	if p.Chunked || p.ToClose || p.Length < 0 {
+		return -1
+	}
+	return p.Length - p.bodyRead
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse message header: The header is parsed line by line as the data
+ * arrives; it is complete when it is terminated by an empty line. Folded
+ * header lines (continuation lines starting with white space) are joined
+ * with the previous header field, so only the first 'Settled' header
+ * fields are final while the header is incomplete.
+ * @param noBody bool - response without body (e.g. for HEAD requests)
+ * @return bool - header completely parsed?
+ * @return error - error object (or nil)
+ */
+func (p *MsgParser) ParseHeader(noBody bool) (bool, error) {
+	if p.hdrDone {
+		return true, nil
+	}
+	for {
+		if !p.started {
+			// skip leading empty lines (RFC 2616, section 4.1)
+			for len(p.buf) > 0 && (p.buf[0] == '\r' || p.buf[0] == '\n') {
+				p.buf = p.buf[1:]
+			}
+		}
+		pos := bytes.IndexByte(p.buf, '\n')
+		if pos == -1 {
+			if p.HdrSize+len(p.buf) > MAX_HDR_SIZE {
+				return false, errors.New("message header too large")
+			}
+			return false, nil
+		}
+		if p.HdrSize+pos >= MAX_HDR_SIZE {
+			return false, errors.New("message header too large")
+		}
+		raw := p.take(pos + 1)
+		p.HdrSize += len(raw)
+		line := strings.TrimRight(string(raw), "\r\n")
+
+		// request or status line
+		if !p.started {
+			if !bytes.HasSuffix(raw, []byte("\r\n")) {
+				p.Lb = "\n"
+			}
+			if err := p.parseStartLine(line); err != nil {
+				return false, err
+			}
+			p.started = true
+			continue
+		}
+		// end of header?
+		if len(line) == 0 {
+			break
+		}
+		// continuation line?
+		if line[0] == ' ' || line[0] == '\t' {
+			if n := len(p.Header); n > 0 {
+				p.Header[n-1].Value += " " + strings.TrimSpace(line)
+				continue
+			}
+			return false, errors.New("continuation line without header field")
+		}
+		pos = strings.Index(line, ":")
+		if pos == -1 {
+			return false, errors.New("invalid header line '" + line + "'")
+		}
+		p.Settled = len(p.Header)
+		p.Header = append(p.Header, &HdrField{
+			Name:  line[:pos],
+			Value: strings.TrimSpace(line[pos+1:]),
+		})
+	}
+	p.Settled = len(p.Header)
+
+	// evaluate body-related header fields
+	p.hdrDone = true
+	if p.IsResponse() && (noBody || p.Status < 200 || p.Status == 204 || p.Status == 304) {
+		// responses without body
+		p.bodyDone = true
+		return true, nil
+	}
+	if te := p.Get("Transfer-Encoding"); len(te) > 0 && !strings.EqualFold(te, "identity") {
+		if !strings.HasSuffix(strings.ToLower(te), "chunked") {
+			return false, errors.New("unsupported transfer encoding '" + te + "'")
+		}
+		p.Chunked = true
+	} else if cl := p.Get("Content-Length"); len(cl) > 0 {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return false, errors.New("invalid content length '" + cl + "'")
+		}
+		p.Length = n
+	} else if p.IsResponse() {
+		// response body is terminated by the server closing the connection
+		p.ToClose = true
+	}
+	p.bodyDone = !p.HasBody()
+	return true, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Parse start line of a message (request or status line).
+ * @param line string - start line
+ * @return error - error object (or nil)
+ */
+func (p *MsgParser) parseStartLine(line string) error {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return errors.New("invalid start line '" + line + "'")
+	}
+	if strings.HasPrefix(parts[0], "HTTP/") {
+		status, err := strconv.Atoi(parts[1])
+		if err != nil || status < 100 {
+			return errors.New("invalid status line '" + line + "'")
+		}
+		p.Proto, p.Status = parts[0], status
+		if len(parts) > 2 {
+			p.Reason = parts[2]
+		}
+		return nil
+	}
+	if len(parts) != 3 {
+		return errors.New("invalid request line '" + line + "'")
+	}
+	p.Method, p.URI, p.Proto = parts[0], parts[1], parts[2]
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read available body data: for chunked bodies the transfer framing
+ * is returned as separate segments, so that the caller can replace the
+ * content while preserving the framing.
+ * @return []*BodySegment - list of body segments
+ * @return bool - body complete?
+ * @return error - error object (or nil)
+ */
+func (p *MsgParser) ReadBody() ([]*BodySegment, bool, error) {
+	segs := make([]*BodySegment, 0)
+	if !p.hdrDone || p.bodyDone {
+		return segs, p.bodyDone, nil
+	}
+	// content terminated by closing the connection
+	if p.ToClose {
+		if len(p.buf) > 0 {
+			segs = append(segs, &BodySegment{Data: p.take(len(p.buf))})
+		}
+		return segs, false, nil
+	}
+	// content with given length
+	if !p.Chunked {
+		n := p.Length - p.bodyRead
+		if n > len(p.buf) {
+			n = len(p.buf)
+		}
+		if n > 0 {
+			segs = append(segs, &BodySegment{Data: p.take(n)})
+			p.bodyRead += n
+		}
+		p.bodyDone = (p.bodyRead == p.Length)
+		return segs, p.bodyDone, nil
+	}
+	// chunked content
+	for len(p.buf) > 0 && !p.bodyDone {
+		switch p.chunkMode {
+		case CS_SIZE:
+			pos := bytes.IndexByte(p.buf, '\n')
+			if pos == -1 {
+				return segs, false, nil
+			}
+			line := p.take(pos + 1)
+			size := strings.TrimSpace(string(line))
+			if idx := strings.Index(size, ";"); idx != -1 {
+				// drop chunk extensions
+				size = size[:idx]
+			}
+			n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 32)
+			if err != nil || n < 0 {
+				return segs, false, errors.New("invalid chunk size '" + size + "'")
+			}
+			segs = append(segs, &BodySegment{Data: line, Framing: true, Kind: SEG_SIZE, Size: int(n)})
+			p.chunkLeft = int(n)
+			if n == 0 {
+				p.chunkMode = CS_TRAILER
+			} else {
+				p.chunkMode = CS_DATA
+			}
+
+		case CS_DATA:
+			n := p.chunkLeft
+			if n > len(p.buf) {
+				n = len(p.buf)
+			}
+			segs = append(segs, &BodySegment{Data: p.take(n)})
+			p.bodyRead += n
+			if p.chunkLeft -= n; p.chunkLeft == 0 {
+				p.chunkMode = CS_DATA_LB
+			}
+
+		case CS_DATA_LB, CS_TRAILER:
+			pos := bytes.IndexByte(p.buf, '\n')
+			if pos == -1 {
+				return segs, false, nil
+			}
+			line := p.take(pos + 1)
+			seg := &BodySegment{Data: line, Framing: true, Kind: SEG_TRAILER}
+			if p.chunkMode == CS_DATA_LB {
+				seg.Kind = SEG_LB
+			}
+			segs = append(segs, seg)
+			if p.chunkMode == CS_DATA_LB {
+				p.chunkMode = CS_SIZE
+			} else if len(bytes.TrimSpace(line)) == 0 {
+				// empty line terminates trailer
+				p.chunkMode = CS_DONE
+				p.bodyDone = true
+			}
+		}
+	}
+	return segs, p.bodyDone, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Take data from the input buffer.
+ * @param n int - number of bytes
+ * @return []byte - data from buffer
+ */
+func (p *MsgParser) take(n int) []byte {
+	out := make([]byte, n)
+	copy(out, p.buf[:n])
+	p.buf = p.buf[n:]
+	return out
+}
@@ -0,0 +1,282 @@
+/*
+ * Streaming parser for "multipart/form-data" content: The content of
+ * form parts is passed to handler functions as soon as it is available,
+ * so uploaded documents never need to be held in memory completely.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	//-----------------------------------------------------------------
+	// Multipart parser states
+	//-----------------------------------------------------------------
+	MP_PREAMBLE = iota // skipping preamble
+	MP_DELIM           // reading remainder of delimiter line
+	MP_HEADER          // reading part header
+	MP_BODY            // reading part content
+	MP_DONE            // final delimiter found
+)
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Part of a multipart form.
+ */
+type FormPart struct {
+	Name        string      // name of form field
+	FileName    string      // name of uploaded file ("" for no file)
+	ContentType string      // content type of part
+	Header      []*HdrField // list of part header fields
+}
+
+//---------------------------------------------------------------------
+/*
+ * Streaming multipart parser.
+ */
+type MultipartParser struct {
+	delim []byte    // delimiter sequence ("\n--" + boundary)
+	buf   []byte    // unprocessed input data
+	mode  int       // parser state
+	part  *FormPart // current form part
+
+	OnPartStart func(*FormPart)         // start of new form part
+	OnPartData  func(*FormPart, []byte) // content of form part
+	OnPartEnd   func(*FormPart)         // end of form part
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new multipart parser for given boundary.
+ * @param boundary string - boundary separator
+ * @return *MultipartParser - reference to new parser instance
+ */
+func NewMultipartParser(boundary string) *MultipartParser {
+	return &MultipartParser{
+		delim: []byte("\n--" + boundary),
+		// the first delimiter is not preceded by a line break
+		buf:  []byte("\n"),
+		mode: MP_PREAMBLE,
+		part: nil,
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if the final delimiter has been processed.
+ * @return bool - multipart content complete?
+ */
+func (m *MultipartParser) Done() bool {
+	return m.mode == MP_DONE
+}
+
+//---------------------------------------------------------------------
+/*
+ * Process (decoded) multipart content (implements io.Writer interface).
+ * @param data []byte - multipart content
+ * @return int - number of bytes processed
+ * @return error - error object (or nil)
+ */
+func (m *MultipartParser) Write(data []byte) (int, error) {
+	m.buf = append(m.buf, data...)
+	for {
+		switch m.mode {
+		//-------------------------------------------------------------
+		// skip content up to the first delimiter
+		//-------------------------------------------------------------
+		case MP_PREAMBLE:
+			pos := bytes.Index(m.buf, m.delim)
+			if pos == -1 {
+				m.keep(len(m.delim))
+				return len(data), nil
+			}
+			m.buf = m.buf[pos+len(m.delim):]
+			m.mode = MP_DELIM
+
+		//-------------------------------------------------------------
+		// end of delimiter line: either final delimiter or a new part
+		//-------------------------------------------------------------
+		case MP_DELIM:
+			if len(m.buf) < 2 {
+				return len(data), nil
+			}
+			if m.buf[0] == '-' && m.buf[1] == '-' {
+				// final delimiter: ignore epilogue
+				m.mode = MP_DONE
+				m.buf = m.buf[:0]
+				return len(data), nil
+			}
+			pos := bytes.IndexByte(m.buf, '\n')
+			if pos == -1 {
+				return len(data), nil
+			}
+			m.buf = m.buf[pos+1:]
+			m.mode = MP_HEADER
+
+		//-------------------------------------------------------------
+		// part header
+		//-------------------------------------------------------------
+		case MP_HEADER:
+			end, sep := bytes.Index(m.buf, []byte("\r\n\r\n")), 4
+			if pos := bytes.Index(m.buf, []byte("\n\n")); pos != -1 && (end == -1 || pos < end) {
+				end, sep = pos, 2
+			}
+			// handle empty part header
+			if bytes.HasPrefix(m.buf, []byte("\r\n")) {
+				end, sep = 0, 2
+			} else if len(m.buf) > 0 && m.buf[0] == '\n' {
+				end, sep = 0, 1
+			}
+			if end == -1 {
+				if len(m.buf) > MAX_HDR_SIZE {
+					return 0, errors.New("multipart header too large")
+				}
+				return len(data), nil
+			}
+			part, err := parsePartHeader(string(m.buf[:end]))
+			if err != nil {
+				return 0, err
+			}
+			m.buf = m.buf[end+sep:]
+			m.part = part
+			m.mode = MP_BODY
+			if m.OnPartStart != nil {
+				m.OnPartStart(part)
+			}
+
+		//-------------------------------------------------------------
+		// part content: content is passed to the handler up to a
+		// (possible) start of a delimiter.
+		//-------------------------------------------------------------
+		case MP_BODY:
+			pos := bytes.Index(m.buf, m.delim)
+			if pos == -1 {
+				// keep enough data to detect a fragmented delimiter
+				// (including a preceding carriage return)
+				if n := len(m.buf) - len(m.delim); n > 0 {
+					m.emit(m.buf[:n])
+					m.keep(len(m.delim))
+				}
+				return len(data), nil
+			}
+			content := m.buf[:pos]
+			if n := len(content); n > 0 && content[n-1] == '\r' {
+				content = content[:n-1]
+			}
+			m.emit(content)
+			if m.OnPartEnd != nil {
+				m.OnPartEnd(m.part)
+			}
+			m.part = nil
+			m.buf = m.buf[pos+len(m.delim):]
+			m.mode = MP_DELIM
+
+		//-------------------------------------------------------------
+		// ignore epilogue
+		//-------------------------------------------------------------
+		case MP_DONE:
+			return len(data), nil
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Pass part content to handler.
+ * @param data []byte - part content
+ */
+func (m *MultipartParser) emit(data []byte) {
+	if len(data) > 0 && m.OnPartData != nil {
+		out := make([]byte, len(data))
+		copy(out, data)
+		m.OnPartData(m.part, out)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Keep only the last 'n' bytes in the input buffer.
+ * @param n int - number of bytes to keep
+ */
+func (m *MultipartParser) keep(n int) {
+	if len(m.buf) > n {
+		m.buf = append(m.buf[:0], m.buf[len(m.buf)-n:]...)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Parse the header of a form part.
+ * @param hdr string - header lines
+ * @return *FormPart - new form part
+ * @return error - error object (or nil)
+ */
+func parsePartHeader(hdr string) (*FormPart, error) {
+	part := &FormPart{
+		ContentType: "text/plain",
+		Header:      make([]*HdrField, 0),
+	}
+	for _, line := range strings.Split(hdr, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		// continuation line?
+		if line[0] == ' ' || line[0] == '\t' {
+			if n := len(part.Header); n > 0 {
+				part.Header[n-1].Value += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		pos := strings.Index(line, ":")
+		if pos == -1 {
+			return nil, errors.New("invalid part header line '" + line + "'")
+		}
+		part.Header = append(part.Header, &HdrField{
+			Name:  line[:pos],
+			Value: strings.TrimSpace(line[pos+1:]),
+		})
+	}
+	for _, f := range part.Header {
+		switch strings.ToLower(f.Name) {
+		case "content-disposition":
+			_, params, err := mime.ParseMediaType(f.Value)
+			if err != nil {
+				return nil, err
+			}
+			part.Name = params["name"]
+			part.FileName = params["filename"]
+		case "content-type":
+			part.ContentType = f.Value
+		}
+	}
+	return part, nil
+}
@@ -0,0 +1,190 @@
+/*
+ * Streaming multipart parser: fragmented content tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Parse multipart content fed in fragments.
+ * @param t *testing.T - test instance
+ * @param boundary string - boundary separator
+ * @param frags []string - content fragments
+ * @return []string - list of parts ("name|filename|type|content")
+ * @return bool - final delimiter found?
+ */
+func parseParts(t *testing.T, boundary string, frags []string) ([]string, bool) {
+	var (
+		parts []string
+		cur   string
+		open  bool
+	)
+	m := NewMultipartParser(boundary)
+	m.OnPartStart = func(p *FormPart) {
+		if open {
+			t.Fatal("part started before end of previous part")
+		}
+		open = true
+		cur = p.Name + "|" + p.FileName + "|" + p.ContentType + "|"
+	}
+	m.OnPartData = func(p *FormPart, data []byte) {
+		if !open {
+			t.Fatal("data outside of part")
+		}
+		cur += string(data)
+	}
+	m.OnPartEnd = func(p *FormPart) {
+		open = false
+		parts = append(parts, cur)
+	}
+	for _, frag := range frags {
+		if n, err := m.Write([]byte(frag)); err != nil || n != len(frag) {
+			t.Fatalf("write of '%s' failed", frag)
+		}
+	}
+	return parts, m.Done()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Compare parsed parts with expected parts.
+ * @param t *testing.T - test instance
+ * @param info string - test description
+ * @param parts []string - parsed parts
+ * @param expect []string - expected parts
+ */
+func checkParts(t *testing.T, info string, parts, expect []string) {
+	if len(parts) != len(expect) {
+		t.Fatalf("%s: %d parts instead of %d", info, len(parts), len(expect))
+	}
+	for i, p := range parts {
+		if p != expect[i] {
+			t.Fatalf("%s: part %d is\n'%s'\ninstead of\n'%s'", info, i, p, expect[i])
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Multipart content is parsed correctly regardless of its fragmentation
+ * (delimiters, part headers and line breaks split across fragments).
+ */
+func TestMultipartFragmented(t *testing.T) {
+	boundary := "----xyz42"
+	body := "preamble\r\n" +
+		"------xyz42\r\n" +
+		"Content-Disposition: form-data; name=\"comment\"\r\n\r\n" +
+		"no boundary: ----xyz4 \r\n----xyz42\r\n" +
+		"------xyz42\r\n" +
+		"Content-Disposition: form-data; name=\"file\";\r\n\tfilename=\"doc.txt\"\r\n" +
+		"Content-Type: application/octet-stream\r\n\r\n" +
+		"line one\r\nline two\r\r\n" +
+		"------xyz42--\r\n" +
+		"epilogue\r\n------xyz42\r\n"
+	expect := []string{
+		"comment||text/plain|no boundary: ----xyz4 \r\n----xyz42",
+		"file|doc.txt|application/octet-stream|line one\r\nline two\r",
+	}
+
+	// content at once and split at every position
+	for pos := 0; pos <= len(body); pos++ {
+		parts, done := parseParts(t, boundary, []string{body[:pos], body[pos:]})
+		if !done {
+			t.Fatalf("split at %d: final delimiter not found", pos)
+		}
+		checkParts(t, "split at "+strconv.Itoa(pos), parts, expect)
+	}
+	// content in fragments of fixed size
+	for size := 1; size < 20; size++ {
+		var frags []string
+		for pos := 0; pos < len(body); pos += size {
+			end := pos + size
+			if end > len(body) {
+				end = len(body)
+			}
+			frags = append(frags, body[pos:end])
+		}
+		parts, done := parseParts(t, boundary, frags)
+		if !done {
+			t.Fatalf("fragments of %d bytes: final delimiter not found", size)
+		}
+		checkParts(t, "fragments", parts, expect)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Multipart content with plain line feeds, empty part headers and no
+ * preamble.
+ */
+func TestMultipartLF(t *testing.T) {
+	body := "--b\n" +
+		"Content-Disposition: form-data; name=\"a\"\n\n" +
+		"first\n" +
+		"--b\n" +
+		"\n" +
+		"second\n" +
+		"--b--"
+	expect := []string{
+		"a||text/plain|first",
+		"||text/plain|second",
+	}
+	for pos := 0; pos <= len(body); pos++ {
+		parts, done := parseParts(t, "b", []string{body[:pos], body[pos:]})
+		if !done {
+			t.Fatalf("split at %d: final delimiter not found", pos)
+		}
+		checkParts(t, "split at "+strconv.Itoa(pos), parts, expect)
+	}
+
+	// incomplete content
+	parts, done := parseParts(t, "b", []string{body[:len(body)-8]})
+	if done || len(parts) != 1 {
+		t.Fatal("incomplete content parsed as complete")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Invalid part headers are rejected.
+ */
+func TestMultipartInvalid(t *testing.T) {
+	for _, body := range []string{
+		"--b\r\nsecret\r\n\r\ndata\r\n--b--\r\n",
+		"--b\r\nContent-Disposition: form-data; name=\"a\r\n\r\ndata\r\n--b--\r\n",
+		"--b\r\nX-Large: " + strings.Repeat("x", MAX_HDR_SIZE) + "\r\n",
+	} {
+		m := NewMultipartParser("b")
+		if _, err := m.Write([]byte(body)); err == nil {
+			t.Fatalf("invalid content '%.40s' accepted", body)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+/*
+ * Configuration options: Schema of all standard configuration options
+ * with their type, range of valid values and section. Parameters from
+ * the configuration file (and command line) are checked against the
+ * schema; unknown and invalid options are reported as errors.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"errors"
+	"github.com/bfix/gospel/logger"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// types of option values
+	OPT_STRING   = iota // string value
+	OPT_INT             // integer value (with range)
+	OPT_BOOL            // boolean value ("ON" or "OFF")
+	OPT_LIST            // list of string values (option can be repeated)
+	OPT_SECTION         // section with options
+	OPT_OBSOLETE        // obsolete option (rejected)
+
+	// names of sections
+	SECT_UPLOADS = "ClientUploads"
+
+	// sources of option values
+	SRC_DEFAULT = "default" // default value
+	SRC_FILE    = "file"    // configuration file
+	SRC_ENV     = "env"     // environment variable
+	SRC_FLAG    = "flag"    // command line flag
+)
+
+///////////////////////////////////////////////////////////////////////
+// Public types
+
+/*
+ * Definition of a configuration option.
+ */
+type Option struct {
+	Name    string                        // name of option
+	Aliases []string                      // alternative (deprecated) names
+	Section string                        // section of option ("": top level)
+	Type    int                           // type of value
+	Min     int                           // min. value (OPT_INT)
+	Max     int                           // max. value (OPT_INT)
+	Values  []string                      // list of valid values (OPT_STRING; nil: any)
+	Field   func(cfg *Config) interface{} // reference to configuration field
+	Flag    string                        // name of command line flag (default: derived from name)
+	Secret  bool                          // hide value in listings
+	Reason  string                        // reason for rejection (OPT_OBSOLETE)
+}
+
+///////////////////////////////////////////////////////////////////////
+// Local variables
+
+/*
+ * Prefixes for command line flags of options in sections.
+ */
+var sectionFlags = map[string]string{
+	SECT_UPLOADS: "upload-",
+}
+
+//---------------------------------------------------------------------
+/*
+ * List of standard configuration options.
+ */
+var cfgOptions = []*Option{
+	// logging-related settings
+	{Name: "LogFile", Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.LogFile }},
+	{Name: "LogToFile", Type: OPT_BOOL,
+		Field: func(c *Config) interface{} { return &c.LogState }},
+	{Name: "LogLevel", Type: OPT_STRING, Values: logLevels,
+		Field: func(c *Config) interface{} { return &c.LogLevel }},
+
+	// instance control
+	{Name: "CtrlPort", Aliases: []string{"CrtlPort"}, Type: OPT_INT, Min: 1, Max: 65535,
+		Field: func(c *Config) interface{} { return &c.CtrlPort }},
+	{Name: "CtrlAllow", Aliases: []string{"CrtlAllow"}, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.CtrlAllow }},
+
+	// HTTP(S) services
+	{Name: "HttpPort", Type: OPT_INT, Min: 1, Max: 65535,
+		Field: func(c *Config) interface{} { return &c.HttpPort }},
+	{Name: "HttpAllow", Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.HttpAllow }},
+	{Name: "HttpsPort", Type: OPT_INT, Min: 0, Max: 65535,
+		Field: func(c *Config) interface{} { return &c.HttpsPort }},
+	{Name: "HttpsCert", Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.HttpsCert }},
+	{Name: "HttpsKey", Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.HttpsKey }},
+
+	// shutdown
+	{Name: "ShutdownTimeout", Type: OPT_INT, Min: 0, Max: 3600,
+		Field: func(c *Config) interface{} { return &c.ShutdownTimeout }},
+
+	// outgoing connections and cover servers
+	{Name: "UseSocks", Type: OPT_BOOL,
+		Field: func(c *Config) interface{} { return &c.UseSocks }},
+	{Name: "SocksAddr", Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.SocksAddr }},
+	{Name: "CoverSelect", Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Covers.Select }},
+	{Name: "CoverServer", Type: OPT_LIST,
+		Field: func(c *Config) interface{} { return &c.Covers.Servers }},
+	{Name: "CoverPin", Type: OPT_LIST,
+		Field: func(c *Config) interface{} { return &c.Covers.Pins }},
+
+	// upload-related settings
+	{Name: SECT_UPLOADS, Type: OPT_SECTION},
+	{Name: "Path", Section: SECT_UPLOADS, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Upload.Path }},
+	{Name: "FileField", Section: SECT_UPLOADS, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Upload.FileField }},
+	{Name: "KeyRing", Aliases: []string{"Keyring"}, Section: SECT_UPLOADS, Type: OPT_STRING, Flag: "upload-keyring",
+		Field: func(c *Config) interface{} { return &c.Upload.Keyring }},
+	{Name: "Reviewers", Section: SECT_UPLOADS, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Upload.Reviewers }},
+	{Name: "SharePrime", Section: SECT_UPLOADS, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Upload.SharePrime }},
+	{Name: "SharePrimeOffset", Section: SECT_UPLOADS, Type: OPT_INT, Min: 0, Max: 1 << 30,
+		Field: func(c *Config) interface{} { return &c.Upload.SharePrimeOffset }},
+	{Name: "ShareTreshold", Section: SECT_UPLOADS, Type: OPT_INT, Min: 0, Max: 255,
+		Field: func(c *Config) interface{} { return &c.Upload.ShareTreshold }},
+	{Name: "MaxSize", Section: SECT_UPLOADS, Type: OPT_INT, Min: 0, Max: 1 << 20,
+		Field: func(c *Config) interface{} { return &c.Upload.MaxSize }},
+	{Name: "Store", Section: SECT_UPLOADS, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Upload.Store }},
+	{Name: "StoreURL", Section: SECT_UPLOADS, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Upload.StoreURL }},
+	{Name: "StoreRegion", Section: SECT_UPLOADS, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Upload.StoreRegion }},
+	{Name: "StoreUser", Section: SECT_UPLOADS, Type: OPT_STRING,
+		Field: func(c *Config) interface{} { return &c.Upload.StoreUser }},
+	{Name: "StorePassword", Section: SECT_UPLOADS, Type: OPT_STRING, Secret: true,
+		Field: func(c *Config) interface{} { return &c.Upload.StorePassword }},
+
+	// obsolete options: the generated prime was '2^512 - 1 - <offset>'
+	{Name: "PrimeOfs", Section: SECT_UPLOADS, Type: OPT_OBSOLETE,
+		Reason: "the prime is now searched above 2^256 (see 'SharePrimeOffset')"},
+	{Name: "SharePrimeOfs", Section: SECT_UPLOADS, Type: OPT_OBSOLETE,
+		Reason: "the prime is now searched above 2^256 (see 'SharePrimeOffset')"},
+}
+
+///////////////////////////////////////////////////////////////////////
+// Public functions
+
+/*
+ * Get definition of a standard configuration option.
+ * @param name string - name (or alias) of option
+ * @return *Option - option definition (or nil if unknown)
+ */
+func GetOption(name string) *Option {
+	for _, opt := range cfgOptions {
+		if opt.Name == name {
+			return opt
+		}
+		for _, alias := range opt.Aliases {
+			if alias == name {
+				logger.Printf(logger.WARN, "[sid.config] Option '%s' is deprecated -- use '%s'\n", name, opt.Name)
+				return opt
+			}
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Suggest a standard option for an unknown option name (misspelled
+ * or wrong case).
+ * @param name string - unknown option name
+ * @return string - name of similar option (or empty string)
+ */
+func SuggestOption(name string) string {
+	best, dist := "", 3
+	for _, opt := range cfgOptions {
+		if opt.Type == OPT_OBSOLETE {
+			continue
+		}
+		for _, n := range append([]string{opt.Name}, opt.Aliases...) {
+			if d := editDistance(strings.ToLower(name), strings.ToLower(n)); d < dist {
+				best, dist = opt.Name, d
+			}
+		}
+	}
+	return best
+}
+
+///////////////////////////////////////////////////////////////////////
+// Public methods
+
+/*
+ * Get name of command line flag for option: the name is derived from
+ * the option name ("HttpPort" -> "http-port"); options in a section
+ * have a section-specific prefix.
+ * @return string - name of command line flag
+ */
+func (o *Option) FlagName() string {
+	if len(o.Flag) > 0 {
+		return o.Flag
+	}
+	name := ""
+	for i, r := range o.Name {
+		if i > 0 && unicode.IsUpper(r) {
+			name += "-"
+		}
+		name += string(unicode.ToLower(r))
+	}
+	return sectionFlags[o.Section] + name
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get name of environment variable for option ("http-port" ->
+ * "SID_HTTP_PORT").
+ * @return string - name of environment variable
+ */
+func (o *Option) EnvName() string {
+	return "SID_" + strings.ToUpper(strings.Replace(o.FlagName(), "-", "_", -1))
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get option value from configuration (string representation).
+ * @param cfg *Config - configuration
+ * @return string - option value
+ */
+func (o *Option) Get(cfg *Config) string {
+	switch o.Type {
+	case OPT_STRING:
+		return *(o.Field(cfg).(*string))
+	case OPT_INT:
+		return strconv.Itoa(*(o.Field(cfg).(*int)))
+	case OPT_BOOL:
+		if *(o.Field(cfg).(*bool)) {
+			return "ON"
+		}
+		return "OFF"
+	case OPT_LIST:
+		return strings.Join(*(o.Field(cfg).(*[]string)), ",")
+	}
+	return ""
+}
+
+//---------------------------------------------------------------------
+/*
+ * Set option value in configuration.
+ * @param cfg *Config - configuration
+ * @param val string - value (string representation)
+ * @return error - error object (or nil)
+ */
+func (o *Option) Set(cfg *Config, val string) error {
+	val = strings.TrimSpace(val)
+	switch o.Type {
+	case OPT_STRING:
+		if o.Values != nil {
+			valid := false
+			for _, v := range o.Values {
+				valid = valid || (v == val)
+			}
+			if !valid {
+				return errors.New("invalid value '" + val + "' for option '" + o.Name + "' (" + strings.Join(o.Values, ",") + ")")
+			}
+		}
+		*(o.Field(cfg).(*string)) = val
+	case OPT_INT:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return errors.New("invalid integer '" + val + "' for option '" + o.Name + "'")
+		}
+		if n < o.Min || n > o.Max {
+			return errors.New("value " + val + " for option '" + o.Name + "' out of range [" + strconv.Itoa(o.Min) + "," + strconv.Itoa(o.Max) + "]")
+		}
+		*(o.Field(cfg).(*int)) = n
+	case OPT_BOOL:
+		switch strings.ToUpper(val) {
+		case "ON", "TRUE":
+			*(o.Field(cfg).(*bool)) = true
+		case "OFF", "FALSE":
+			*(o.Field(cfg).(*bool)) = false
+		default:
+			return errors.New("invalid value '" + val + "' for option '" + o.Name + "' (ON,OFF)")
+		}
+	case OPT_LIST:
+		list := o.Field(cfg).(*[]string)
+		*list = append(*list, val)
+	default:
+		return errors.New("option '" + o.Name + "' has no value")
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Reset option value: list options are emptied (an overriding source
+ * replaces all values); other options are unchanged.
+ * @param cfg *Config - configuration
+ */
+func (o *Option) Reset(cfg *Config) {
+	if o.Type == OPT_LIST {
+		*(o.Field(cfg).(*[]string)) = make([]string, 0)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Command line flag for an option (implements flag.Value): the values
+ * are collected and applied when the configuration is read.
+ */
+type optionFlag struct {
+	opt  *Option  // associated option
+	vals []string // values from command line
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get string representation of flag value.
+ * @return string - flag value
+ */
+func (f *optionFlag) String() string {
+	if f == nil || len(f.vals) == 0 {
+		return ""
+	}
+	return strings.Join(f.vals, ",")
+}
+
+//---------------------------------------------------------------------
+/*
+ * Set flag value (list options can be repeated).
+ * @param val string - flag value
+ * @return error - error object (or nil)
+ */
+func (f *optionFlag) Set(val string) error {
+	if f.opt.Type == OPT_LIST {
+		f.vals = append(f.vals, val)
+	} else {
+		f.vals = []string{val}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Flags for boolean options can be used without value.
+ * @return bool - boolean flag?
+ */
+func (f *optionFlag) IsBoolFlag() bool {
+	return f.opt.Type == OPT_BOOL
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Compute the edit distance (Levenshtein) of two strings.
+ * @param a string - first string
+ * @param b string - second string
+ * @return int - edit distance
+ */
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if curr[j-1]+1 < d {
+				d = curr[j-1] + 1
+			}
+			curr[j] = d
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
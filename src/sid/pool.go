@@ -0,0 +1,314 @@
+/*
+ * Pool of cover servers: Every client session is assigned a cover
+ * server from the pool by a (pluggable) selection strategy, so that
+ * a SID instance is not tied to a single (well-known) cover server.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"container/list"
+	"errors"
+	"github.com/bfix/gospel/crypto"
+	"github.com/bfix/gospel/logger"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	STICKY_MAX_CLIENTS = 4096      // max. number of sticky assignments
+	STICKY_TTL         = time.Hour // lifetime of unused sticky assignments
+)
+
+///////////////////////////////////////////////////////////////////////
+// Public types
+
+/*
+ * Selection strategy: Return the index of the pool entry to be used
+ * for a new client connection. The pool is locked while the selector
+ * is running, so selectors must not call locking pool methods.
+ */
+type CoverSelector func(p *CoverPool, client net.Conn) int
+
+//---------------------------------------------------------------------
+/*
+ * Pool entry: cover server instance with selection weight.
+ */
+type poolEntry struct {
+	cover  *Cover // cover server instance
+	weight int    // selection weight (weighted strategy)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Sticky assignment of a client to a pool entry.
+ */
+type stickyEntry struct {
+	client string    // client address
+	idx    int       // index of pool entry
+	used   time.Time // time of last use
+}
+
+//---------------------------------------------------------------------
+/*
+ * Pool of cover server instances. Each cover instance keeps its own
+ * list of states and POST contents.
+ */
+type CoverPool struct {
+	lock     sync.Mutex               // lock for concurrent access
+	entries  []*poolEntry             // list of cover servers
+	sticky   map[string]*list.Element // sticky assignments (client -> LRU element)
+	lru      *list.List               // sticky assignments (most recently used first)
+	Selector CoverSelector            // selection strategy
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Create a new (empty) cover pool with given selection strategy.
+ * @param sel CoverSelector - selection strategy (nil for random)
+ * @return *CoverPool - reference to new pool instance
+ */
+func NewCoverPool(sel CoverSelector) *CoverPool {
+	if sel == nil {
+		sel = SelectRandom
+	}
+	return &CoverPool{
+		entries:  make([]*poolEntry, 0),
+		sticky:   make(map[string]*list.Element),
+		lru:      list.New(),
+		Selector: sel,
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Add a cover server instance to the pool.
+ * @param c *Cover - cover server instance
+ * @param weight int - selection weight (values < 1 are set to 1)
+ */
+func (p *CoverPool) Add(c *Cover, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.entries = append(p.entries, &poolEntry{c, weight})
+	logger.Printf(logger.INFO, "[sid.pool] cover server '%s://%s:%d' added (weight %d)\n", c.Protocol, c.Name, c.Port, weight)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get number of cover servers in the pool.
+ * @return int - number of cover servers
+ */
+func (p *CoverPool) Count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.entries)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get list of cover servers in the pool.
+ * @return []*Cover - list of cover server instances
+ */
+func (p *CoverPool) Covers() []*Cover {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	list := make([]*Cover, len(p.entries))
+	for i, e := range p.entries {
+		list[i] = e.cover
+	}
+	return list
+}
+
+//---------------------------------------------------------------------
+/*
+ * Select a cover server for a new client connection.
+ * @param client net.Conn - client connection
+ * @return *Cover - selected cover server (or nil if pool is empty)
+ */
+func (p *CoverPool) Select(client net.Conn) *Cover {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.entries) == 0 {
+		return nil
+	}
+	idx := p.Selector(p, client)
+	if idx < 0 || idx >= len(p.entries) {
+		logger.Printf(logger.WARN, "[sid.pool] selector returned invalid index %d -- using first entry\n", idx)
+		idx = 0
+	}
+	return p.entries[idx].cover
+}
+
+///////////////////////////////////////////////////////////////////////
+// Selection strategies
+
+/*
+ * Random selection: every cover server has the same chance.
+ * @param p *CoverPool - cover pool (locked)
+ * @param client net.Conn - client connection
+ * @return int - index of selected entry
+ */
+func SelectRandom(p *CoverPool, client net.Conn) int {
+	return crypto.RandInt(0, len(p.entries)-1)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Weighted selection: the chance of a cover server to be selected is
+ * proportional to its weight.
+ * @param p *CoverPool - cover pool (locked)
+ * @param client net.Conn - client connection
+ * @return int - index of selected entry
+ */
+func SelectWeighted(p *CoverPool, client net.Conn) int {
+	total := 0
+	for _, e := range p.entries {
+		total += e.weight
+	}
+	r := crypto.RandInt(0, total-1)
+	for i, e := range p.entries {
+		if r < e.weight {
+			return i
+		}
+		r -= e.weight
+	}
+	return len(p.entries) - 1
+}
+
+//---------------------------------------------------------------------
+/*
+ * Sticky selection: a client (identified by its remote address) is
+ * always assigned the same cover server; new clients are assigned a
+ * cover server by weighted selection. Assignments unused for longer
+ * than STICKY_TTL are dropped; at most STICKY_MAX_CLIENTS assignments
+ * are kept (the least recently used assignment is dropped first).
+ * N.B.: Clients are only distinguished by address -- if SID is running
+ * behind a Tor hidden service, all clients connect from the same local
+ * address and are assigned the same cover server.
+ * @param p *CoverPool - cover pool (locked)
+ * @param client net.Conn - client connection
+ * @return int - index of selected entry
+ */
+func SelectSticky(p *CoverPool, client net.Conn) int {
+	key := client.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+	now := time.Now()
+	if el, ok := p.sticky[key]; ok {
+		e := el.Value.(*stickyEntry)
+		if e.idx < len(p.entries) && now.Sub(e.used) < STICKY_TTL {
+			e.used = now
+			p.lru.MoveToFront(el)
+			return e.idx
+		}
+		p.lru.Remove(el)
+		delete(p.sticky, key)
+	}
+	// drop expired (or least recently used) assignments
+	for el := p.lru.Back(); el != nil; el = p.lru.Back() {
+		e := el.Value.(*stickyEntry)
+		if p.lru.Len() < STICKY_MAX_CLIENTS && now.Sub(e.used) < STICKY_TTL {
+			break
+		}
+		p.lru.Remove(el)
+		delete(p.sticky, e.client)
+	}
+	idx := SelectWeighted(p, client)
+	p.sticky[key] = p.lru.PushFront(&stickyEntry{key, idx, now})
+	return idx
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get selection strategy by name.
+ * @param name string - name of strategy (RANDOM, WEIGHTED, STICKY)
+ * @return CoverSelector - selection strategy (or nil if unknown)
+ */
+func GetCoverSelector(name string) CoverSelector {
+	switch strings.ToUpper(name) {
+	case "RANDOM":
+		return SelectRandom
+	case "WEIGHTED":
+		return SelectWeighted
+	case "STICKY":
+		return SelectSticky
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Parse a cover server specification from the configuration. The
+ * specification has the form "[<protocol>://]<host>[:<port>][;<weight>]"
+ * @param spec string - cover server specification
+ * @return name string - hostname of cover server
+ * @return port int - port of cover server
+ * @return protocol string - protocol ("http" or "https")
+ * @return weight int - selection weight
+ * @return err error - error object (or nil)
+ */
+func ParseCoverSpec(spec string) (name string, port int, protocol string, weight int, err error) {
+	protocol = "http"
+	weight = 1
+	if pos := strings.Index(spec, ";"); pos != -1 {
+		if weight, err = strconv.Atoi(strings.TrimSpace(spec[pos+1:])); err != nil {
+			return
+		}
+		spec = spec[:pos]
+	}
+	spec = strings.TrimSpace(spec)
+	if pos := strings.Index(spec, "://"); pos != -1 {
+		protocol = strings.ToLower(spec[:pos])
+		spec = spec[pos+3:]
+	}
+	switch protocol {
+	case "http":
+		port = 80
+	case "https":
+		port = 443
+	default:
+		err = errors.New("unknown protocol '" + protocol + "'")
+		return
+	}
+	name = spec
+	if host, p, e := net.SplitHostPort(spec); e == nil {
+		name = host
+		if port, err = strconv.Atoi(p); err != nil {
+			return
+		}
+	}
+	if len(name) == 0 {
+		err = errors.New("missing hostname")
+	}
+	return
+}
@@ -0,0 +1,291 @@
+/*
+ * Pool of cover servers: selection strategy and specification tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper types and functions
+
+/*
+ * Client connection with a given remote address.
+ */
+type testConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get remote address of connection.
+ * @return net.Addr - remote address
+ */
+func (c *testConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a client connection for an address.
+ * @param ip string - IP address of client
+ * @param port int - port of client
+ * @return net.Conn - client connection
+ */
+func clientConn(ip string, port int) net.Conn {
+	return &testConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a pool of cover servers with given weights.
+ * @param sel CoverSelector - selection strategy
+ * @param weights ...int - weights of cover servers
+ * @return *CoverPool - new pool
+ */
+func testPool(sel CoverSelector, weights ...int) *CoverPool {
+	p := NewCoverPool(sel)
+	for i, w := range weights {
+		p.Add(NewCover("cover"+strconv.Itoa(i)+".example.org", 80, "http"), w)
+	}
+	return p
+}
+
+//---------------------------------------------------------------------
+/*
+ * Count selections of cover servers.
+ * @param p *CoverPool - pool of cover servers
+ * @param n int - number of selections
+ * @return map[*Cover]int - number of selections per cover server
+ */
+func countSelections(p *CoverPool, n int) map[*Cover]int {
+	counts := make(map[*Cover]int)
+	for i := 0; i < n; i++ {
+		counts[p.Select(clientConn("10.0.0.1", 1000+i))]++
+	}
+	return counts
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Pool management: empty pools, weights and invalid selections.
+ */
+func TestCoverPool(t *testing.T) {
+	p := NewCoverPool(nil)
+	if p.Select(clientConn("10.0.0.1", 1)) != nil {
+		t.Fatal("cover selected from empty pool")
+	}
+	c1 := NewCover("one.example.org", 80, "http")
+	c2 := NewCover("two.example.org", 443, "https")
+	p.Add(c1, 0)
+	p.Add(c2, 5)
+	if p.Count() != 2 {
+		t.Fatalf("%d covers in pool", p.Count())
+	}
+	if list := p.Covers(); list[0] != c1 || list[1] != c2 {
+		t.Fatal("wrong list of covers")
+	}
+	if p.entries[0].weight != 1 || p.entries[1].weight != 5 {
+		t.Fatalf("weights %d/%d", p.entries[0].weight, p.entries[1].weight)
+	}
+
+	// invalid index from selector: first entry
+	for _, idx := range []int{-1, 2, 100} {
+		p.Selector = func(p *CoverPool, client net.Conn) int { return idx }
+		if p.Select(clientConn("10.0.0.1", 1)) != c1 {
+			t.Fatalf("index %d: first entry not used", idx)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Random selection: all cover servers are selected (about) equally
+ * often, regardless of their weight.
+ */
+func TestSelectRandom(t *testing.T) {
+	p := testPool(SelectRandom, 1, 10, 1)
+	counts := countSelections(p, 3000)
+	for _, c := range p.Covers() {
+		if n := counts[c]; n < 800 || n > 1200 {
+			t.Fatalf("cover '%s' selected %d of 3000 times", c.Name, n)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Weighted selection: cover servers are selected in proportion to
+ * their weight.
+ */
+func TestSelectWeighted(t *testing.T) {
+	p := testPool(SelectWeighted, 1, 3, 6)
+	counts := countSelections(p, 10000)
+	for i, c := range p.Covers() {
+		expect := p.entries[i].weight * 1000
+		if n := counts[c]; n < expect*8/10 || n > expect*12/10 {
+			t.Fatalf("cover '%s' selected %d times (expected %d)", c.Name, n, expect)
+		}
+	}
+	// single entry
+	p = testPool(SelectWeighted, 7)
+	if p.Select(clientConn("10.0.0.1", 1)) != p.Covers()[0] {
+		t.Fatal("single cover not selected")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Sticky selection: a client address is always assigned the same cover
+ * server (regardless of the client port).
+ */
+func TestSelectSticky(t *testing.T) {
+	p := testPool(SelectSticky, 1, 1, 1, 1)
+	seen := make(map[*Cover]bool)
+	for i := 0; i < 50; i++ {
+		ip := "10.0.1." + strconv.Itoa(i)
+		c := p.Select(clientConn(ip, 1000))
+		seen[c] = true
+		for port := 1001; port < 1010; port++ {
+			if p.Select(clientConn(ip, port)) != c {
+				t.Fatalf("client '%s' assigned different covers", ip)
+			}
+		}
+	}
+	if len(seen) < 2 {
+		t.Fatal("all clients assigned the same cover")
+	}
+	// IPv6 clients
+	c := p.Select(clientConn("2001:db8::1", 1000))
+	if p.Select(clientConn("2001:db8::1", 2000)) != c {
+		t.Fatal("IPv6 client assigned different covers")
+	}
+	if len(p.sticky) != 51 || p.lru.Len() != 51 {
+		t.Fatalf("%d/%d sticky assignments", len(p.sticky), p.lru.Len())
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Sticky assignments are limited in number and expire when unused.
+ */
+func TestSelectStickyEviction(t *testing.T) {
+	p := testPool(SelectSticky, 1, 1)
+	for i := 0; i < STICKY_MAX_CLIENTS+100; i++ {
+		p.Select(clientConn("10.1."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256), 1000))
+	}
+	if len(p.sticky) != STICKY_MAX_CLIENTS || p.lru.Len() != STICKY_MAX_CLIENTS {
+		t.Fatalf("%d/%d sticky assignments", len(p.sticky), p.lru.Len())
+	}
+	// least recently used assignments are dropped first
+	if _, ok := p.sticky["10.1.0.0"]; ok {
+		t.Fatal("oldest assignment not dropped")
+	}
+	if _, ok := p.sticky["10.1.0.100"]; !ok {
+		t.Fatal("recent assignment dropped")
+	}
+
+	// expired assignments are dropped
+	old := time.Now().Add(-2 * STICKY_TTL)
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		el.Value.(*stickyEntry).used = old
+	}
+	p.Select(clientConn("10.2.0.1", 1000))
+	if len(p.sticky) != 1 || p.lru.Len() != 1 {
+		t.Fatalf("%d/%d sticky assignments after expiry", len(p.sticky), p.lru.Len())
+	}
+	// an expired client gets a new assignment
+	p.lru.Front().Value.(*stickyEntry).used = old
+	p.Select(clientConn("10.2.0.1", 1001))
+	if e := p.lru.Front().Value.(*stickyEntry); e.client != "10.2.0.1" || time.Since(e.used) > time.Minute {
+		t.Fatal("expired assignment not renewed")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Selection strategies by name.
+ */
+func TestGetCoverSelector(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sel  CoverSelector
+	}{
+		{"random", SelectRandom},
+		{"WEIGHTED", SelectWeighted},
+		{"Sticky", SelectSticky},
+	} {
+		sel := GetCoverSelector(tc.name)
+		if sel == nil || reflect.ValueOf(sel).Pointer() != reflect.ValueOf(tc.sel).Pointer() {
+			t.Fatalf("wrong selector for '%s'", tc.name)
+		}
+	}
+	if GetCoverSelector("roundrobin") != nil {
+		t.Fatal("unknown selector accepted")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Cover server specifications from the configuration.
+ */
+func TestParseCoverSpec(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		name     string
+		port     int
+		protocol string
+		weight   int
+	}{
+		{"www.example.org", "www.example.org", 80, "http", 1},
+		{"https://www.example.org", "www.example.org", 443, "https", 1},
+		{"HTTP://www.example.org:8080;3", "www.example.org", 8080, "http", 3},
+		{" https://[2001:db8::1]:8443 ; 2", "2001:db8::1", 8443, "https", 2},
+	} {
+		name, port, protocol, weight, err := ParseCoverSpec(tc.spec)
+		if err != nil {
+			t.Fatalf("'%s': %s", tc.spec, err.Error())
+		}
+		if name != tc.name || port != tc.port || protocol != tc.protocol || weight != tc.weight {
+			t.Fatalf("'%s': %s/%d/%s/%d", tc.spec, name, port, protocol, weight)
+		}
+	}
+	for _, spec := range []string{
+		"ftp://www.example.org",
+		"www.example.org:http",
+		"www.example.org;heavy",
+		"https://",
+		":80",
+	} {
+		if _, _, _, _, err := ParseCoverSpec(spec); err == nil {
+			t.Fatalf("invalid specification '%s' accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+/*
+ * Reviewer registry: Public OpenPGP keys of the reviewers that receive
+ * the shares of document keys. Keys are read from a keyring file and
+ * from a directory of key files (binary or ASCII-armored); every key is
+ * checked for a usable encryption key, expiry and revocation.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/armor"
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"errors"
+	"fmt"
+	"github.com/bfix/gospel/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// warn about keys expiring within this period
+	REVIEWER_EXPIRY_WARN = 30 * 24 * time.Hour
+	// max. size of a key file
+	REVIEWER_MAX_KEYSIZE = 1024 * 1024
+)
+
+///////////////////////////////////////////////////////////////////////
+// Public types
+
+/*
+ * Reviewer: public key of a reviewer.
+ */
+type Reviewer struct {
+	Entity      *openpgp.Entity // public key
+	Id          string          // short key id (8 hex digits)
+	Fingerprint string          // fingerprint of primary key
+	Name        string          // name of (primary) identity
+	Expires     time.Time       // expiry of key (zero: never)
+	Source      string          // file the key was read from
+}
+
+//---------------------------------------------------------------------
+/*
+ * Reviewer registry: list of valid reviewer keys.
+ */
+type ReviewerRegistry struct {
+	dir      string      // directory of key files ("": none)
+	treshold int         // number of reviewers required to access documents
+	lock     sync.Mutex  // lock for list of reviewers
+	list     []*Reviewer // list of reviewers
+}
+
+///////////////////////////////////////////////////////////////////////
+// Public functions
+
+/*
+ * Create a new reviewer registry: keys are read from a keyring file
+ * and from all files in a directory.
+ * @param keyring string - name of keyring file ("": none)
+ * @param dir string - directory of key files ("": none)
+ * @param treshold int - number of reviewers required to access documents
+ * @return *ReviewerRegistry - new reviewer registry
+ * @return error - error object (or nil)
+ */
+func NewReviewerRegistry(keyring, dir string, treshold int) (*ReviewerRegistry, error) {
+	r := &ReviewerRegistry{
+		dir:      dir,
+		treshold: treshold,
+		list:     make([]*Reviewer, 0),
+	}
+	if len(keyring) > 0 {
+		if err := r.loadFile(keyring); err != nil {
+			return nil, errors.New("Can't read keyring file '" + keyring + "': " + err.Error())
+		}
+	}
+	if len(dir) > 0 {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, errors.New("Can't read reviewer directory '" + dir + "'")
+		}
+		for _, fi := range files {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			fname := filepath.Join(dir, fi.Name())
+			if err := r.loadFile(fname); err != nil {
+				logger.Printf(logger.WARN, "[sid.reviewer] Can't read key file '%s': %s\n", fname, err.Error())
+			}
+		}
+	}
+	if len(r.list) < treshold {
+		return nil, fmt.Errorf("only %d valid reviewer key(s) for a share treshold of %d", len(r.list), treshold)
+	}
+	return r, nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Public methods
+
+/*
+ * Get list of reviewers.
+ * @return []*Reviewer - list of reviewers
+ */
+func (r *ReviewerRegistry) List() []*Reviewer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*Reviewer(nil), r.list...)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get keys of reviewers that can be used now (keys that expired since
+ * they have been loaded are skipped).
+ * @return openpgp.EntityList - list of usable keys
+ * @return error - error object (not enough usable keys)
+ */
+func (r *ReviewerRegistry) Entities() (openpgp.EntityList, error) {
+	now := time.Now()
+	list := make(openpgp.EntityList, 0)
+	for _, rev := range r.List() {
+		if !rev.Expires.IsZero() && now.After(rev.Expires) {
+			logger.Printf(logger.WARN, "[sid.reviewer] Key of reviewer %s has expired\n", rev.Id)
+			continue
+		}
+		list = append(list, rev.Entity)
+	}
+	if len(list) < r.treshold {
+		return nil, fmt.Errorf("only %d usable reviewer key(s) for a share treshold of %d", len(list), r.treshold)
+	}
+	return list, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Add reviewer keys (binary or ASCII-armored): if the registry has a
+ * directory of key files, the keys are stored in a new file so they are
+ * available after a restart.
+ * @param data []byte - key data
+ * @return []*Reviewer - list of added reviewers
+ * @return error - error object (or nil)
+ */
+func (r *ReviewerRegistry) Add(data []byte) ([]*Reviewer, error) {
+	list, err := readReviewers(data, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no valid reviewer key found")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	added := make([]*Reviewer, 0)
+	for _, rev := range list {
+		if r.find(rev.Fingerprint) != -1 {
+			continue
+		}
+		if len(r.dir) > 0 {
+			rev.Source = filepath.Join(r.dir, rev.Fingerprint+".asc")
+			if err = writeArmoredKey(rev.Source, rev.Entity); err != nil {
+				return added, err
+			}
+		}
+		r.list = append(r.list, rev)
+		added = append(added, rev)
+		logger.Printf(logger.INFO, "[sid.reviewer] Reviewer added: %s\n", rev.String())
+	}
+	return added, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove a reviewer: a key file in the directory of key files is
+ * deleted if it only contains the key of the reviewer; other keys are
+ * only removed until the registry is loaded again.
+ * @param id string - short key id or fingerprint of reviewer
+ * @return *Reviewer - removed reviewer
+ * @return bool - key file deleted?
+ * @return error - error object (or nil)
+ */
+func (r *ReviewerRegistry) Remove(id string) (*Reviewer, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	pos := r.find(strings.ToUpper(id))
+	if pos == -1 {
+		return nil, false, errors.New("unknown reviewer '" + id + "'")
+	}
+	if len(r.list)-1 < r.treshold {
+		return nil, false, fmt.Errorf("share treshold of %d requires at least %d reviewers", r.treshold, r.treshold)
+	}
+	rev := r.list[pos]
+	r.list = append(r.list[:pos], r.list[pos+1:]...)
+	deleted := false
+	if len(r.dir) > 0 && filepath.Dir(rev.Source) == filepath.Clean(r.dir) {
+		if data, err := ioutil.ReadFile(rev.Source); err == nil {
+			if keys, err := readKeys(data); err == nil && len(keys) == 1 {
+				deleted = (os.Remove(rev.Source) == nil)
+			}
+		}
+	}
+	logger.Printf(logger.INFO, "[sid.reviewer] Reviewer removed: %s\n", rev.String())
+	return rev, deleted, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Log summary of reviewer keys.
+ */
+func (r *ReviewerRegistry) LogSummary() {
+	list := r.List()
+	logger.Printf(logger.INFO, "[sid.reviewer] %d reviewer(s), share treshold %d\n", len(list), r.treshold)
+	for _, rev := range list {
+		logger.Printf(logger.INFO, "[sid.reviewer]   %s\n", rev.String())
+		if !rev.Expires.IsZero() && rev.Expires.Sub(time.Now()) < REVIEWER_EXPIRY_WARN {
+			logger.Printf(logger.WARN, "[sid.reviewer] Key of reviewer %s expires on %s\n", rev.Id, rev.Expires.Format("2006-01-02"))
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get printable description of reviewer.
+ * @return string - description
+ */
+func (rev *Reviewer) String() string {
+	exp := "never"
+	if !rev.Expires.IsZero() {
+		exp = rev.Expires.Format("2006-01-02")
+	}
+	return fmt.Sprintf("%s '%s' [%s] expires %s", rev.Id, rev.Name, rev.Fingerprint, exp)
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper methods
+
+/*
+ * Read reviewer keys from a file.
+ * @param fname string - name of key file
+ * @return error - error object (or nil)
+ */
+func (r *ReviewerRegistry) loadFile(fname string) error {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > REVIEWER_MAX_KEYSIZE {
+		return errors.New("file too large")
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	list, err := readReviewers(data, fname)
+	if err != nil {
+		return err
+	}
+	for _, rev := range list {
+		if r.find(rev.Fingerprint) != -1 {
+			logger.Printf(logger.WARN, "[sid.reviewer] Duplicate key %s in '%s' ignored\n", rev.Id, fname)
+			continue
+		}
+		r.list = append(r.list, rev)
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Find reviewer by short key id or fingerprint.
+ * @param id string - short key id or fingerprint (upper case)
+ * @return int - index of reviewer (-1: not found)
+ */
+func (r *ReviewerRegistry) find(id string) int {
+	for i, rev := range r.list {
+		if rev.Id == id || rev.Fingerprint == id {
+			return i
+		}
+	}
+	return -1
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Read and validate reviewer keys: invalid keys are skipped (with a
+ * warning).
+ * @param data []byte - key data (binary or ASCII-armored)
+ * @param source string - name of key file
+ * @return []*Reviewer - list of valid reviewer keys
+ * @return error - error object (or nil)
+ */
+func readReviewers(data []byte, source string) ([]*Reviewer, error) {
+	keys, err := readKeys(data)
+	if err != nil {
+		return nil, err
+	}
+	subSigs := readSubkeySigs(data)
+	now := time.Now()
+	list := make([]*Reviewer, 0)
+	for _, ent := range keys {
+		rev, err := newReviewer(ent, subSigs, now)
+		if err != nil {
+			logger.Printf(logger.WARN, "[sid.reviewer] Key %08X rejected: %s\n", ent.PrimaryKey.KeyId&0xFFFFFFFF, err.Error())
+			continue
+		}
+		rev.Source = source
+		list = append(list, rev)
+	}
+	return list, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Read public keys (binary or ASCII-armored).
+ * @param data []byte - key data
+ * @return openpgp.EntityList - list of keys
+ * @return error - error object (or nil)
+ */
+func readKeys(data []byte) (openpgp.EntityList, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+//---------------------------------------------------------------------
+/*
+ * Collect the signatures of all subkeys in key data: an entity keeps
+ * only one signature for every subkey, but a subkey can have several
+ * binding and revocation signatures.
+ * @param data []byte - key data (binary or ASCII-armored)
+ * @return map[uint64][]*packet.Signature - signatures of subkeys (by key id)
+ */
+func readSubkeySigs(data []byte) map[uint64][]*packet.Signature {
+	sigs := make(map[uint64][]*packet.Signature)
+	var rdr io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		block, err := armor.Decode(rdr)
+		if err != nil {
+			return sigs
+		}
+		rdr = block.Body
+	}
+	packets := packet.NewReader(rdr)
+	var sub *packet.PublicKey
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			break
+		}
+		switch pkt := p.(type) {
+		case *packet.PublicKey:
+			sub = nil
+			if pkt.IsSubkey {
+				sub = pkt
+			}
+		case *packet.UserId:
+			sub = nil
+		case *packet.Signature:
+			if sub != nil {
+				sigs[sub.KeyId] = append(sigs[sub.KeyId], pkt)
+			}
+		}
+	}
+	return sigs
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check reviewer key: the key must not be revoked (by a valid revocation
+ * signature) or expired and must have a valid key for encryption. Only
+ * valid subkeys are kept in the key.
+ * @param ent *openpgp.Entity - public key
+ * @param subSigs map[uint64][]*packet.Signature - all signatures of subkeys
+ * @param now time.Time - reference time
+ * @return *Reviewer - reviewer for key
+ * @return error - error object (or nil)
+ */
+func newReviewer(ent *openpgp.Entity, subSigs map[uint64][]*packet.Signature, now time.Time) (*Reviewer, error) {
+	for _, sig := range ent.Revocations {
+		if err := ent.PrimaryKey.VerifyRevocationSignature(sig); err != nil {
+			logger.Printf(logger.WARN, "[sid.reviewer] Invalid revocation of key %08X ignored\n", ent.PrimaryKey.KeyId&0xFFFFFFFF)
+			continue
+		}
+		return nil, errors.New("key revoked")
+	}
+	// primary identity
+	var id *openpgp.Identity
+	for _, ident := range ent.Identities {
+		if ident.SelfSignature == nil {
+			continue
+		}
+		if id == nil || (ident.SelfSignature.IsPrimaryId != nil && *ident.SelfSignature.IsPrimaryId) {
+			id = ident
+		}
+	}
+	if id == nil {
+		return nil, errors.New("no valid identity")
+	}
+	expires := keyExpiry(ent.PrimaryKey, id.SelfSignature)
+	if !expires.IsZero() && now.After(expires) {
+		return nil, errors.New("key expired on " + expires.Format("2006-01-02"))
+	}
+	// key for encryption: subkey or primary key
+	var encExpires time.Time
+	found := false
+	subkeys := make([]openpgp.Subkey, 0)
+	for _, sub := range ent.Subkeys {
+		sig := subkeyBinding(ent, sub, subSigs[sub.PublicKey.KeyId])
+		if sig == nil {
+			continue
+		}
+		sub.Sig = sig
+		subkeys = append(subkeys, sub)
+		if !canEncrypt(sub.PublicKey, sig) {
+			continue
+		}
+		exp := keyExpiry(sub.PublicKey, sig)
+		if !exp.IsZero() && now.After(exp) {
+			continue
+		}
+		if !found || (!encExpires.IsZero() && (exp.IsZero() || exp.After(encExpires))) {
+			encExpires = exp
+		}
+		found = true
+	}
+	if !found && canEncrypt(ent.PrimaryKey, id.SelfSignature) {
+		found = true
+	}
+	if !found {
+		return nil, errors.New("no valid encryption key")
+	}
+	if expires.IsZero() || (!encExpires.IsZero() && encExpires.Before(expires)) {
+		expires = encExpires
+	}
+	ent.Subkeys = subkeys
+	return &Reviewer{
+		Entity:      ent,
+		Id:          fmt.Sprintf("%08X", ent.PrimaryKey.KeyId&0xFFFFFFFF),
+		Fingerprint: fmt.Sprintf("%X", ent.PrimaryKey.Fingerprint),
+		Name:        id.Name,
+		Expires:     expires,
+	}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get the binding signature of a subkey: all signatures of the subkey
+ * are verified; a valid revocation invalidates the subkey, otherwise
+ * the latest valid binding signature is used.
+ * @param ent *openpgp.Entity - public key
+ * @param sub openpgp.Subkey - subkey
+ * @param sigs []*packet.Signature - further signatures of subkey
+ * @return *packet.Signature - binding signature (nil: invalid subkey)
+ */
+func subkeyBinding(ent *openpgp.Entity, sub openpgp.Subkey, sigs []*packet.Signature) *packet.Signature {
+	if sub.Sig != nil {
+		sigs = append([]*packet.Signature{sub.Sig}, sigs...)
+	}
+	var binding *packet.Signature
+	for _, sig := range sigs {
+		if ent.PrimaryKey.VerifyKeySignature(sub.PublicKey, sig) != nil {
+			continue
+		}
+		switch sig.SigType {
+		case packet.SigTypeSubkeyRevocation:
+			return nil
+		case packet.SigTypeSubkeyBinding:
+			if binding == nil || sig.CreationTime.After(binding.CreationTime) {
+				binding = sig
+			}
+		}
+	}
+	return binding
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if a key can be used for encryption.
+ * @param key *packet.PublicKey - public key
+ * @param sig *packet.Signature - self-signature of key
+ * @return bool - key usable for encryption?
+ */
+func canEncrypt(key *packet.PublicKey, sig *packet.Signature) bool {
+	if !key.PubKeyAlgo.CanEncrypt() {
+		return false
+	}
+	return !sig.FlagsValid || sig.FlagEncryptCommunications || sig.FlagEncryptStorage
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get expiry of a key.
+ * @param key *packet.PublicKey - public key
+ * @param sig *packet.Signature - self-signature of key
+ * @return time.Time - expiry of key (zero: never)
+ */
+func keyExpiry(key *packet.PublicKey, sig *packet.Signature) time.Time {
+	if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return key.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write ASCII-armored public key to file.
+ * @param fname string - name of key file
+ * @param ent *openpgp.Entity - public key
+ * @return error - error object (or nil)
+ */
+func writeArmoredKey(fname string, ent *openpgp.Entity) error {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	wrt := bufio.NewWriter(f)
+	var aw io.WriteCloser
+	if aw, err = armor.Encode(wrt, openpgp.PublicKeyType, nil); err == nil {
+		if err = ent.Serialize(aw); err == nil {
+			if err = aw.Close(); err == nil {
+				err = wrt.Flush()
+			}
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fname)
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+/*
+ * Reviewer registry: key validation tests (with keys generated by
+ * GnuPG in the 'testdata' directory).
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Read a test key.
+ * @param t *testing.T - test instance
+ * @param name string - name of key ("reviewer-<name>.asc" in 'testdata')
+ * @return *openpgp.Entity - public key
+ * @return map[uint64][]*packet.Signature - all signatures of subkeys
+ */
+func testKey(t *testing.T, name string) (*openpgp.Entity, map[uint64][]*packet.Signature) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "reviewer-"+name+".asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := readKeys(data)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err.Error())
+	}
+	if len(keys) != 1 {
+		t.Fatalf("%s: %d keys", name, len(keys))
+	}
+	return keys[0], readSubkeySigs(data)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Find a signature of a given type.
+ * @param sigs []*packet.Signature - list of signatures
+ * @param sigType packet.SignatureType - type of signature
+ * @return *packet.Signature - first signature of type (or nil)
+ */
+func findSig(sigs []*packet.Signature, sigType packet.SignatureType) *packet.Signature {
+	for _, sig := range sigs {
+		if sig.SigType == sigType {
+			return sig
+		}
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Valid keys are accepted; revoked and expired keys and keys without a
+ * valid encryption key are rejected.
+ */
+func TestReviewerKeys(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name    string
+		err     string
+		subkeys int
+	}{
+		{"valid", "", 1},
+		{"subkeys", "", 1},
+		{"renewed", "", 1},
+		{"revoked", "key revoked", 0},
+		{"expired", "key expired on 2020-01-31", 0},
+		{"sign", "no valid encryption key", 0},
+	} {
+		ent, sigs := testKey(t, tc.name)
+		rev, err := newReviewer(ent, sigs, now)
+		if len(tc.err) > 0 {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("%s: error '%v' (expected '%s')", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err.Error())
+		}
+		if !rev.Expires.IsZero() || !strings.HasSuffix(rev.Name, "<"+tc.name+"@example.org>") {
+			t.Fatalf("%s: reviewer %s", tc.name, rev.String())
+		}
+		if len(rev.Entity.Subkeys) != tc.subkeys {
+			t.Fatalf("%s: %d valid subkeys", tc.name, len(rev.Entity.Subkeys))
+		}
+	}
+
+	// keys in a directory: only valid keys are used
+	if _, err := NewReviewerRegistry("", "testdata", 4); err == nil {
+		t.Fatal("invalid keys in registry")
+	}
+	r, err := NewReviewerRegistry("", "testdata", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, err := r.Entities(); err != nil || len(list) != 3 {
+		t.Fatal("wrong list of usable keys")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Only revocations signed by the key itself revoke a key.
+ */
+func TestReviewerRevocation(t *testing.T) {
+	revoked, _ := testKey(t, "revoked")
+	if len(revoked.Revocations) != 1 {
+		t.Fatalf("%d revocations", len(revoked.Revocations))
+	}
+	ent, sigs := testKey(t, "valid")
+	ent.Revocations = append(ent.Revocations, revoked.Revocations[0])
+	if _, err := newReviewer(ent, sigs, time.Now()); err != nil {
+		t.Fatalf("revocation by other key accepted: %s", err.Error())
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * All signatures of a subkey are checked: a revoked subkey is never
+ * used, and the latest binding signature defines the expiry of a
+ * subkey (regardless of the signature kept in the key).
+ */
+func TestReviewerSubkeySigs(t *testing.T) {
+	now := time.Now()
+
+	// revoked subkey with a valid binding signature
+	ent, sigs := testKey(t, "subkeys")
+	if len(ent.Subkeys) != 2 {
+		t.Fatalf("%d subkeys", len(ent.Subkeys))
+	}
+	revokedId := ent.Subkeys[0].PublicKey.KeyId
+	if findSig(sigs[revokedId], packet.SigTypeSubkeyRevocation) == nil {
+		t.Fatal("subkey revocation not found")
+	}
+	ent.Subkeys[0].Sig = findSig(sigs[revokedId], packet.SigTypeSubkeyBinding)
+	rev, err := newReviewer(ent, sigs, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rev.Entity.Subkeys) != 1 || rev.Entity.Subkeys[0].PublicKey.KeyId == revokedId {
+		t.Fatal("revoked subkey used")
+	}
+	ent, sigs = testKey(t, "subkeys")
+	ent.Subkeys = ent.Subkeys[:1]
+	if _, err = newReviewer(ent, sigs, now); err == nil {
+		t.Fatal("key with revoked subkey only accepted")
+	}
+
+	// renewed subkey (expired binding signature kept in the key)
+	ent, sigs = testKey(t, "renewed")
+	subId := ent.Subkeys[0].PublicKey.KeyId
+	if len(sigs[subId]) != 2 {
+		t.Fatalf("%d subkey signatures", len(sigs[subId]))
+	}
+	ent.Subkeys[0].Sig = sigs[subId][0]
+	if rev, err = newReviewer(ent, sigs, now); err != nil || !rev.Expires.IsZero() {
+		t.Fatalf("renewed subkey not used: %v", err)
+	}
+	ent, _ = testKey(t, "renewed")
+	ent.Subkeys[0].Sig = sigs[subId][0]
+	if _, err = newReviewer(ent, nil, now); err == nil {
+		t.Fatal("expired subkey used")
+	}
+
+	// signatures by other keys are ignored
+	other, otherSigs := testKey(t, "subkeys")
+	ent, sigs = testKey(t, "valid")
+	subId = ent.Subkeys[0].PublicKey.KeyId
+	sigs[subId] = append(sigs[subId], findSig(otherSigs[other.Subkeys[0].PublicKey.KeyId], packet.SigTypeSubkeyRevocation))
+	if _, err = newReviewer(ent, sigs, now); err != nil {
+		t.Fatalf("revocation by other key accepted: %s", err.Error())
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Network services: Connections are accepted on a TCP (or TLS) socket
+ * and passed (after a successful TLS handshake) to the first service
+ * instance that accepts the connection.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/bfix/gospel/logger"
+	"github.com/bfix/gospel/network"
+	"net"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// delay after failed accepts (doubled on every failure)
+	ACCEPT_DELAY_MIN = 5 * time.Millisecond
+	ACCEPT_DELAY_MAX = time.Second
+)
+
+///////////////////////////////////////////////////////////////////////
+// Public types
+
+/*
+ * Listener for network services: Connections are accepted on a TCP
+ * (or TLS) socket and handled in separate go-routines. The listener
+ * keeps track of active connections, so that a shutdown can wait for
+ * running sessions to finish.
+ */
+type ServiceListener struct {
+	Addr     string            // listener address
+	listener net.Listener      // TCP (or TLS) listener
+	hdlrs    []network.Service // list of service handlers
+	active   activeGroup       // active connections
+}
+
+///////////////////////////////////////////////////////////////////////
+// Local types
+
+/*
+ * Group of active tasks (connections or uploads): once the group is
+ * closed, no further tasks are added, so waiting for the group can't
+ * race with tasks started during a shutdown.
+ */
+type activeGroup struct {
+	lock   sync.Mutex     // lock for closed flag
+	tasks  sync.WaitGroup // active tasks
+	closed bool           // group closed?
+}
+
+///////////////////////////////////////////////////////////////////////
+// Public functions
+
+/*
+ * Create TLS configuration for a server from certificate and key files
+ * (PEM-encoded).
+ * @param certFile string - name of certificate file (incl. chain)
+ * @param keyFile string - name of private key file
+ * @return *tls.Config - TLS configuration
+ * @return error - error object (or nil)
+ */
+func NewServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Start service handlers on a listener: the listener is running in
+ * its own go-routine, every connection is handled in a separate
+ * go-routine.
+ * @param addr string - listener address
+ * @param cfg *tls.Config - TLS configuration (nil: plain TCP)
+ * @param hdlrs []network.Service - list of service handlers
+ * @return *ServiceListener - running listener
+ * @return error - error object (or nil)
+ */
+func StartService(addr string, cfg *tls.Config, hdlrs []network.Service) (*ServiceListener, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+	if cfg != nil {
+		listener, err = tls.Listen("tcp", addr, cfg)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		logger.Println(logger.ERROR, "[sid.service] Failed to start listener: "+err.Error())
+		return nil, err
+	}
+	logger.Println(logger.INFO, "[sid.service] Listener started on "+addr)
+	l := &ServiceListener{
+		Addr:     addr,
+		listener: listener,
+		hdlrs:    hdlrs,
+	}
+	go l.run()
+	return l, nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// Public methods
+
+/*
+ * Stop accepting new connections; active connections are not affected.
+ */
+func (l *ServiceListener) Close() {
+	l.active.close()
+	l.listener.Close()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Wait for active connections to end.
+ * @param timeout time.Duration - max. waiting time
+ * @param abort <-chan bool - waiting is aborted when closed (or nil)
+ * @return bool - all connections ended?
+ */
+func (l *ServiceListener) Wait(timeout time.Duration, abort <-chan bool) bool {
+	done := make(chan bool)
+	go func() {
+		l.active.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	case <-abort:
+		return false
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper methods
+
+/*
+ * Accept loop of listener.
+ */
+func (l *ServiceListener) run() {
+	delay := time.Duration(0)
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logger.Println(logger.INFO, "[sid.service] Listener on "+l.Addr+" stopped.")
+				return
+			}
+			// back off on other errors (e.g. too many open files)
+			if delay == 0 {
+				delay = ACCEPT_DELAY_MIN
+			} else if delay *= 2; delay > ACCEPT_DELAY_MAX {
+				delay = ACCEPT_DELAY_MAX
+			}
+			logger.Printf(logger.WARN, "[sid.service] Accept on %s failed: %s -- retrying in %v\n", l.Addr, err.Error(), delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		// no new connections after the listener is closed
+		if !l.active.add() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer l.active.done()
+			l.handleConnection(conn)
+		}()
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Handle incoming connection: find a service handler for the
+ * connection and complete the TLS handshake (if required) before
+ * the connection is processed.
+ * @param conn net.Conn - client connection
+ */
+func (l *ServiceListener) handleConnection(conn net.Conn) {
+	addr := conn.RemoteAddr().String()
+	for _, hdlr := range l.hdlrs {
+		if !hdlr.CanHandle("tcp") || !hdlr.IsAllowed(addr) {
+			continue
+		}
+		if tc, ok := conn.(*tls.Conn); ok {
+			tc.SetDeadline(time.Now().Add(TLS_TIMEOUT))
+			if err := tc.Handshake(); err != nil {
+				logger.Printf(logger.WARN, "[sid.service] TLS handshake with '%s' failed: %s\n", addr, err.Error())
+				conn.Close()
+				return
+			}
+			tc.SetDeadline(time.Time{})
+		}
+		logger.Printf(logger.INFO, "[sid.service] Connection from '%s' handled by '%s'\n", addr, hdlr.GetName())
+		hdlr.Process(conn)
+		return
+	}
+	logger.Printf(logger.WARN, "[sid.service] Unhandled connection from '%s'\n", addr)
+	conn.Close()
+}
+
+///////////////////////////////////////////////////////////////////////
+// activeGroup methods
+
+/*
+ * Add a task to the group.
+ * @return bool - task added (false: group is closed)
+ */
+func (g *activeGroup) add() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return false
+	}
+	g.tasks.Add(1)
+	return true
+}
+
+//---------------------------------------------------------------------
+/*
+ * Task of the group has finished.
+ */
+func (g *activeGroup) done() {
+	g.tasks.Done()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Close group: no further tasks are added.
+ */
+func (g *activeGroup) close() {
+	g.lock.Lock()
+	g.closed = true
+	g.lock.Unlock()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Wait for all tasks of the group to finish (the group is closed
+ * first).
+ */
+func (g *activeGroup) wait() {
+	g.close()
+	g.tasks.Wait()
+}
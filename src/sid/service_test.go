@@ -0,0 +1,136 @@
+/*
+ * Network services: listener tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"github.com/bfix/gospel/network"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper types
+
+/*
+ * Service that keeps connections open until released.
+ */
+type holdSrv struct {
+	release chan bool
+}
+
+func (s *holdSrv) Process(conn net.Conn) {
+	<-s.release
+	conn.Close()
+}
+func (s *holdSrv) CanHandle(protocol string) bool { return true }
+func (s *holdSrv) IsAllowed(addr string) bool     { return true }
+func (s *holdSrv) GetName() string                { return "sid.test" }
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Waiting for active connections ends when the connections end, on
+ * timeout or when it is aborted.
+ */
+func TestListenerWait(t *testing.T) {
+	srv := &holdSrv{release: make(chan bool)}
+	l, err := StartService("127.0.0.1:0", nil, []network.Service{srv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", l.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	l.Close()
+
+	if l.Wait(50*time.Millisecond, nil) {
+		t.Fatal("active connection not detected")
+	}
+	abort := make(chan bool)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(abort)
+	}()
+	start := time.Now()
+	if l.Wait(time.Minute, abort) {
+		t.Fatal("active connection not detected")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("waiting not aborted")
+	}
+	close(srv.release)
+	if !l.Wait(time.Minute, nil) {
+		t.Fatal("connection did not end")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * A closed listener accepts no further connections; tasks can't be
+ * added to a group while (or after) waiting for it.
+ */
+func TestListenerClosed(t *testing.T) {
+	srv := &holdSrv{release: make(chan bool)}
+	close(srv.release)
+	l, err := StartService("127.0.0.1:0", nil, []network.Service{srv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.listener.Addr().String()
+	l.Close()
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("connection to closed listener accepted")
+	}
+	if l.active.add() {
+		t.Fatal("connection added to closed listener")
+	}
+	if !l.Wait(time.Second, nil) {
+		t.Fatal("closed listener has active connections")
+	}
+
+	// concurrent tasks and waiting
+	g := new(activeGroup)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if g.add() {
+				time.Sleep(time.Millisecond)
+				g.done()
+			}
+		}()
+	}
+	g.wait()
+	if g.add() {
+		t.Fatal("task added after waiting")
+	}
+	wg.Wait()
+}
@@ -0,0 +1,231 @@
+/*
+ * Session registry: Keep track of active client sessions of a cover
+ * server instance. The registry is shared among all HTTP go-routines
+ * and can safely be accessed concurrently.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Local variables
+
+// last assigned session identifier
+var lastSessionId uint64 = 0
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Registry of active sessions (states associated with connections
+ * to a cover server). The zero value is an empty registry ready
+ * to use.
+ */
+type SessionRegistry struct {
+	lock sync.RWMutex        // lock for concurrent access
+	list map[net.Conn]*State // state of active connections
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new (empty) session registry.
+ * @return *SessionRegistry - reference to new registry
+ */
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		list: make(map[net.Conn]*State),
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Register state for a connection.
+ * @param conn net.Conn - connection to cover server
+ * @param s *State - associated state
+ */
+func (r *SessionRegistry) Add(conn net.Conn, s *State) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.list == nil {
+		r.list = make(map[net.Conn]*State)
+	}
+	r.list[conn] = s
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove state for a connection from the registry.
+ * @param conn net.Conn - connection to cover server
+ * @return *State - removed state (or nil if not registered)
+ */
+func (r *SessionRegistry) Remove(conn net.Conn) *State {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s, ok := r.list[conn]
+	if !ok {
+		return nil
+	}
+	delete(r.list, conn)
+	return s
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get state associated with given connection.
+ * @param conn net.Conn - connection to cover server
+ * @return *State - associated state (or nil if not registered)
+ */
+func (r *SessionRegistry) Get(conn net.Conn) *State {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.list[conn]
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get number of active sessions.
+ * @return int - number of registered sessions
+ */
+func (r *SessionRegistry) Count() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.list)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get a snapshot of all active sessions.
+ * @return []*State - list of registered states
+ */
+func (r *SessionRegistry) List() []*State {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	out := make([]*State, 0, len(r.list))
+	for _, s := range r.list {
+		out = append(out, s)
+	}
+	return out
+}
+
+//---------------------------------------------------------------------
+/*
+ * Find an active session by its identifier.
+ * @param id uint64 - session identifier
+ * @return *State - associated state (or nil if not registered)
+ */
+func (r *SessionRegistry) Find(id uint64) *State {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, s := range r.list {
+		if s.Id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Summary of a session (snapshot of the state).
+ */
+type SessionInfo struct {
+	Id          uint64    // session identifier
+	Client      string    // remote address of client
+	Started     time.Time // start of session
+	Mode        string    // current request type (GET, POST)
+	Resource    string    // resource requested by client
+	BytesIn     int64     // number of bytes received from client
+	BytesOut    int64     // number of bytes sent to client
+	PostPos     int       // index into cover POST content
+	PostSize    int       // size of cover POST content
+	Upload      bool      // document upload in progress?
+	UploadCount int       // number of completed document uploads
+	UploadOK    bool      // uploads successful so far?
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get a summary of the session state: the state is locked while the
+ * summary is created.
+ * @return *SessionInfo - session summary
+ */
+func (s *State) Summary() *SessionInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	mode := "-"
+	switch s.ReqMode {
+	case REQ_GET:
+		mode = "GET"
+	case REQ_POST:
+		mode = "POST"
+	}
+	return &SessionInfo{
+		Id:          s.Id,
+		Client:      s.Client,
+		Started:     s.Started,
+		Mode:        mode,
+		Resource:    s.ReqResource,
+		BytesIn:     s.BytesIn,
+		BytesOut:    s.BytesOut,
+		PostPos:     s.ReqCoverPostPos,
+		PostSize:    len(s.ReqCoverPost),
+		Upload:      s.ReqUpload,
+		UploadCount: s.ReqUploadCount,
+		UploadOK:    s.ReqUploadOK,
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Terminate session: the session ends (and releases all resources)
+ * the next time the session loop is entered.
+ */
+func (s *State) Kill() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.killed = true
+}
+
+//---------------------------------------------------------------------
+/*
+ * Check if the session has been terminated.
+ * @return bool - session terminated?
+ */
+func (s *State) Killed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.killed
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Get a new (unique) session identifier.
+ * @return uint64 - session identifier
+ */
+func nextSessionId() uint64 {
+	return atomic.AddUint64(&lastSessionId, 1)
+}
@@ -0,0 +1,131 @@
+/*
+ * Session registry: concurrent access tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+// number of concurrent go-routines in tests
+const numRoutines = 50
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * Run go-routines that add, look up and remove sessions concurrently
+ * while other go-routines list the registry.
+ */
+func TestSessionRegistryConcurrent(t *testing.T) {
+	var r SessionRegistry // zero value must be usable
+	var wg sync.WaitGroup
+	done := make(chan bool)
+
+	// readers: list and count sessions until all writers are done
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, s := range r.List() {
+					r.Find(s.Id)
+				}
+				r.Count()
+			}
+		}()
+	}
+
+	// writers: each go-routine handles its own session
+	errs := make(chan string, numRoutines)
+	var ww sync.WaitGroup
+	for i := 0; i < numRoutines; i++ {
+		ww.Add(1)
+		go func() {
+			defer ww.Done()
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			defer peer.Close()
+			s := &State{Id: nextSessionId()}
+			r.Add(conn, s)
+			if r.Get(conn) != s {
+				errs <- "registered state not found"
+				return
+			}
+			if r.Find(s.Id) != s {
+				errs <- "state not found by id"
+				return
+			}
+			if r.Remove(conn) != s {
+				errs <- "removed wrong state"
+				return
+			}
+			if r.Get(conn) != nil || r.Remove(conn) != nil {
+				errs <- "state still registered after removal"
+			}
+		}()
+	}
+	ww.Wait()
+	close(done)
+	wg.Wait()
+	close(errs)
+	for msg := range errs {
+		t.Error(msg)
+	}
+	if n := r.Count(); n != 0 {
+		t.Fatalf("%d sessions left in registry", n)
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Session identifiers are unique across go-routines.
+ */
+func TestSessionIdUnique(t *testing.T) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[uint64]bool)
+	for i := 0; i < numRoutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := nextSessionId()
+			lock.Lock()
+			defer lock.Unlock()
+			if seen[id] {
+				t.Errorf("duplicate session id %d", id)
+			}
+			seen[id] = true
+		}()
+	}
+	wg.Wait()
+}
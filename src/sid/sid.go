@@ -31,7 +31,21 @@ package sid
 import (
 	"github.com/bfix/gospel/logger"
 	"github.com/bfix/gospel/network"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	SID_VERSION = "0.3" // version of SID implementation
+
+	// max. time to wait for terminated sessions on shutdown
+	SHUTDOWN_KILL_WAIT = 5 * time.Second
 )
 
 ///////////////////////////////////////////////////////////////////////
@@ -41,6 +55,12 @@ import (
  */
 var CustomInitialization func() *Cover = nil
 
+/*
+ * Optional custom initialization of the cover pool: register
+ * additional cover instances with the pool.
+ */
+var CustomPoolInitialization func(pool *CoverPool) = nil
+
 /*
  * Optional HTTP fallback handler.
  */
@@ -58,7 +78,7 @@ var HttpActive bool = true
 func Startup() {
 
 	logger.Println(logger.INFO, "[sid] ==============================")
-	logger.Println(logger.INFO, "[sid] SID v0.3 -- Server In Disguise")
+	logger.Println(logger.INFO, "[sid] SID v"+SID_VERSION+" -- Server In Disguise")
 	logger.Println(logger.INFO, "[sid] (c) 2011-2012 Bernd R. Fix >Y<")
 	logger.Println(logger.INFO, "[sid] ==============================")
 
@@ -81,11 +101,42 @@ func Startup() {
 
 	InitDocumentHandler(CfgData.Upload)
 
-	if CustomInitialization == nil {
+	if CustomInitialization == nil && CustomPoolInitialization == nil {
 		logger.Println(logger.ERROR, "[sid] No custom initialization function defined -- aborting!")
 		return
 	}
-	cover := CustomInitialization()
+	sel := GetCoverSelector(CfgData.Covers.Select)
+	if sel == nil {
+		logger.Printf(logger.ERROR, "[sid] Unknown cover selection strategy '%s' -- aborting!\n", CfgData.Covers.Select)
+		return
+	}
+	pool := NewCoverPool(sel)
+	if CustomInitialization != nil {
+		// the custom cover instance is the template for all cover
+		// servers defined in the configuration.
+		if cover := CustomInitialization(); cover != nil {
+			pool.Add(cover, 1)
+			for _, spec := range CfgData.Covers.Servers {
+				name, port, protocol, weight, err := ParseCoverSpec(spec)
+				if err != nil {
+					logger.Printf(logger.ERROR, "[sid] Invalid cover server '%s': %s -- aborting!\n", spec, err.Error())
+					return
+				}
+				pool.Add(cover.Clone(name, port, protocol), weight)
+			}
+		}
+	}
+	if CustomPoolInitialization != nil {
+		CustomPoolInitialization(pool)
+	}
+	if pool.Count() == 0 {
+		logger.Println(logger.ERROR, "[sid] No cover server defined -- aborting!")
+		return
+	}
+	if err := ApplyCoverPins(pool, CfgData.Covers.Pins); err != nil {
+		logger.Printf(logger.ERROR, "[sid] Invalid cover server pin: %s -- aborting!\n", err.Error())
+		return
+	}
 
 	//-----------------------------------------------------------------
 	//	Start network services
@@ -93,13 +144,13 @@ func Startup() {
 
 	// create control service.
 	ch := make(chan bool)
-	ctrl := &ControlSrv{ch}
+	ctrl := NewControlSrv(ch, pool)
 	ctrlList := []network.Service{ctrl}
 
 	// create HTTP service
 	httpList := make([]network.Service, 0)
 	if HttpActive {
-		http := NewHttpSrv(cover)
+		http := NewHttpSrv(pool)
 		httpList = append(httpList, http)
 	}
 	if HttpFallback != nil {
@@ -107,12 +158,109 @@ func Startup() {
 	}
 
 	// start network services
-	network.RunService("tcp", ":"+strconv.Itoa(CfgData.CtrlPort), ctrlList)
+	ctrlSrv, err := StartService(":"+strconv.Itoa(CfgData.CtrlPort), nil, ctrlList)
+	if err != nil {
+		return
+	}
+	httpSrvs := make([]*ServiceListener, 0)
 	if len(httpList) > 0 {
-		network.RunService("tcp", ":"+strconv.Itoa(CfgData.HttpPort), httpList)
+		l, err := StartService(":"+strconv.Itoa(CfgData.HttpPort), nil, httpList)
+		if err != nil {
+			return
+		}
+		httpSrvs = append(httpSrvs, l)
+
+		// optional HTTPS listener for the same services
+		if CfgData.HttpsPort > 0 {
+			cfg, err := NewServerTLSConfig(CfgData.HttpsCert, CfgData.HttpsKey)
+			if err != nil {
+				logger.Println(logger.ERROR, "[sid] Failed to load HTTPS certificate: "+err.Error()+" -- aborting!")
+				return
+			}
+			if l, err = StartService(":"+strconv.Itoa(CfgData.HttpsPort), cfg, httpList); err != nil {
+				return
+			}
+			httpSrvs = append(httpSrvs, l)
+		}
 	}
 
-	// wait for termination
-	<-ch
+	// reload configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Println(logger.INFO, "[sid] SIGHUP received.")
+			ReloadConfig()
+		}
+	}()
+
+	// wait for termination (control service or signal)
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case <-ch:
+	case sig := <-term:
+		logger.Println(logger.INFO, "[sid] Signal '"+sig.String()+"' received.")
+	}
+	shutdown(pool, ctrl, append(httpSrvs, ctrlSrv), term)
 	logger.Println(logger.INFO, "[sid] Application terminated.")
 }
+
+//---------------------------------------------------------------------
+/*
+ * Graceful shutdown: stop accepting client and control connections and
+ * wait for active sessions to finish (max. 'ShutdownTimeout' seconds or
+ * until a termination signal is received again); remaining sessions are
+ * terminated. Running document uploads are completed before incomplete
+ * upload files are removed.
+ * @param pool *CoverPool - pool of cover servers
+ * @param ctrl *ControlSrv - control service
+ * @param list []*ServiceListener - listeners for client and control sessions
+ * @param term chan os.Signal - termination signals
+ */
+func shutdown(pool *CoverPool, ctrl *ControlSrv, list []*ServiceListener, term chan os.Signal) {
+	logger.Println(logger.INFO, "[sid] Shutting down...")
+	for _, l := range list {
+		l.Close()
+	}
+	// a (further) termination signal ends the waiting for sessions
+	abort := make(chan bool)
+	go func() {
+		if sig, ok := <-term; ok {
+			logger.Println(logger.WARN, "[sid] Signal '"+sig.String()+"' received -- terminating sessions.")
+			close(abort)
+		}
+	}()
+	defer func() {
+		signal.Stop(term)
+		close(term)
+	}()
+
+	// wait for active sessions
+	timeout := time.Duration(GetConfig().ShutdownTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+	drained := true
+	for _, l := range list {
+		drained = l.Wait(deadline.Sub(time.Now()), abort) && drained
+	}
+	if !drained {
+		// terminate remaining sessions
+		for _, c := range pool.Covers() {
+			for _, s := range c.States.List() {
+				logger.Printf(logger.WARN, "[sid] Terminating session %d (client '%s')\n", s.Id, s.Client)
+				s.Kill()
+			}
+		}
+		ctrl.closeSessions()
+		for _, l := range list {
+			if !l.Wait(SHUTDOWN_KILL_WAIT, nil) {
+				logger.Println(logger.WARN, "[sid] Sessions on "+l.Addr+" did not terminate.")
+			}
+		}
+	}
+	// wait for document post-processing and clean up
+	WaitForUploads()
+	if h := GetDocumentHandler(); h != nil {
+		h.Cleanup()
+	}
+}
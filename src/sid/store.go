@@ -0,0 +1,361 @@
+/*
+ * Document stores: Uploaded documents (and the associated shares) are
+ * stored as objects in a document store. Objects only become visible
+ * in the store when they are complete; incomplete objects are removed.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/bfix/gospel/logger"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// file name extension of incomplete upload files
+	UPLOAD_PART_EXT = ".part"
+	// name prefix of spool directories and files (remote stores)
+	SPOOL_PREFIX = "sid-spool-"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Public types
+
+/*
+ * Document store: Storage backend for uploaded documents.
+ */
+type DocumentStore interface {
+	// Create a new (incomplete) object.
+	Create(name string) (StoreObject, error)
+	// Remove a (complete) object.
+	Remove(name string) error
+	// Remove incomplete objects (left over from a crashed instance);
+	// also called for the store of a replaced document handler (when
+	// all its uploads are finished).
+	Cleanup()
+	// Get a description of the store (for logging).
+	String() string
+}
+
+//---------------------------------------------------------------------
+/*
+ * Object in a document store: Data is written to the object, which is
+ * either committed (and becomes visible in the store) or aborted.
+ */
+type StoreObject interface {
+	io.Writer
+	// Complete object.
+	Commit() error
+	// Discard object.
+	Abort()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Optional factory for custom document stores: called for store types
+ * not handled by SID.
+ */
+var CustomDocumentStore func(defs UploadDefs) (DocumentStore, error) = nil
+
+///////////////////////////////////////////////////////////////////////
+// Public functions
+
+/*
+ * Create document store for the upload settings.
+ * @param defs UploadDefs - upload-related settings
+ * @return DocumentStore - document store
+ * @return error - error object (or nil)
+ */
+func NewDocumentStore(defs UploadDefs) (DocumentStore, error) {
+	switch strings.ToUpper(defs.Store) {
+	case "", "LOCAL":
+		return NewLocalStore(defs.Path)
+	case "S3":
+		return NewS3Store(defs.StoreURL, defs.StoreRegion, defs.StoreUser, defs.StorePassword)
+	case "WEBDAV":
+		return NewWebDAVStore(defs.StoreURL, defs.StoreUser, defs.StorePassword)
+	}
+	if CustomDocumentStore != nil {
+		return CustomDocumentStore(defs)
+	}
+	return nil, errors.New("unknown document store '" + defs.Store + "'")
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Local document store: objects are files in a directory; incomplete
+ * objects have the extension ".part".
+ */
+type LocalStore struct {
+	path string // directory of store
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new local document store.
+ * @param path string - directory of store
+ * @return *LocalStore - new document store
+ * @return error - error object (or nil)
+ */
+func NewLocalStore(path string) (*LocalStore, error) {
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		return nil, errors.New("upload directory '" + path + "' not available")
+	}
+	return &LocalStore{path}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new (incomplete) object.
+ * @param name string - name of object
+ * @return StoreObject - new object
+ * @return error - error object (or nil)
+ */
+func (s *LocalStore) Create(name string) (StoreObject, error) {
+	fname := filepath.Join(s.path, name)
+	f, err := os.OpenFile(fname+UPLOAD_PART_EXT, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &localObject{f, fname}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove a (complete) object.
+ * @param name string - name of object
+ * @return error - error object (or nil)
+ */
+func (s *LocalStore) Remove(name string) error {
+	return os.Remove(filepath.Join(s.path, name))
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove incomplete upload files (left over from an aborted or crashed
+ * post-processing) from the upload directory.
+ */
+func (s *LocalStore) Cleanup() {
+	removeFiles(filepath.Join(s.path, "*"+UPLOAD_PART_EXT))
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get a description of the store.
+ * @return string - description
+ */
+func (s *LocalStore) String() string {
+	return "local:" + s.path
+}
+
+//=====================================================================
+/*
+ * Object in a local store.
+ */
+type localObject struct {
+	file  *os.File // incomplete file
+	fname string   // final name of file
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write data to object (implements io.Writer interface).
+ * @param data []byte - data
+ * @return int - number of bytes written
+ * @return error - error object (or nil)
+ */
+func (o *localObject) Write(data []byte) (int, error) {
+	return o.file.Write(data)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Complete object: close and rename file.
+ * @return error - error object (or nil)
+ */
+func (o *localObject) Commit() error {
+	if err := o.file.Close(); err != nil {
+		os.Remove(o.file.Name())
+		return err
+	}
+	return os.Rename(o.file.Name(), o.fname)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Discard object: close and remove file.
+ */
+func (o *localObject) Abort() {
+	o.file.Close()
+	os.Remove(o.file.Name())
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Spooled object (for remote stores): the data is written to a
+ * temporary file and sent to the store when the object is committed.
+ */
+type spoolObject struct {
+	file    *os.File                                        // spool file
+	hash    hash.Hash                                       // SHA-256 hash of data
+	size    int64                                           // size of data
+	publish func(rdr io.Reader, size int64, h []byte) error // send data to store
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new spooled object.
+ * @param sd *spoolDir - spool directory of store
+ * @param publish func(io.Reader, int64, []byte) error - send data to store
+ * @return *spoolObject - new object
+ * @return error - error object (or nil)
+ */
+func newSpoolObject(sd *spoolDir, publish func(rdr io.Reader, size int64, h []byte) error) (*spoolObject, error) {
+	dir, err := sd.get()
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, SPOOL_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	return &spoolObject{
+		file:    f,
+		hash:    sha256.New(),
+		size:    0,
+		publish: publish,
+	}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write data to object (implements io.Writer interface).
+ * @param data []byte - data
+ * @return int - number of bytes written
+ * @return error - error object (or nil)
+ */
+func (o *spoolObject) Write(data []byte) (int, error) {
+	n, err := o.file.Write(data)
+	o.hash.Write(data[:n])
+	o.size += int64(n)
+	return n, err
+}
+
+//---------------------------------------------------------------------
+/*
+ * Complete object: send spooled data to store.
+ * @return error - error object (or nil)
+ */
+func (o *spoolObject) Commit() error {
+	defer o.Abort()
+	if _, err := o.file.Seek(0, 0); err != nil {
+		return err
+	}
+	return o.publish(o.file, o.size, o.hash.Sum(nil))
+}
+
+//---------------------------------------------------------------------
+/*
+ * Discard object: remove spool file.
+ */
+func (o *spoolObject) Abort() {
+	o.file.Close()
+	os.Remove(o.file.Name())
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Remove files matching a pattern.
+ * @param pattern string - file name pattern
+ */
+func removeFiles(pattern string) {
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			logger.Printf(logger.ERROR, "[sid.store] Can't remove incomplete file '%s': %s\n", name, err.Error())
+		} else {
+			logger.Printf(logger.WARN, "[sid.store] Incomplete file '%s' removed.\n", name)
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * Spool directory of a remote store: the directory is created on first
+ * use (with access for the owner only), so spool files of other stores
+ * and instances are never touched.
+ */
+type spoolDir struct {
+	lock sync.Mutex // lock for spool directory
+	path string     // spool directory ("": none)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get the spool directory (created on demand).
+ * @return string - spool directory
+ * @return error - error object (or nil)
+ */
+func (sd *spoolDir) get() (string, error) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	if len(sd.path) == 0 {
+		dir, err := ioutil.TempDir("", SPOOL_PREFIX)
+		if err != nil {
+			return "", err
+		}
+		sd.path = dir
+	}
+	return sd.path, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove the spool directory (and left-over spool files in it).
+ */
+func (sd *spoolDir) remove() {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	if len(sd.path) == 0 {
+		return
+	}
+	removeFiles(filepath.Join(sd.path, SPOOL_PREFIX+"*"))
+	if err := os.Remove(sd.path); err != nil {
+		logger.Printf(logger.ERROR, "[sid.store] Can't remove spool directory '%s': %s\n", sd.path, err.Error())
+	}
+	sd.path = ""
+}
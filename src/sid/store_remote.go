@@ -0,0 +1,366 @@
+/*
+ * Remote document stores: Objects are pushed to an S3-compatible object
+ * store or to a WebDAV collection when they are complete.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Constants
+
+const (
+	// timeout for requests to remote stores
+	STORE_TIMEOUT = 60 * time.Second
+	// default region of S3 stores
+	S3_DEFAULT_REGION = "us-east-1"
+)
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * S3-compatible object store: objects are stored in a bucket (with an
+ * optional key prefix) specified by a path-style URL like
+ * "https://s3.example.org/bucket/prefix/". Requests are signed with
+ * AWS signature version 4.
+ */
+type S3Store struct {
+	base   *url.URL     // URL of bucket (and key prefix)
+	region string       // region of bucket
+	key    string       // access key id
+	secret string       // secret access key
+	client *http.Client // HTTP client
+	spool  spoolDir     // spool directory for objects
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new S3-compatible document store.
+ * @param base string - URL of bucket (and key prefix)
+ * @param region string - region of bucket
+ * @param key string - access key id
+ * @param secret string - secret access key
+ * @return *S3Store - new document store
+ * @return error - error object (or nil)
+ */
+func NewS3Store(base, region, key, secret string) (*S3Store, error) {
+	u, err := parseStoreURL(base)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 || len(secret) == 0 {
+		return nil, errors.New("S3 store requires access key and secret")
+	}
+	if len(region) == 0 {
+		region = S3_DEFAULT_REGION
+	}
+	return &S3Store{
+		base:   u,
+		region: region,
+		key:    key,
+		secret: secret,
+		client: &http.Client{Timeout: STORE_TIMEOUT},
+	}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new (incomplete) object.
+ * @param name string - name of object
+ * @return StoreObject - new object
+ * @return error - error object (or nil)
+ */
+func (s *S3Store) Create(name string) (StoreObject, error) {
+	return newSpoolObject(&s.spool, func(rdr io.Reader, size int64, h []byte) error {
+		return s.request("PUT", name, rdr, size, h)
+	})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove a (complete) object.
+ * @param name string - name of object
+ * @return error - error object (or nil)
+ */
+func (s *S3Store) Remove(name string) error {
+	h := sha256.Sum256(nil)
+	return s.request("DELETE", name, nil, 0, h[:])
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove incomplete objects: incomplete objects are never sent to the
+ * store, so only the spool directory of this store is removed.
+ */
+func (s *S3Store) Cleanup() {
+	s.spool.remove()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get a description of the store.
+ * @return string - description
+ */
+func (s *S3Store) String() string {
+	return "s3:" + s.base.String()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Send signed request for an object to the store.
+ * @param method string - request method
+ * @param name string - name of object
+ * @param body io.Reader - request body (or nil)
+ * @param size int64 - size of body
+ * @param h []byte - SHA-256 hash of body
+ * @return error - error object (or nil)
+ */
+func (s *S3Store) request(method, name string, body io.Reader, size int64, h []byte) error {
+	req, err := newStoreRequest(method, s.base, name, body, size)
+	if err != nil {
+		return err
+	}
+	s.sign(req, hex.EncodeToString(h), time.Now().UTC())
+	return doStoreRequest(s.client, req)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Sign request (AWS signature version 4).
+ * @param req *http.Request - request
+ * @param payload string - hex-encoded SHA-256 hash of body
+ * @param now time.Time - time of request
+ */
+func (s *S3Store) sign(req *http.Request, payload string, now time.Time) {
+	stamp := now.Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("x-amz-date", stamp)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + stamp,
+		"",
+		headers,
+		payload,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	ch := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(ch[:])
+
+	key := []byte("AWS4" + s.secret)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.key+"/"+scope+
+		", SignedHeaders="+headers+", Signature="+sig)
+}
+
+///////////////////////////////////////////////////////////////////////
+/*
+ * WebDAV document store: objects are pushed to a WebDAV collection
+ * specified by an URL like "https://dav.example.org/uploads/" (using
+ * basic authentication if a user name is set).
+ */
+type WebDAVStore struct {
+	base     *url.URL     // URL of collection
+	user     string       // user name
+	password string       // password
+	client   *http.Client // HTTP client
+	spool    spoolDir     // spool directory for objects
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new WebDAV document store.
+ * @param base string - URL of collection
+ * @param user string - user name (or empty)
+ * @param password string - password
+ * @return *WebDAVStore - new document store
+ * @return error - error object (or nil)
+ */
+func NewWebDAVStore(base, user, password string) (*WebDAVStore, error) {
+	u, err := parseStoreURL(base)
+	if err != nil {
+		return nil, err
+	}
+	return &WebDAVStore{
+		base:     u,
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: STORE_TIMEOUT},
+	}, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new (incomplete) object.
+ * @param name string - name of object
+ * @return StoreObject - new object
+ * @return error - error object (or nil)
+ */
+func (s *WebDAVStore) Create(name string) (StoreObject, error) {
+	return newSpoolObject(&s.spool, func(rdr io.Reader, size int64, h []byte) error {
+		return s.request("PUT", name, rdr, size)
+	})
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove a (complete) object.
+ * @param name string - name of object
+ * @return error - error object (or nil)
+ */
+func (s *WebDAVStore) Remove(name string) error {
+	return s.request("DELETE", name, nil, 0)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove incomplete objects: incomplete objects are never sent to the
+ * store, so only the spool directory of this store is removed.
+ */
+func (s *WebDAVStore) Cleanup() {
+	s.spool.remove()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get a description of the store.
+ * @return string - description
+ */
+func (s *WebDAVStore) String() string {
+	return "webdav:" + s.base.String()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Send request for an object to the store.
+ * @param method string - request method
+ * @param name string - name of object
+ * @param body io.Reader - request body (or nil)
+ * @param size int64 - size of body
+ * @return error - error object (or nil)
+ */
+func (s *WebDAVStore) request(method, name string, body io.Reader, size int64) error {
+	req, err := newStoreRequest(method, s.base, name, body, size)
+	if err != nil {
+		return err
+	}
+	if len(s.user) > 0 {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	return doStoreRequest(s.client, req)
+}
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Parse URL of a remote store (path is always terminated by '/').
+ * @param base string - URL of store
+ * @return *url.URL - parsed URL
+ * @return error - error object (or nil)
+ */
+func parseStoreURL(base string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, errors.New("invalid store URL '" + base + "'")
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create request for an object in a remote store.
+ * @param method string - request method
+ * @param base *url.URL - URL of store
+ * @param name string - name of object
+ * @param body io.Reader - request body (or nil)
+ * @param size int64 - size of body
+ * @return *http.Request - new request
+ * @return error - error object (or nil)
+ */
+func newStoreRequest(method string, base *url.URL, name string, body io.Reader, size int64) (*http.Request, error) {
+	u := *base
+	u.Path += name
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return req, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Send request to a remote store.
+ * @param client *http.Client - HTTP client
+ * @param req *http.Request - request
+ * @return error - error object (or nil)
+ */
+func doStoreRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(req.Method + " " + req.URL.String() + " failed: " + strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Compute HMAC-SHA256 of data.
+ * @param key []byte - key
+ * @param data string - data
+ * @return []byte - message authentication code
+ */
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
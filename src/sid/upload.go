@@ -30,172 +30,643 @@ package sid
 import (
 	"code.google.com/p/go.crypto/openpgp"
 	"code.google.com/p/go.crypto/openpgp/armor"
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/bfix/gospel/crypto"
 	"github.com/bfix/gospel/logger"
+	"hash"
 	"io"
 	"math/big"
 	"os"
+	"path/filepath"
+	"sid/container"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 ///////////////////////////////////////////////////////////////////////
 // Document handling: Store and encrypt client uploads
 ///////////////////////////////////////////////////////////////////////
 
-var uploadPath string = "./uploads"
-var reviewer openpgp.EntityList = nil
-var treshold int = 2
-var prime *big.Int = nil
+/*
+ * Document handler: settings for storing client uploads. A new handler
+ * is created when the configuration is reloaded; sessions keep the
+ * handler that was active when they started.
+ */
+type DocumentHandler struct {
+	store     DocumentStore     // store for client uploads
+	reviewers *ReviewerRegistry // public keys of reviewers
+	treshold  int               // number of reviewers required to access documents
+	prime     *big.Int          // prime number for secret sharing
+	maxSize   int64             // max. size of uploaded documents (0: unlimited)
+	open      sync.WaitGroup    // unfinished uploads of this handler
+}
+
+// error for document uploads exceeding the max. size
+var ErrUploadTooLarge = errors.New("document upload too large")
+
+// error for document uploads completed during shutdown
+var ErrShutdown = errors.New("shutting down")
+
+const (
+	SHARE_KEY_BITS = 8 * container.KEY_SIZE // size of document keys (bits)
+	PRIME_ROUNDS   = 32                     // rounds of probable-prime test
+)
+
+var (
+	docLock       sync.RWMutex     // lock for current document handler
+	docHandler    *DocumentHandler // current document handler
+	uploadsActive activeGroup      // running post-processing of uploads
+)
 
+//---------------------------------------------------------------------
+/*
+ * Initialize document handling at start-up: terminates the application
+ * if the handler can't be set up.
+ * @param defs UploadDefs - upload-related settings
+ */
 func InitDocumentHandler(defs UploadDefs) {
+	h, err := NewDocumentHandler(defs)
+	if err != nil {
+		// can't handle uploads -- terminate!
+		logger.Printf(logger.ERROR, "[sid.upload] %s -- terminating!\n", err.Error())
+		os.Exit(1)
+	}
+	// remove left-overs of an aborted instance
+	h.Cleanup()
+	setDocumentHandler(h)
+}
 
-	// initialize upload handling parameters
-	uploadPath = defs.Path
-	treshold = defs.ShareTreshold
+//---------------------------------------------------------------------
+/*
+ * Create a new document handler.
+ * @param defs UploadDefs - upload-related settings
+ * @return *DocumentHandler - new document handler
+ * @return error - error object (or nil)
+ */
+func NewDocumentHandler(defs UploadDefs) (*DocumentHandler, error) {
+
+	// setup document store
+	store, err := NewDocumentStore(defs)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf(logger.INFO, "[sid.upload] Document store: %s\n", store.String())
 
+	// initialize upload handling parameters
+	h := &DocumentHandler{
+		store:     store,
+		reviewers: nil,
+		treshold:  defs.ShareTreshold,
+		prime:     nil,
+		maxSize:   int64(defs.MaxSize) << 20,
+	}
 	// check for disabled secret sharing scheme
-	if treshold > 0 {
-		// compute prime: (2^512-1) - SharePrimeOfs
-		one := big.NewInt(1)
-		ofs := big.NewInt(int64(defs.SharePrimeOfs))
-		prime = new(big.Int).Lsh(one, 512)
-		prime = new(big.Int).Sub(prime, one)
-		prime = new(big.Int).Sub(prime, ofs)
-
-		// open keyring file
-		rdr, err := os.Open(defs.Keyring)
-		if err != nil {
-			// can't read keys -- terminate!
-			logger.Printf(logger.ERROR, "[sid.upload] Can't read keyring file '%s' -- terminating!\n", defs.Keyring)
-			os.Exit(1)
+	if h.treshold > 0 {
+		// get (and check) prime for the secret sharing scheme
+		if h.prime, err = SharePrime(defs.SharePrime, defs.SharePrimeOffset); err != nil {
+			return nil, err
 		}
-		defer rdr.Close()
+		logger.Printf(logger.INFO, "[sid.upload] Secret sharing: treshold %d, %d-bit prime field\n", h.treshold, h.prime.BitLen())
 
-		// read public keys from keyring
-		if reviewer, err = openpgp.ReadKeyRing(rdr); err != nil {
-			// can't read keys -- terminate!
-			logger.Printf(logger.ERROR, "[sid.upload] Failed to process keyring '%s' -- terminating!\n", defs.Keyring)
-			os.Exit(1)
+		// read and check public keys of reviewers
+		if h.reviewers, err = NewReviewerRegistry(defs.Keyring, defs.Reviewers, h.treshold); err != nil {
+			return nil, err
 		}
+		h.reviewers.LogSummary()
 	} else {
 		logger.Printf(logger.WARN, "[sid.upload] Secret sharing scheme disabled -- uploads will be stored unencrypted!!")
 	}
+	return h, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get prime for the secret sharing scheme: the field must be larger
+ * than the range of document keys. An explicit prime is checked with a
+ * probable-prime test; otherwise the smallest (probable) prime above
+ * 2^n + ofs is used (n: size of document keys in bits).
+ * @param prime string - explicit prime (decimal or "0x" hex; "": none)
+ * @param ofs int - offset for prime search
+ * @return *big.Int - prime
+ * @return error - error object (or nil)
+ */
+func SharePrime(prime string, ofs int) (*big.Int, error) {
+	min := new(big.Int).Lsh(big.NewInt(1), SHARE_KEY_BITS)
+	if len(prime) > 0 {
+		p, ok := new(big.Int).SetString(prime, 0)
+		if !ok {
+			return nil, errors.New("invalid prime for secret sharing")
+		}
+		if p.Cmp(min) <= 0 {
+			return nil, fmt.Errorf("prime for secret sharing must be larger than 2^%d", SHARE_KEY_BITS)
+		}
+		if !p.ProbablyPrime(PRIME_ROUNDS) {
+			return nil, errors.New("modulus for secret sharing is not prime")
+		}
+		return p, nil
+	}
+	p := new(big.Int).Add(min, big.NewInt(int64(ofs)))
+	p.SetBit(p, 0, 1)
+	two := big.NewInt(2)
+	for !p.ProbablyPrime(PRIME_ROUNDS) {
+		p.Add(p, two)
+	}
+	return p, nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get current document handler.
+ * @return *DocumentHandler - current document handler
+ */
+func GetDocumentHandler() *DocumentHandler {
+	docLock.RLock()
+	defer docLock.RUnlock()
+	return docHandler
+}
+
+//---------------------------------------------------------------------
+/*
+ * Set current document handler.
+ * @param h *DocumentHandler - new document handler
+ */
+func setDocumentHandler(h *DocumentHandler) {
+	docLock.Lock()
+	defer docLock.Unlock()
+	docHandler = h
+}
+
+//=====================================================================
+/*
+ * Upload sink: the content of a document upload is encrypted and
+ * written to the document store while it is received; the metadata
+ * record and the shares of the document key are created when the
+ * upload is complete.
+ */
+type UploadSink struct {
+	Meta container.Metadata // metadata of document (set by caller)
+
+	hdlr  *DocumentHandler // document handler
+	files *uploadFiles     // objects created for the upload
+	name  string           // base name of objects
+	doc   io.Writer        // output for document data
+	enc   io.WriteCloser   // document encryption (nil: unencrypted)
+	key   []byte           // document key
+	size  int64            // size of received document data
+	hash  hash.Hash        // hash value of received document data
+	err   error            // upload failed (or complete)
+	open  bool             // upload registered with handler?
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create a new sink for a document upload: the document object is
+ * created in the store immediately.
+ * @param h *DocumentHandler - document handler (nil: current handler)
+ * @return *UploadSink - new upload sink
+ */
+func NewUploadSink(h *DocumentHandler) *UploadSink {
+	if h == nil {
+		h = GetDocumentHandler()
+	}
+	u := &UploadSink{
+		hdlr: h,
+		name: CreateId(16),
+		hash: sha256.New(),
+	}
+	if h == nil {
+		logger.Println(logger.ERROR, "[sid.upload] No document handler available")
+		u.err = errors.New("no document handler")
+		return u
+	}
+	// objects are written as incomplete objects first; they are
+	// committed when post-processing is complete (or removed on failure).
+	u.files = &uploadFiles{store: h.store}
+	h.open.Add(1)
+	u.open = true
+
+	// check if we use a shared secret scheme
+	fname := u.name + ".document"
+	if h.reviewers != nil {
+		// yes: encrypt document with a new document key
+		fname += ".aes256"
+		u.key = crypto.RandBytes(container.KEY_SIZE)
+		logger.Println(logger.DBG_ALL, "[sid.upload] key:\n"+hex.Dump(u.key))
+	}
+	wrt, err := u.files.create(fname)
+	if err != nil {
+		logger.Printf(logger.ERROR, "[sid.upload] Can't create document file '%s'\n", fname)
+		u.fail(err)
+		return u
+	}
+	u.doc = wrt
+	if u.key != nil {
+		if u.enc, err = container.NewWriter(wrt, u.key); err != nil {
+			u.fail(err)
+			return u
+		}
+		u.doc = u.enc
+	}
+	return u
+}
+
+//---------------------------------------------------------------------
+/*
+ * Add uploaded data (implements io.Writer interface).
+ * @param data []byte - uploaded document data
+ * @return int - number of bytes processed
+ * @return error - error object (or nil)
+ */
+func (u *UploadSink) Write(data []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	u.size += int64(len(data))
+	if max := u.hdlr.maxSize; max > 0 && u.size > max {
+		logger.Printf(logger.WARN, "[sid.upload] Document upload exceeds max. size of %d bytes\n", max)
+		u.fail(ErrUploadTooLarge)
+		return 0, u.err
+	}
+	logger.Println(logger.DBG_ALL, "[sid.upload] Client upload data:\n"+string(data))
+	n, err := u.doc.Write(data)
+	u.hash.Write(data[:n])
+	if err != nil {
+		logger.Printf(logger.ERROR, "[sid.upload] Can't write document file: %s\n", err.Error())
+		u.fail(err)
+	}
+	return n, err
+}
+
+//---------------------------------------------------------------------
+/*
+ * Upload complete (implements io.Closer interface): finalize the
+ * document without additional form fields.
+ * @return error - error object (or nil)
+ */
+func (u *UploadSink) Close() error {
+	return u.Complete(nil)
+}
+
+//---------------------------------------------------------------------
+/*
+ * Upload complete: finalize the document, write the metadata record
+ * and create the shares of the document key.
+ * @param fields map[string]string - additional form fields (or nil)
+ * @return error - error object (or nil)
+ */
+func (u *UploadSink) Complete(fields map[string]string) error {
+	if u.err != nil {
+		return u.err
+	}
+	// keep track of running post-processing (shutdown)
+	if !uploadsActive.add() {
+		logger.Println(logger.WARN, "[sid.upload] Client upload discarded (shutting down)")
+		u.fail(ErrShutdown)
+		return ErrShutdown
+	}
+	defer uploadsActive.done()
+
+	logger.Printf(logger.INFO, "[sid.upload] Client upload received (%d bytes)\n", u.size)
+	if u.enc != nil {
+		if err := u.enc.Close(); err != nil {
+			logger.Printf(logger.ERROR, "[sid.upload] Can't write document file: %s\n", err.Error())
+			u.fail(err)
+			return err
+		}
+	}
+	// write metadata record
+	u.Meta.Size = u.size
+	u.Meta.SHA256 = hex.EncodeToString(u.hash.Sum(nil))
+	u.Meta.SetDate(time.Now())
+	if len(fields) > 0 {
+		u.Meta.Fields = make(map[string]string)
+		for k, v := range fields {
+			u.Meta.Fields[k] = v
+		}
+	}
+	if err := u.writeMeta(); err != nil {
+		logger.Printf(logger.ERROR, "[sid.upload] Can't write metadata file: %s\n", err.Error())
+		u.fail(err)
+		return err
+	}
+	// create shares of document key
+	if u.key != nil {
+		if err := u.hdlr.writeShares(u.files, u.name, u.key); err != nil {
+			logger.Printf(logger.ERROR, "[sid.upload] Can't create shares: %s\n", err.Error())
+			u.fail(err)
+			return err
+		}
+	}
+	// complete upload files
+	if err := u.files.commit(); err != nil {
+		logger.Printf(logger.ERROR, "[sid.upload] Can't complete upload files: %s\n", err.Error())
+		u.fail(err)
+		return err
+	}
+	u.err = errors.New("upload complete")
+	u.release()
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Abort upload: all objects created for the upload are removed.
+ */
+func (u *UploadSink) Abort() {
+	if u.err == nil {
+		u.fail(errors.New("upload aborted"))
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Write metadata record (encrypted with the document key if the
+ * secret sharing scheme is used).
+ * @return error - error object (or nil)
+ */
+func (u *UploadSink) writeMeta() error {
+	fname := u.name + ".meta"
+	if u.key != nil {
+		fname += ".aes256"
+	}
+	wrt, err := u.files.create(fname)
+	if err != nil {
+		return err
+	}
+	if u.key == nil {
+		return u.Meta.Write(wrt)
+	}
+	enc, err := container.NewWriter(wrt, u.key)
+	if err != nil {
+		return err
+	}
+	if err = u.Meta.Write(enc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Upload failed: remove all objects created for the upload.
+ * @param err error - reason of failure
+ */
+func (u *UploadSink) fail(err error) {
+	u.err = err
+	u.files.abort()
+	u.release()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Upload finished: release the upload from its handler.
+ */
+func (u *UploadSink) release() {
+	if u.open {
+		u.open = false
+		u.hdlr.open.Done()
+	}
 }
 
 //=====================================================================
 /*
- * Client upload data received.
+ * Client upload data received (handled by the current document
+ * handler).
  * @param data []byte - uploaded document data
  * @return bool - post-processing successful?
  */
 func PostprocessUploadData(data []byte) bool {
+	h := GetDocumentHandler()
+	if h == nil {
+		logger.Println(logger.ERROR, "[sid.upload] No document handler available")
+		return false
+	}
+	return h.Process(data)
+}
 
-	logger.Println(logger.INFO, "[sid.upload] Client upload received")
-	logger.Println(logger.DBG_ALL, "[sid.upload] Client upload data:\n"+string(data))
+//---------------------------------------------------------------------
+/*
+ * Store client upload data.
+ * @param data []byte - uploaded document data
+ * @return bool - post-processing successful?
+ */
+func (h *DocumentHandler) Process(data []byte) bool {
+	u := NewUploadSink(h)
+	if _, err := u.Write(data); err != nil {
+		return false
+	}
+	return u.Close() == nil
+}
 
-	baseName := uploadPath + "/" + CreateId(16)
+//---------------------------------------------------------------------
+/*
+ * Create shares of a document key for all reviewers with usable keys:
+ * shares that can't be created are skipped, but at least the number of
+ * shares required to access the document must be created. The
+ * commitment to the document key is written with the shares.
+ * @param files *uploadFiles - objects created for the upload
+ * @param name string - base name of objects
+ * @param key []byte - document key
+ * @return error - error object (or nil)
+ */
+func (h *DocumentHandler) writeShares(files *uploadFiles, name string, key []byte) error {
+	var (
+		err error
+		wrt StoreObject    = nil
+		ct  io.WriteCloser = nil
+		pt  io.WriteCloser = nil
+	)
+	reviewers, err := h.reviewers.Entities()
+	if err != nil {
+		return err
+	}
+	// write commitment to document key (allows verification of the
+	// recovered key)
+	if wrt, err = files.create(name + ".commit"); err != nil {
+		return err
+	}
+	if _, err = wrt.Write([]byte(container.KeyCommitment(name, key) + "\n")); err != nil {
+		return err
+	}
+	secret := new(big.Int).SetBytes(key)
+	n := len(reviewers)
+	shares := crypto.Split(secret, h.prime, n, h.treshold)
+	recipient := make([]*openpgp.Entity, 1)
+	count := 0
 
-	// check if we use a shared secret scheme
-	if reviewer == nil {
-		// no: store content unencrypted.
-		fname := baseName + ".document"
-		wrt, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	for i, ent := range reviewers {
+		// generate filename based on key id
+		id := strconv.FormatUint(ent.PrimaryKey.KeyId&0xFFFFFFFF, 16)
+		fname := name + "." + strings.ToUpper(id) + ".gpg"
+		// create file for output
+		if wrt, err = files.create(fname); err != nil {
+			logger.Printf(logger.ERROR, "[sid.upload] Can't create share file '%s'\n", fname)
+			continue
+		}
+		// create PGP armorer
+		if ct, err = armor.Encode(wrt, "PGP MESSAGE", nil); err != nil {
+			logger.Printf(logger.ERROR, "[sid.upload] Can't create armorer: %s\n", err.Error())
+			files.discard(fname)
+			continue
+		}
+		// encrypt share to file
+		recipient[0] = ent
+		if pt, err = openpgp.Encrypt(ct, recipient, nil, nil, nil); err != nil {
+			logger.Printf(logger.ERROR, "[sid.upload] Can't create encrypter: %s\n", err.Error())
+			ct.Close()
+			files.discard(fname)
+			continue
+		}
+		share := &container.Share{
+			Document: name,
+			P:        shares[i].P,
+			X:        shares[i].X,
+			Y:        shares[i].Y,
+		}
+		err = share.Write(pt)
+		if cerr := pt.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := ct.Close(); err == nil {
+			err = cerr
+		}
 		if err != nil {
-			logger.Printf(logger.ERROR, "[sid.upload] Can't create document file '%s'\n", fname)
-			return false
+			logger.Printf(logger.ERROR, "[sid.upload] Can't write share file '%s': %s\n", fname, err.Error())
+			files.discard(fname)
+			continue
 		}
-		// write content and close file
-		wrt.Write(data)
-		wrt.Close()
-	} else {
-		// yes: use shared secret scheme to store upload in encrypted form.
-		var (
-			err    error
-			engine cipher.Block   = nil
-			wrt    io.WriteCloser = nil
-			ct     io.WriteCloser = nil
-			pt     io.WriteCloser = nil
-		)
-
-		//-----------------------------------------------------------------
-		// setup AES-256 for encryption
-		//-----------------------------------------------------------------
-		key := crypto.RandBytes(32)
-		if engine, err = aes.NewCipher(key); err != nil {
-			// should not happen at all; epic fail if it does
-			logger.Println(logger.ERROR, "[sid.upload] Failed to setup AES cipher!")
-			return false
-		}
-		bs := engine.BlockSize()
-		iv := crypto.RandBytes(bs)
-		enc := cipher.NewCFBEncrypter(engine, iv)
-
-		logger.Println(logger.DBG_ALL, "[sid.upload] key:\n"+hex.Dump(key))
-		logger.Println(logger.DBG_ALL, "[sid.upload] IV:\n"+hex.Dump(iv))
-
-		//-----------------------------------------------------------------
-		// encrypt client document into file
-		//-----------------------------------------------------------------
-
-		// open file for output
-		fname := baseName + ".document.aes256"
-		if wrt, err = os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
-			logger.Printf(logger.ERROR, "[sid.upload] Can't create document file '%s'\n", fname)
-			return false
-		}
-		// write iv first
-		wrt.Write(iv)
-		// encrypt binary data for the document
-		logger.Println(logger.DBG_ALL, "[sid.upload] AES256 in:\n"+hex.Dump(data))
-		enc.XORKeyStream(data, data)
-		logger.Println(logger.DBG_ALL, "[sid.upload] AES256 out:\n"+hex.Dump(data))
-		// write to file
-		wrt.Write(data)
-		wrt.Close()
-
-		//-----------------------------------------------------------------
-		//	create shares from secret
-		//-----------------------------------------------------------------
-		secret := new(big.Int).SetBytes(key)
-		n := len(reviewer)
-		shares := crypto.Split(secret, prime, n, treshold)
-		recipient := make([]*openpgp.Entity, 1)
-
-		for i, ent := range reviewer {
-			// generate filename based on key id
-			id := strconv.FormatUint(ent.PrimaryKey.KeyId&0xFFFFFFFF, 16)
-			fname = baseName + "." + strings.ToUpper(id) + ".gpg"
-			// create file for output
-			if wrt, err = os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
-				logger.Printf(logger.ERROR, "[sid.upload] Can't create share file '%s'\n", fname)
-				continue
-			}
-			// create PGP armorer
-			if ct, err = armor.Encode(wrt, "PGP MESSAGE", nil); err != nil {
-				logger.Printf(logger.ERROR, "[sid.upload] Can't create armorer: %s\n", err.Error())
-				wrt.Close()
-				continue
-			}
-			// encrypt share to file
-			recipient[0] = ent
-			if pt, err = openpgp.Encrypt(ct, recipient, nil, nil, nil); err != nil {
-				logger.Printf(logger.ERROR, "[sid.upload] Can't create encrypter: %s\n", err.Error())
-				ct.Close()
-				wrt.Close()
-				continue
+		count++
+	}
+	if count < h.treshold {
+		return fmt.Errorf("only %d share(s) created for a share treshold of %d", count, h.treshold)
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get reviewer registry of document handler.
+ * @return *ReviewerRegistry - reviewer registry (nil: secret sharing disabled)
+ */
+func (h *DocumentHandler) Reviewers() *ReviewerRegistry {
+	return h.reviewers
+}
+
+//---------------------------------------------------------------------
+/*
+ * Wait for running post-processing of document uploads; uploads that
+ * are completed afterwards are discarded.
+ */
+func WaitForUploads() {
+	uploadsActive.wait()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove incomplete objects (left over from an aborted or crashed
+ * post-processing) from the document store.
+ */
+func (h *DocumentHandler) Cleanup() {
+	h.store.Cleanup()
+}
+
+//---------------------------------------------------------------------
+/*
+ * Retire a replaced document handler: the store of the handler is
+ * cleaned up when all uploads of the handler are finished. A local
+ * store in the same upload directory as the store of the new handler
+ * is not cleaned up (the incomplete files of the new handler would be
+ * removed).
+ * @param next *DocumentHandler - new document handler
+ */
+func (h *DocumentHandler) retire(next *DocumentHandler) {
+	h.open.Wait()
+	if ls, ok := h.store.(*LocalStore); ok && next != nil {
+		if nls, ok := next.store.(*LocalStore); ok && filepath.Clean(nls.path) == filepath.Clean(ls.path) {
+			return
+		}
+	}
+	logger.Printf(logger.INFO, "[sid.upload] Cleaning up replaced document store '%s'\n", h.store.String())
+	h.Cleanup()
+}
+
+//=====================================================================
+/*
+ * List of objects created during the post-processing of an upload.
+ */
+type uploadFiles struct {
+	store DocumentStore // document store
+	names []string      // names of objects
+	objs  []StoreObject // incomplete objects
+	done  int           // number of committed objects
+}
+
+//---------------------------------------------------------------------
+/*
+ * Create (incomplete) upload object.
+ * @param name string - name of object
+ * @return StoreObject - object for output
+ * @return error - error object (or nil)
+ */
+func (f *uploadFiles) create(name string) (StoreObject, error) {
+	obj, err := f.store.Create(name)
+	if err == nil {
+		f.names = append(f.names, name)
+		f.objs = append(f.objs, obj)
+	}
+	return obj, err
+}
+
+//---------------------------------------------------------------------
+/*
+ * Discard a single (incomplete) upload object.
+ * @param name string - name of object
+ */
+func (f *uploadFiles) discard(name string) {
+	for i, n := range f.names {
+		if n == name {
+			f.objs[i].Abort()
+			f.names = append(f.names[:i], f.names[i+1:]...)
+			f.objs = append(f.objs[:i], f.objs[i+1:]...)
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Complete all upload objects.
+ * @return error - error object (or nil)
+ */
+func (f *uploadFiles) commit() error {
+	for ; f.done < len(f.objs); f.done++ {
+		if err := f.objs[f.done].Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+/*
+ * Remove all upload objects (complete and incomplete).
+ */
+func (f *uploadFiles) abort() {
+	for i, obj := range f.objs {
+		if i < f.done {
+			if err := f.store.Remove(f.names[i]); err != nil {
+				logger.Printf(logger.ERROR, "[sid.upload] Can't remove object '%s': %s\n", f.names[i], err.Error())
 			}
-			pt.Write([]byte(shares[i].P.String() + "\n"))
-			pt.Write([]byte(shares[i].X.String() + "\n"))
-			pt.Write([]byte(shares[i].Y.String() + "\n"))
-			pt.Close()
-			ct.Close()
-			wrt.Close()
+		} else {
+			obj.Abort()
 		}
 	}
-	// report success
-	return true
+	f.names = nil
+	f.objs = nil
+	f.done = 0
 }
@@ -0,0 +1,162 @@
+/*
+ * Document handling: replaced document handler tests.
+ *
+ * (c) 2012 Bernd Fix   >Y<
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or (at
+ * your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sid
+
+///////////////////////////////////////////////////////////////////////
+// Import external declarations.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Helper functions
+
+/*
+ * Create a document handler (without secret sharing) for a local store.
+ * @param t *testing.T - test instance
+ * @param dir string - upload directory
+ * @return *DocumentHandler - new document handler
+ */
+func testDocumentHandler(t *testing.T, dir string) *DocumentHandler {
+	store, err := NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DocumentHandler{store: store}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Get names of files in a directory matching a pattern.
+ * @param dir string - directory
+ * @param pattern string - file name pattern
+ * @return []string - list of file names
+ */
+func dirFiles(dir, pattern string) []string {
+	names, _ := filepath.Glob(filepath.Join(dir, pattern))
+	return names
+}
+
+///////////////////////////////////////////////////////////////////////
+// Test cases
+
+/*
+ * A replaced document handler is cleaned up when its uploads are
+ * finished.
+ */
+func TestRetireDocumentHandler(t *testing.T) {
+	dir1, err := ioutil.TempDir("", "sid-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	dir2, err := ioutil.TempDir("", "sid-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+
+	h1 := testDocumentHandler(t, dir1)
+	u := NewUploadSink(h1)
+	if _, err = u.Write([]byte("document")); err != nil {
+		t.Fatal(err)
+	}
+	// left-over of a crashed post-processing
+	if err = ioutil.WriteFile(filepath.Join(dir1, "left-over"+UPLOAD_PART_EXT), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		h1.retire(testDocumentHandler(t, dir2))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("handler retired with running upload")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err = u.Complete(nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler not retired")
+	}
+	if len(dirFiles(dir1, "*"+UPLOAD_PART_EXT)) != 0 {
+		t.Fatal("incomplete files not removed")
+	}
+	if len(dirFiles(dir1, "*.document")) != 1 || len(dirFiles(dir1, "*.meta")) != 1 {
+		t.Fatal("completed upload removed")
+	}
+
+	// aborted (and failed) uploads are finished too
+	u = NewUploadSink(h1)
+	u.Abort()
+	u.Abort()
+	h1.retire(nil)
+
+	// the store of the new handler is not touched
+	h2 := testDocumentHandler(t, dir1)
+	u = NewUploadSink(h2)
+	defer u.Abort()
+	h1.retire(h2)
+	if len(dirFiles(dir1, "*"+UPLOAD_PART_EXT)) != 1 {
+		t.Fatal("incomplete file of new handler removed")
+	}
+}
+
+//---------------------------------------------------------------------
+/*
+ * Uploads completed after waiting for the running post-processing
+ * (on shutdown) are discarded.
+ */
+func TestUploadShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sid-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := testDocumentHandler(t, dir)
+	u := NewUploadSink(h)
+	if _, err = u.Write([]byte("document")); err != nil {
+		t.Fatal(err)
+	}
+	WaitForUploads()
+	defer func() {
+		uploadsActive.lock.Lock()
+		uploadsActive.closed = false
+		uploadsActive.lock.Unlock()
+	}()
+	if err = u.Complete(nil); err != ErrShutdown {
+		t.Fatalf("upload completed on shutdown: %v", err)
+	}
+	if len(dirFiles(dir, "*")) != 0 {
+		t.Fatal("files of discarded upload not removed")
+	}
+	// the handler is not blocked by the discarded upload
+	h.retire(nil)
+}